@@ -14,4 +14,30 @@ type ApplicationMode = int
 const (
 	RouterMode ApplicationMode = iota
 	WebsocketMode
+	RespMode // Redis协议
+	MqttMode // MQTT 3.1.1
+)
+
+type LimitAction = int
+
+const (
+	LimitDrop  LimitAction = iota // 丢弃消息
+	LimitReply                    // 回复错误消息
+	LimitClose                    // 关闭连接
+)
+
+type VerifyAction = int
+
+const (
+	VerifyClose VerifyAction = iota // 关闭连接
+	VerifyDrop                      // 丢弃消息
+	VerifyPass                      // 交给路由处理，可以通过message.Seq()判断
+)
+
+type SniffResult = int
+
+const (
+	SniffNoMatch SniffResult = iota // 不是这个协议
+	SniffMatch                      // 是这个协议
+	SniffMore                       // 数据不足，需要等待更多数据
 )
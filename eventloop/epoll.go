@@ -3,8 +3,6 @@
 package eventloop
 
 import (
-	"io"
-
 	"github.com/ikilobyte/netman/util"
 
 	"github.com/ikilobyte/netman/iface"
@@ -81,6 +79,29 @@ func (p *Poller) Wait(emitCh chan<- iface.IContext) {
 				continue
 			}
 
+			// 0、开启了PROXY协议时，先读取PROXY协议头
+			if ready, err := connEvent.ReadProxyHeader(); err != nil || !ready {
+				if err != nil {
+					_ = conn.Close()
+					util.Logger.Errorf("read proxy protocol header error %v", err)
+				}
+				continue
+			}
+
+			// 开启了协议探测时，探测完成后使用实际的连接继续处理
+			if sniffer, ok := conn.(iface.IConnectSniffer); ok {
+				next, err := sniffer.Sniff()
+				if err != nil {
+					_ = conn.Close()
+					util.Logger.Errorf("sniff protocol error %v", err)
+					continue
+				}
+				if next == nil {
+					continue
+				}
+				conn, connEvent = next, next.(iface.IConnectEvent)
+			}
+
 			// 1、判断是否开启tls
 			if conn.GetTLSEnable() && conn.GetHandshakeCompleted() == false {
 
@@ -101,43 +122,11 @@ func (p *Poller) Wait(emitCh chan<- iface.IContext) {
 				}
 			}
 
-			// 2、非阻塞模式读取一个完整的包
-			message, err := connEvent.DecodePacket()
-			if err != nil {
-				switch err {
-				case io.EOF, util.HeadBytesLengthFail, util.BodyLenExceedLimit:
-					// 断开连接
-					_ = conn.Close()
-				case
-					util.WebsocketOpcodeFail,
-					util.WebsocketRsvFail,
-					util.WebsocketCtrlMessageMustNotFragmented,
-					util.WebsocketProtocolError,
-					util.WebsocketPingPayloadOversize:
-					_ = conn.(iface.IWebsocketCloser).CloseCode(1002, "protocol error.")
-				case util.WebsocketMustUtf8:
-					_ = conn.(iface.IWebsocketCloser).CloseCode(1007, "non-UTF-8 data within a text message")
-				default:
-
-					// 是udp客户端，且解析数据出现错误时，可以释放这个资源了
-					if conn.IsUDP() {
-						util.Logger.Error(err.Error())
-						_ = conn.Close()
-					}
-					continue
-				}
-			}
-
-			if message == nil {
-				continue
-			}
-
-			// 3、将消息传递出去，交给worker处理（websocket是可以发送payload长度为0的消息）
-			if message.Len() <= 0 && message.IsWebsocket() == false {
-				continue
+			// 2、读取并处理消息，一次读取解码出多个消息时（IStreamDecoder），需要全部处理完
+			p.read(conn, connEvent, emitCh)
+			for connEvent.HasPending() {
+				p.read(conn, connEvent, emitCh)
 			}
-
-			emitCh <- util.NewContext(util.NewRequest(conn, message, p.ConnectMgr))
 		}
 	}
 }
@@ -178,6 +167,20 @@ func (p *Poller) ModRead(fd, connID int) error {
 	})
 }
 
+//PauseRead 不再监听任何事件，出错（EPOLLERR、EPOLLHUP）时仍会通知
+func (p *Poller) PauseRead(fd, connID int) error {
+	return unix.EpollCtl(p.Epfd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{
+		Events: 0,
+		Fd:     int32(fd),
+		Pad:    int32(connID),
+	})
+}
+
+//ResumeRead .
+func (p *Poller) ResumeRead(fd, connID int) error {
+	return p.ModRead(fd, connID)
+}
+
 //Remove 删除某个fd的事件
 func (p *Poller) Remove(fd int) error {
 	return unix.EpollCtl(p.Epfd, unix.EPOLL_CTL_DEL, fd, nil)
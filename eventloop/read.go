@@ -0,0 +1,78 @@
+// +build linux darwin freebsd dragonfly
+
+package eventloop
+
+import (
+	"io"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//read 读取一个完整的包，交给worker处理
+func (p *Poller) read(conn iface.IConnect, connEvent iface.IConnectEvent, emitCh chan<- iface.IContext) {
+
+	// 1、非阻塞模式读取一个完整的包
+	message, err := connEvent.DecodePacket()
+	if err != nil {
+		// websocket消息太大、解压失败时使用对应的状态码关闭
+		if closer, ok := conn.(iface.IWebsocketCloser); ok {
+			switch err {
+			case util.BodyLenExceedLimit:
+				_ = closer.CloseCode(1009, "message too big")
+				return
+			case util.DecompressFail:
+				_ = closer.CloseCode(1007, "invalid compressed data")
+				return
+			}
+		}
+
+		switch err {
+		case io.EOF, util.HeadBytesLengthFail, util.BodyLenExceedLimit, util.DecompressFail,
+			util.ChecksumFail, util.SequenceFail:
+			// 断开连接
+			_ = conn.Close()
+		case
+			util.WebsocketOpcodeFail,
+			util.WebsocketRsvFail,
+			util.WebsocketCtrlMessageMustNotFragmented,
+			util.WebsocketProtocolError,
+			util.WebsocketPingPayloadOversize:
+			_ = conn.(iface.IWebsocketCloser).CloseCode(1002, "protocol error.")
+		case util.WebsocketMustUtf8:
+			_ = conn.(iface.IWebsocketCloser).CloseCode(1007, "non-UTF-8 data within a text message")
+		default:
+
+			// 是udp客户端，且解析数据出现错误时，可以释放这个资源了
+			if conn.IsUDP() {
+				util.Logger.Error(err.Error())
+				_ = conn.Close()
+			}
+			return
+		}
+	}
+
+	if message == nil {
+		return
+	}
+
+	// 2、将消息传递出去，交给worker处理（websocket是可以发送payload长度为0的消息）
+	if message.Len() <= 0 && message.IsWebsocket() == false {
+		return
+	}
+
+	// 3、超出接收速率限制的消息，不交给worker处理（内置协议在DecodePacket中解压、校验之前检查）
+	if err := connEvent.Allow(); err != nil {
+		if err == io.EOF {
+			_ = conn.Close()
+		}
+
+		// 流式路由的消息需要丢弃未接收的包体
+		if closer, ok := message.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return
+	}
+
+	emitCh <- util.NewContext(util.NewRequest(conn, message, p.ConnectMgr))
+}
@@ -0,0 +1,8 @@
+package iface
+
+//ICodec 编解码抽象层，负责包体和结构体之间的转换，可以自行实现，如：msgpack
+type ICodec interface {
+	Name() string                               // 名称
+	Marshal(v interface{}) ([]byte, error)      // 编码
+	Unmarshal(data []byte, v interface{}) error // 解码
+}
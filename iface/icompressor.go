@@ -0,0 +1,8 @@
+package iface
+
+// ICompressor 压缩算法抽象层，可以自行实现，如：zstd、snappy
+type ICompressor interface {
+	Name() string                                             // 名称
+	Compress(data []byte) ([]byte, error)                     // 压缩
+	Decompress(data []byte, maxLength uint32) ([]byte, error) // 解压，解压后超过maxLength（0表示不限制）时返回错误
+}
@@ -1,8 +1,10 @@
 package iface
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"net/http"
 	"net/url"
 	"time"
 
@@ -28,22 +30,49 @@ type IConnect interface {
 	GetCertificate() tls.Certificate
 	GetTLSLayer() *tls.Conn
 	GetConnectMgr() IConnectManager
-	Text([]byte) (int, error)        // 发送websocket text数据
-	Binary([]byte) (int, error)      // 发送 websocket 二进制格式数据
-	GetQueryStringParam() url.Values // 仅在websocket时可用
+	Text([]byte) (int, error)                    // 发送websocket text数据
+	Binary([]byte) (int, error)                  // 发送 websocket 二进制格式数据
+	GetQueryStringParam() url.Values             // 仅在websocket时可用
+	GetPath() string                             // 握手请求的路径，仅在websocket时可用
+	GetHeader() http.Header                      // 握手请求的header，仅在websocket时可用
+	GetCookie(name string) (*http.Cookie, error) // 握手请求中的cookie，仅在websocket时可用
+	GetSubprotocol() string                      // 握手时协商的子协议（Sec-WebSocket-Protocol），仅在websocket时可用
 	IsUDP() bool
+	SetIdentity(identity interface{}) // 认证成功后设置连接的身份信息，设置后连接视为已认证
+	GetIdentity() interface{}         // 获取连接的身份信息，未认证时返回nil
+	IsAuthenticated() bool            // 是否已认证
+	Context() context.Context         // 连接的上下文，连接断开或者服务停止时取消
 }
 
-//IConnectEvent 专门处理epoll/kqueue事件的方法，无需对外提供
+//IConnectEvent 专门处理epoll/kqueue事件的方法，自定义协议嵌入*server.BaseConnect后只需要实现DecodePacket
 type IConnectEvent interface {
-	DecodePacket() (IMessage, error)
+	DecodePacket() (IMessage, error) // 非阻塞模式下解码出一个消息，数据不完整时返回nil，返回io.EOF时断开连接
 	ProceedWrite() error
 	SetState(state common.ConnectState)
 	SetWriteBuff([]byte)
 	SetEpFd(epfd int)
 	SetPoller(poller IPoller)
+	Allow() error                   // 是否允许将消息交给路由处理，用于限制接收消息的速率
+	HasPending() bool               // 是否还有已解码未处理的消息，一次读取可能解码出多个消息
+	ReadProxyHeader() (bool, error) // 开启PROXY协议时读取PROXY协议头，返回是否可以继续处理这次可读事件
+}
+
+//IProtocolConnect 应用层协议的连接，自定义协议嵌入*server.BaseConnect并实现DecodePacket后即可满足
+type IProtocolConnect interface {
+	IConnect
+	IConnectEvent
 }
 
 type IWebsocketCloser interface {
 	CloseCode(code uint16, reason string) error
 }
+
+//IWebsocketConnect websocket协议的连接，未配置信封或者找不到路由的消息交给WebsocketHandler处理，自定义协议也可以实现
+type IWebsocketConnect interface {
+	IsWebsocket() bool
+}
+
+//IConnectSniffer 开启协议探测时，探测完成之前的连接
+type IConnectSniffer interface {
+	Sniff() (IConnect, error) // 读取数据并探测协议，数据不足时返回nil，探测完成后返回实际的连接
+}
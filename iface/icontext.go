@@ -1,6 +1,10 @@
 package iface
 
+import "context"
+
+//IContext 实现了context.Context，连接断开、服务停止或者路由执行超时时取消
 type IContext interface {
+	context.Context
 	GetRequest() IRequest
 	GetConnect() IConnect
 	GetMessage() IMessage
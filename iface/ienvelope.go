@@ -0,0 +1,8 @@
+package iface
+
+//IEnvelope websocket消息的信封格式，从payload中解析出路由使用的msgID，Send时使用相同的格式封装
+type IEnvelope interface {
+	Decode(payload []byte) (msgID uint32, data []byte, err error) // 解析
+	Encode(msgID uint32, data []byte) ([]byte, error)             // 封装
+	IsBinary() bool                                               // 封装后使用二进制帧还是文本帧发送
+}
@@ -2,6 +2,7 @@ package iface
 
 type IMessage interface {
 	ID() uint32
+	Seq() uint32
 	Bytes() []byte
 	String() string
 	Len() int
@@ -4,7 +4,14 @@ type Next = func(ctx IContext) interface{}
 type MiddlewareFunc = func(ctx IContext, next Next) interface{}
 
 type IMiddlewareGroup interface {
-	AddRouter(msgID uint32, router IRouter)
-	GetMiddlewares() []MiddlewareFunc
+	AddRouter(msgID uint32, router IRouter, middlewares ...MiddlewareFunc)                    // 添加路由，可以单独配置这个路由的中间件
+	AddRangeRouter(from, to uint32, router IRouter, middlewares ...MiddlewareFunc)            // 添加范围路由，msgID在[from, to]范围内时执行
+	AddMaskRouter(mask, value uint32, router IRouter, middlewares ...MiddlewareFunc)          // 添加掩码路由，msgID & mask == value 时执行
+	TryAddRouter(msgID uint32, router IRouter, middlewares ...MiddlewareFunc) error           // 添加路由，启动后与已有的路由冲突时返回错误
+	TryAddRangeRouter(from, to uint32, router IRouter, middlewares ...MiddlewareFunc) error   // 添加范围路由，启动后与已有的路由冲突时返回错误
+	TryAddMaskRouter(mask, value uint32, router IRouter, middlewares ...MiddlewareFunc) error // 添加掩码路由，启动后与已有的路由冲突时返回错误
+	Group(callable MiddlewareFunc, more ...MiddlewareFunc) IMiddlewareGroup                   // 创建子分组，子分组会继承当前分组的中间件
+	Range(from, to uint32) IMiddlewareGroup                                                   // msgID在[from, to]范围内的路由都会执行当前分组的中间件
+	GetMiddlewares() []MiddlewareFunc                                                         // 获取中间件，包含父分组的中间件
 	GetRouters() map[uint32]IRouter
 }
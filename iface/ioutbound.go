@@ -0,0 +1,7 @@
+package iface
+
+//OutboundNext 执行下一个发送拦截器，最后一个执行完后发送数据
+type OutboundNext = func(message IMessage) error
+
+//OutboundFunc 发送拦截器，可以读取、修改（压缩、加密、签名）要发送的消息，返回错误时取消发送
+type OutboundFunc = func(connect IConnect, message IMessage, next OutboundNext) error
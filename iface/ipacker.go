@@ -7,3 +7,27 @@ type IPacker interface {
 	SetMaxBodyLength(uint32)                        // 设置包体最大长度限制
 	GetHeaderLength() uint32                        // 获取头部长度
 }
+
+//IBodyUnpacker 包体读取完整后的处理，如：解压、解密、校验，IPacker实现了这个接口时，交给路由之前调用
+//可以通过message.SetData修改包体，返回错误时会断开连接
+type IBodyUnpacker interface {
+	UnPackBody(message IMessage) error
+}
+
+//IStreamDecoder 基于缓冲区的解码，适用于varint、TLV等变长包头的协议
+//IPacker同时实现了这个接口时，连接会使用Decode解码，不再使用GetHeaderLength和UnPack
+type IStreamDecoder interface {
+	//Decode buf为已接收未解码的数据，返回使用的字节数和解码出的消息，数据不完整时返回0
+	//消息中的数据可以引用buf中已使用的部分，返回错误时会断开连接
+	Decode(buf []byte) (consumed int, messages []IMessage, err error)
+}
+
+//IPackerCloner packer有连接级别的状态时（如：序列号）实现这个接口，每个连接使用Clone出来的packer
+type IPackerCloner interface {
+	Clone() IPacker
+}
+
+//IPacketStamper 封包中有连接级别的发送序号时实现（如：序列号），Pack时不设置，发送时在连接的写入锁中调用，保证序号与写入顺序一致
+type IPacketStamper interface {
+	Stamp(dataPack []byte) // 设置Pack返回的数据中的发送序号
+}
@@ -5,6 +5,8 @@ type IPoller interface {
 	AddWrite(fd, connID int) error
 	ModWrite(fd, connID int) error
 	ModRead(fd, connId int) error
+	PauseRead(fd, connID int) error  // 暂停读事件，用于流式路由的背压
+	ResumeRead(fd, connID int) error // 恢复读事件
 	Wait(emitCh chan<- IContext)
 	Remove(fd int) error
 	Close() error
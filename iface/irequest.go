@@ -1,7 +1,14 @@
 package iface
 
+import "context"
+
 type IRequest interface {
 	GetConnect() IConnect
 	GetMessage() IMessage
 	GetConnects() []IConnect
 }
+
+//IRequestContext 框架创建的请求都实现了这个接口，可以通过util.RequestContext获取
+type IRequestContext interface {
+	Context() context.Context // 消息的上下文，连接断开、服务停止或者路由执行超时时取消
+}
@@ -1,6 +1,26 @@
 package iface
 
+import "io"
+
 //IRouter 路由抽象，根据业务场景实现这个接口即可，通过msgID和router对应
 type IRouter interface {
 	Do(request IRequest)
 }
+
+//IReplyRouter 有返回值的路由，返回的数据会经过中间件后由框架回复，replyMsgID为回复的消息ID，payload为nil时不回复
+type IReplyRouter interface {
+	Do(request IRequest) (replyMsgID uint32, payload interface{}, err error)
+}
+
+//IStreamRouter 流式路由，包头读取完后立即执行，包体边接收边交给路由，不会整个缓存在内存中，适用于上传文件等大消息
+type IStreamRouter interface {
+	DoStream(request IRequest, body IBodyStream)
+}
+
+//IBodyStream 流式路由的包体，读取完后返回io.EOF，连接断开时返回io.ErrUnexpectedEOF
+//未读取的数据超过StreamBufferSize时暂停读取这个连接，读取后恢复
+type IBodyStream interface {
+	io.ReadCloser
+	Next() ([]byte, error) // 按接收的顺序读取一块数据，与Read不能混用
+	Len() int              // 包体总长度
+}
@@ -4,6 +4,6 @@ package iface
 type IServer interface {
 	Start()
 	Stop()
-	AddRouter(msgID uint32, router IRouter)
+	AddRouter(msgID uint32, router IRouter, middlewares ...MiddlewareFunc)
 	SetWebSocketHandler(IWebsocketHandler)
 }
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//KeyFunc 根据消息生成令牌桶的key，返回值相同的消息共用一个令牌桶
+type KeyFunc = func(ctx iface.IContext) string
+
+type rateLimitOptions struct {
+	key          KeyFunc
+	action       common.LimitAction
+	replyMsgID   uint32
+	onLimitation func(ctx iface.IContext)
+}
+
+type RateLimitOption = func(opts *rateLimitOptions)
+
+//ByConnect 每个连接一个令牌桶（默认）
+func ByConnect() RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.key = func(ctx iface.IContext) string {
+			return strconv.Itoa(ctx.GetConnect().GetID())
+		}
+	}
+}
+
+//ByIP 每个客户端IP一个令牌桶，同一个IP的所有连接共用
+func ByIP() RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.key = func(ctx iface.IContext) string {
+			address := ctx.GetConnect().GetAddress()
+			if address == nil {
+				return ""
+			}
+			host, _, err := net.SplitHostPort(address.String())
+			if err != nil {
+				return address.String()
+			}
+			return host
+		}
+	}
+}
+
+//ByRoute 每个msgID一个令牌桶，所有连接共用
+func ByRoute() RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.key = func(ctx iface.IContext) string {
+			return strconv.FormatUint(uint64(ctx.GetMessage().ID()), 10)
+		}
+	}
+}
+
+//ByKey 自定义令牌桶的key
+func ByKey(key KeyFunc) RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.key = key
+	}
+}
+
+//WithDrop 超出限制时丢弃消息（默认）
+func WithDrop() RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.action = common.LimitDrop
+	}
+}
+
+//WithReply 超出限制时使用msgID回复标准错误包（util.ErrorPacket），使用server配置的codec编码
+//自定义codec需要能编码util.ErrorPacket，否则只记录日志
+func WithReply(msgID uint32) RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.action = common.LimitReply
+		opts.replyMsgID = msgID
+	}
+}
+
+//WithClose 超出限制时关闭连接
+func WithClose() RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.action = common.LimitClose
+	}
+}
+
+//WithLimitation 超出限制时的回调，在执行action之前调用，可用于记录日志、统计
+func WithLimitation(callback func(ctx iface.IContext)) RateLimitOption {
+	return func(opts *rateLimitOptions) {
+		opts.onLimitation = callback
+	}
+}
+
+//RateLimit 令牌桶限流中间件，每秒生成rate个令牌，最多允许burst个消息的突发
+// s.Use(middleware.RateLimit(10, 20))
+// s.Use(middleware.RateLimit(100, 100, middleware.ByIP(), middleware.WithClose()))
+// s.AddRouter(1, new(xxx), middleware.RateLimit(1, 1, middleware.ByRoute(), middleware.WithReply(500)))
+func RateLimit(rate float64, burst int, opts ...RateLimitOption) iface.MiddlewareFunc {
+
+	options := &rateLimitOptions{
+		action: common.LimitDrop,
+	}
+	ByConnect()(options)
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	limiter := util.NewRateLimiter(rate, burst)
+
+	return func(ctx iface.IContext, next iface.Next) interface{} {
+
+		if limiter.Allow(options.key(ctx)) {
+			return next(ctx)
+		}
+
+		if options.onLimitation != nil {
+			options.onLimitation(ctx)
+		}
+
+		switch options.action {
+		case common.LimitReply:
+			return util.NewReply(options.replyMsgID, &util.ErrorPacket{
+				MsgID: ctx.GetMessage().ID(),
+				Error: util.RateLimitExceeded.Error(),
+			})
+		case common.LimitClose:
+			_ = ctx.GetConnect().Close()
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//rateLimitTestConnect 只实现限流中间件使用的方法，记录是否已关闭
+type rateLimitTestConnect struct {
+	iface.IConnect
+	id      int
+	address net.Addr
+	closed  bool
+}
+
+func (c *rateLimitTestConnect) GetID() int           { return c.id }
+func (c *rateLimitTestConnect) GetAddress() net.Addr { return c.address }
+func (c *rateLimitTestConnect) Close() error         { c.closed = true; return nil }
+
+type rateLimitTestContext struct {
+	iface.IContext
+	connect iface.IConnect
+	message iface.IMessage
+}
+
+func (c *rateLimitTestContext) GetConnect() iface.IConnect { return c.connect }
+func (c *rateLimitTestContext) GetMessage() iface.IMessage { return c.message }
+
+func TestRateLimitKey(t *testing.T) {
+	connects := []*rateLimitTestConnect{
+		{id: 1, address: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}},
+		{id: 2, address: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}},
+		{id: 3, address: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}},
+	}
+
+	// 每个令牌桶只有一个令牌，不会生成新的令牌
+	tests := []struct {
+		name     string
+		opt      RateLimitOption
+		messages [][2]int // 依次发送的消息：连接的下标、msgID
+		allowed  []bool
+	}{
+		{"by connect", ByConnect(), [][2]int{{0, 1}, {0, 2}, {1, 1}}, []bool{true, false, true}},
+		{"by ip", ByIP(), [][2]int{{0, 1}, {1, 1}, {2, 1}}, []bool{true, false, true}},
+		{"by route", ByRoute(), [][2]int{{0, 1}, {1, 1}, {2, 2}}, []bool{true, false, true}},
+		{"by key", ByKey(func(ctx iface.IContext) string { return "all" }), [][2]int{{0, 1}, {2, 2}}, []bool{true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := RateLimit(0, 1, tt.opt)
+			for i, message := range tt.messages {
+				allowed := false
+				ctx := &rateLimitTestContext{
+					connect: connects[message[0]],
+					message: &util.Message{MsgID: uint32(message[1])},
+				}
+				limit(ctx, func(ctx iface.IContext) interface{} {
+					allowed = true
+					return nil
+				})
+				if allowed != tt.allowed[i] {
+					t.Fatalf("message %d allowed = %v, want %v", i, allowed, tt.allowed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitAction(t *testing.T) {
+	tests := []struct {
+		name   string
+		opt    RateLimitOption
+		reply  bool // 是否回复标准错误包
+		closed bool // 是否关闭连接
+	}{
+		{"drop", WithDrop(), false, false},
+		{"reply", WithReply(500), true, false},
+		{"close", WithClose(), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limited := 0
+			limit := RateLimit(0, 0, tt.opt, WithLimitation(func(ctx iface.IContext) {
+				limited++
+			}))
+
+			connect := &rateLimitTestConnect{id: 1}
+			ctx := &rateLimitTestContext{connect: connect, message: &util.Message{MsgID: 7}}
+			result := limit(ctx, func(ctx iface.IContext) interface{} {
+				t.Fatal("limited message is passed to next")
+				return nil
+			})
+
+			if limited != 1 {
+				t.Fatalf("onLimitation called %d times", limited)
+			}
+			if connect.closed != tt.closed {
+				t.Fatalf("closed = %v, want %v", connect.closed, tt.closed)
+			}
+			if !tt.reply {
+				if result != nil {
+					t.Fatalf("result = %v, want nil", result)
+				}
+				return
+			}
+
+			reply, ok := result.(*util.Reply)
+			if !ok || reply.MsgID != 500 {
+				t.Fatalf("result = %#v", result)
+			}
+			packet, ok := reply.Payload.(*util.ErrorPacket)
+			if !ok || packet.MsgID != 7 || packet.Error != util.RateLimitExceeded.Error() {
+				t.Fatalf("payload = %#v", reply.Payload)
+			}
+		})
+	}
+}
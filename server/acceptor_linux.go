@@ -6,8 +6,6 @@ import (
 	"log"
 	"syscall"
 
-	"github.com/ikilobyte/netman/common"
-
 	"github.com/ikilobyte/netman/util"
 
 	"golang.org/x/sys/unix"
@@ -98,7 +96,8 @@ func (a *acceptor) Run(listenerFd int, loop iface.IEventLoop) error {
 			}
 
 			// 设置非阻塞，非tls状态下可以现在设置为非阻塞，如果是tls，则需要在完成tls握手后设置成非阻塞
-			if !a.options.TlsEnable {
+			// 开启协议探测时先以非阻塞模式读取数据，确定是TLS后在握手期间设置为阻塞
+			if !a.options.TlsEnable || a.options.Sniff {
 				if err := unix.SetNonblock(connFd, true); err != nil {
 					_ = unix.Close(connFd)
 					continue
@@ -111,17 +110,25 @@ func (a *acceptor) Run(listenerFd int, loop iface.IEventLoop) error {
 				continue
 			}
 
+			// 开启了PROXY协议时，只接受受信任的代理的连接
+			address := util.SockaddrToTCPOrUnixAddr(sa)
+			if !a.options.trustedProxy(address) {
+				util.Logger.Warnf("reject untrusted proxy connection from %v", address)
+				_ = unix.Close(connFd)
+				continue
+			}
+
 			baseConnect := newBaseConnect(
 				a.IncrementID(),
 				connFd,
-				util.SockaddrToTCPOrUnixAddr(sa),
+				address,
 				a.options,
 			)
 			var connect iface.IConnect
-			if a.options.Application == common.RouterMode {
-				connect = newRouterProtocol(baseConnect) // 路由模式，也可以是自定义应用层协议
+			if a.options.Sniff {
+				connect = newSniffConnect(baseConnect) // 协议探测，探测完成后替换为实际的协议
 			} else {
-				connect = newWebsocketProtocol(baseConnect) // websocket协议
+				connect = newProtocol(baseConnect, a.options.Application, a.options.Protocol)
 			}
 
 			// 添加事件循环
@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"github.com/ikilobyte/netman/common"
 	"github.com/ikilobyte/netman/iface"
 	"github.com/ikilobyte/netman/util"
 	"golang.org/x/sys/unix"
@@ -23,18 +24,24 @@ func (a *acceptorUdp) makeUdpConnect(fd int, eventLoop iface.IEventLoop) (iface.
 		return nil, fmt.Errorf("UDP acceptor from %s err: %v", address, err)
 	}
 
-	if n < headLen {
-		return nil, fmt.Errorf("recv message No packet from %v", address)
-	}
+	// 变长包头的协议，创建连接后再解码
+	decoder, isStream := a.packer.(iface.IStreamDecoder)
 
-	message, err := a.packer.UnPack(buffer[:headLen])
+	var message iface.IMessage
+	if !isStream {
+		if n < headLen {
+			return nil, fmt.Errorf("recv message No packet from %v", address)
+		}
 
-	if err != nil {
-		return nil, fmt.Errorf("unpack message err %v", err)
-	}
+		message, err = a.packer.UnPack(buffer[:headLen])
 
-	if n-headLen != message.Len() {
-		return nil, fmt.Errorf("not a complete data packet")
+		if err != nil {
+			return nil, fmt.Errorf("unpack message err %v", err)
+		}
+
+		if n-headLen != message.Len() {
+			return nil, fmt.Errorf("not a complete data packet")
+		}
 	}
 
 	// 创建一个socket，用于绑定
@@ -69,7 +76,7 @@ func (a *acceptorUdp) makeUdpConnect(fd int, eventLoop iface.IEventLoop) (iface.
 		a.options,
 	)
 
-	connect := newRouterProtocol(baseConnect) // 路由模式，也可以是自定义应用层协议
+	connect := newProtocol(baseConnect, common.RouterMode, nil) // 路由模式
 
 	// 添加到事件循环
 	if err := eventLoop.AddRead(connect); err != nil {
@@ -80,8 +87,34 @@ func (a *acceptorUdp) makeUdpConnect(fd int, eventLoop iface.IEventLoop) (iface.
 	// 添加到全局管理中
 	a.connectMgr.Add(connect)
 
+	// 一个数据报中可能有多个消息
+	if isStream {
+		protocol := connect.(*routerProtocol)
+
+		// 使用连接自己的packer解码（IPackerCloner），解码状态不会影响其它连接
+		if connectDecoder, ok := connect.GetPacker().(iface.IStreamDecoder); ok {
+			decoder = connectDecoder
+		}
+		message, err := protocol.decodeDatagram(decoder, buffer[:n])
+		for err == nil && message != nil {
+			if err = unpackBody(connect.GetPacker(), message); err == nil {
+				a.server.emitCh <- util.NewContext(util.NewRequest(connect, message, a.connectMgr))
+			} else if err == util.MessageDropped {
+				err = nil
+			}
+			message = protocol.popPending()
+		}
+		return connect, nil
+	}
+
 	// 发送一次出去即可
 	message.SetData(buffer[headLen : headLen+message.Len()])
+	if err := unpackBody(connect.GetPacker(), message); err != nil {
+		if err == util.MessageDropped {
+			return connect, nil
+		}
+		return connect, fmt.Errorf("unpack body err %v", err)
+	}
 	context := util.NewContext(util.NewRequest(connect, message, a.connectMgr))
 	a.server.emitCh <- context
 
@@ -1,11 +1,15 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ikilobyte/netman/common"
@@ -16,6 +20,8 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+//BaseConnect 连接的基础实现，负责读写数据、发送队列、TLS、关闭连接，应用层协议嵌入这个结构体后实现解码
+//自定义协议通过WithProtocol注册，只需要实现DecodePacket，Send、Close、HasPending可以按需重写
 type BaseConnect struct {
 	id                 int                 // 自定义生成的ID
 	fd                 int                 // 系统分配的fd
@@ -28,12 +34,29 @@ type BaseConnect struct {
 	writeQ             *util.Queue         //
 	state              common.ConnectState // 当前状态，0 离线，1 在线，2 epoll状态是可写，3 epoll状态是可读
 	lastMessageTime    time.Time           // 最后一次发送消息的时间，用于心跳检测
+	idleTime           int64               // 这个连接允许空闲的时间，0时使用HeartbeatIdleTime，小于0时不检测
 	tlsEnable          bool                // 是否开启了tls
 	handshakeCompleted bool                // tls握手是否完成
 	options            *Options            // 可选项配置
 	tlsLayer           *tls.Conn           // TLS层
 	tlsRawSize         int                 // tls原始字节数据，对应*tls.Conn.rawInput中是否还有数据未读
 	tlsWritePacketSize int                 // 发送数据包的长度
+	readLimiter        *util.TokenBucket   // 接收消息的速率限制
+	identity           atomic.Value        // *connectIdentity 认证成功后的身份信息
+	ctx                context.Context     // 连接的上下文，连接断开或者服务停止时取消
+	cancel             context.CancelFunc  //
+	proxyHeader        *util.ProxyHeader   // PROXY协议头
+	proxyBuffer        []byte              // 已读取的不完整的PROXY协议头
+	sniffRaw           []byte              // 协议探测时读取的TLS握手数据，交给TLS层读取
+	sniffData          []byte              // 协议探测时读取的应用层数据（TLS连接是解密后的数据），交给应用层协议读取
+	self               iface.IConnect      // 嵌入了这个结构体的连接，执行回调、发送拦截器时使用
+	writeLocker        sync.Mutex          // packer有发送序号时，设置序号和写入期间加锁
+	opened             int32               // 是否已执行onopen事件，-1表示协议探测中，没有执行过的连接断开时不执行onclose
+}
+
+//connectIdentity atomic.Value不能保存nil，包装一层
+type connectIdentity struct {
+	value interface{}
 }
 
 func newBaseConnect(id int, fd int, address net.Addr, options *Options) *BaseConnect {
@@ -43,33 +66,67 @@ func newBaseConnect(id int, fd int, address net.Addr, options *Options) *BaseCon
 		packer:             options.Packer,
 		Address:            address,
 		hooks:              options.Hooks,
-		writeQ:             util.NewQueue(), // 待发送的数据队列
-		state:              common.OnLine,   // 状态
-		lastMessageTime:    time.Now(),      // 初始化
-		tlsEnable:          options.TlsEnable,
+		writeQ:             util.NewQueue(),                     // 待发送的数据队列
+		state:              common.OnLine,                       // 状态
+		lastMessageTime:    time.Now(),                          // 初始化
+		tlsEnable:          options.TlsEnable && !options.Sniff, // 开启协议探测时根据数据判断
 		handshakeCompleted: false,
 		options:            options,
 		tlsLayer:           nil,
 		tlsRawSize:         0,
 	}
 
+	connect.self = connect
+
 	// TLS相关配置
-	if connect.options.TlsEnable {
-		if connect.options.TlsConfig != nil {
-			connect.tlsLayer = tls.Server(connect, connect.options.TlsConfig)
-		} else {
-			connect.tlsLayer = tls.Server(connect, &tls.Config{Certificates: []tls.Certificate{*connect.options.TlsCertificate}})
-		}
+	if connect.tlsEnable {
+		connect.initTLS()
+	}
+
+	// packer有连接级别的状态（如：序列号），每个连接使用单独的packer
+	if cloner, ok := options.Packer.(iface.IPackerCloner); ok {
+		connect.packer = cloner.Clone()
 	}
 
-	// 执行onopen事件
-	if connect.hooks != nil {
-		go connect.hooks.OnOpen(connect)
+	// 连接的上下文，派生自服务的上下文
+	connect.ctx, connect.cancel = context.WithCancel(options.ctx)
+
+	// 接收消息的速率限制
+	if options.ReadLimitRate > 0 {
+		connect.readLimiter = util.NewTokenBucket(options.ReadLimitRate, options.ReadLimitBurst)
 	}
 
 	return connect
 }
 
+//open 执行onopen事件，参数和onclose一样是嵌入了这个结构体的连接，只执行一次
+//开启PROXY协议时在读取到包头后执行，开启协议探测时opened为-1，在探测完成后执行
+func (c *BaseConnect) open() {
+	if c.hooks == nil || (c.proxyEnabled() && c.proxyHeader == nil) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.opened, 0, 1) {
+		go c.hooks.OnOpen(c.self)
+	}
+}
+
+//onClose 执行onclose事件，没有执行过onopen的连接（如：PROXY协议头、协议探测未完成）不执行
+func (c *BaseConnect) onClose() {
+	if c.hooks != nil && atomic.LoadInt32(&c.opened) == 1 {
+		c.hooks.OnClose(c.self)
+	}
+}
+
+// initTLS 创建TLS层
+func (c *BaseConnect) initTLS() {
+	c.tlsEnable = true
+	if c.options.TlsConfig != nil {
+		c.tlsLayer = tls.Server(c, c.options.TlsConfig)
+	} else {
+		c.tlsLayer = tls.Server(c, &tls.Config{Certificates: []tls.Certificate{*c.options.TlsCertificate}})
+	}
+}
+
 // GetID 获取连接ID
 func (c *BaseConnect) GetID() int {
 	return c.id
@@ -83,6 +140,13 @@ func (c *BaseConnect) GetFd() int {
 // Read 读取数据
 func (c *BaseConnect) Read(bs []byte) (int, error) {
 
+	// 协议探测时已读取的TLS握手数据
+	if len(c.sniffRaw) > 0 {
+		n := copy(bs, c.sniffRaw)
+		c.sniffRaw = c.sniffRaw[n:]
+		return n, nil
+	}
+
 	n, err := unix.Read(c.fd, bs)
 
 	// 已完成了TLS握手
@@ -236,6 +300,16 @@ func (c *BaseConnect) SetLastMessageTime(duration time.Time) {
 	c.lastMessageTime = duration
 }
 
+// SetIdleTime 设置这个连接允许空闲的时间，0时使用HeartbeatIdleTime，小于0时不检测，如：MQTT的keepalive
+func (c *BaseConnect) SetIdleTime(idleTime time.Duration) {
+	atomic.StoreInt64(&c.idleTime, int64(idleTime))
+}
+
+// GetIdleTime 获取这个连接允许空闲的时间
+func (c *BaseConnect) GetIdleTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.idleTime))
+}
+
 func (c *BaseConnect) GetTLSEnable() bool {
 	return c.tlsEnable
 }
@@ -297,14 +371,51 @@ func (c *BaseConnect) ProceedWrite() error {
 	return nil
 }
 
-// Close 会被重写，不会执行到这里
+// Close 关闭连接，移除事件监听后执行OnClose，应用层协议需要释放自己的资源时重写
 func (c *BaseConnect) Close() error {
-	return nil
+
+	// 移除事件监听
+	_ = c.GetPoller().Remove(c.fd)
+
+	// 从管理类中移除
+	c.GetConnectMgr().Remove(c.self)
+
+	// 关闭连接
+	err := unix.Close(c.fd)
+
+	// 取消连接的上下文
+	c.cancel()
+
+	c.sniffRaw = nil
+	c.sniffData = nil
+
+	// 关闭成功才执行
+	if err == nil {
+		c.onClose()
+	}
+
+	return err
 }
 
-// Send 会被重写，不会执行到这里
+// Send 使用packer封包后发送，先执行发送拦截器
 func (c *BaseConnect) Send(msgID uint32, bs []byte) (int, error) {
-	return 0, nil
+	return c.options.outbound.send(c.self, newOutboundMessage(msgID, bs, 0), c.writeMessage)
+}
+
+// writeMessage 使用packer封包后发送
+func (c *BaseConnect) writeMessage(message iface.IMessage) (int, error) {
+	dataPack, err := c.packer.Pack(message.ID(), message.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	// packer有发送序号时，设置序号和写入需要在同一个锁中，并发发送时序号与写入顺序一致
+	if stamper, ok := c.packer.(iface.IPacketStamper); ok {
+		c.writeLocker.Lock()
+		defer c.writeLocker.Unlock()
+		stamper.Stamp(dataPack)
+	}
+	return c.WriteData(dataPack)
 }
 
 // 以下方法是为了实现TLS，实际并未实现
@@ -346,6 +457,24 @@ func (c *BaseConnect) SetWriteDeadline(t time.Time) error {
 
 // readData 读取数据
 func (c *BaseConnect) readData(bs []byte) (int, error) {
+
+	// 协议探测时已读取的数据，不够时继续读取，这时的错误（如：EAGAIN）等下次读取时处理
+	if len(c.sniffData) > 0 {
+		n := copy(bs, c.sniffData)
+		c.sniffData = c.sniffData[n:]
+
+		// TLS层的数据已在探测时全部读取，当作原始数据计入，和解码时减去的长度一致
+		if c.handshakeCompleted {
+			c.tlsRawSize += n
+		}
+		if n < len(bs) {
+			if m, err := c.readData(bs[n:]); err == nil && m > 0 {
+				n += m
+			}
+		}
+		return n, nil
+	}
+
 	if c.GetTLSEnable() {
 		return c.GetTLSLayer().Read(bs)
 	}
@@ -356,6 +485,64 @@ func (c *BaseConnect) GetQueryStringParam() url.Values {
 	return make(url.Values)
 }
 
+func (c *BaseConnect) GetPath() string {
+	return ""
+}
+
+func (c *BaseConnect) GetHeader() http.Header {
+	return make(http.Header)
+}
+
+func (c *BaseConnect) GetCookie(name string) (*http.Cookie, error) {
+	return nil, http.ErrNoCookie
+}
+
+func (c *BaseConnect) GetSubprotocol() string {
+	return ""
+}
+
+// Allow 是否允许将消息交给路由处理，超出速率限制时返回util.RateLimitExceeded，需要关闭连接时返回io.EOF
+func (c *BaseConnect) Allow() error {
+	if c.readLimiter == nil || c.readLimiter.Allow() {
+		return nil
+	}
+
+	util.Logger.Warnf("connect fd[%d] id[%d] read limit exceeded", c.fd, c.id)
+	if c.options.ReadLimitAction == common.LimitClose {
+		return io.EOF
+	}
+	return util.RateLimitExceeded
+}
+
+// SetIdentity 认证成功后设置连接的身份信息，设置后连接视为已认证
+func (c *BaseConnect) SetIdentity(identity interface{}) {
+	c.identity.Store(&connectIdentity{value: identity})
+}
+
+// GetIdentity 获取连接的身份信息，未认证时返回nil
+func (c *BaseConnect) GetIdentity() interface{} {
+	if identity, ok := c.identity.Load().(*connectIdentity); ok {
+		return identity.value
+	}
+	return nil
+}
+
+// IsAuthenticated 是否已认证
+func (c *BaseConnect) IsAuthenticated() bool {
+	_, ok := c.identity.Load().(*connectIdentity)
+	return ok
+}
+
+// Context 连接的上下文，连接断开或者服务停止时取消
+func (c *BaseConnect) Context() context.Context {
+	return c.ctx
+}
+
+// HasPending 是否还有已解码未处理的消息，默认只判断协议探测时已读取未处理的数据
+func (c *BaseConnect) HasPending() bool {
+	return len(c.sniffData) > 0 && c.ctx.Err() == nil
+}
+
 // IsUDP 是否为UDP
 func (c *BaseConnect) IsUDP() bool {
 	return strings.ToLower(c.Address.Network()) == "udp"
@@ -7,12 +7,14 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
 )
 
 //ConnectManager 所有连接都保存在这里
 type ConnectManager struct {
-	connects map[int]iface.IConnect // connFD => Connect
-	options  *Options
+	connects   map[int]iface.IConnect // connFD => Connect
+	authTimers map[int]*time.Timer    // connFD => 认证超时的定时器，协议探测完成后替换连接时继续使用
+	options    *Options
 	sync.RWMutex
 }
 
@@ -20,8 +22,9 @@ type ConnectManager struct {
 func newConnectManager(options *Options) *ConnectManager {
 
 	mgr := &ConnectManager{
-		connects: map[int]iface.IConnect{},
-		options:  options,
+		connects:   map[int]iface.IConnect{},
+		authTimers: map[int]*time.Timer{},
+		options:    options,
 	}
 
 	// 心跳检测
@@ -30,14 +33,48 @@ func newConnectManager(options *Options) *ConnectManager {
 	return mgr
 }
 
-//Add 添加一个连接
+//Add 添加一个连接，协议探测完成后也会调用，替换为实际的连接
 func (c *ConnectManager) Add(conn iface.IConnect) int {
 	c.Lock()
 	defer c.Unlock()
-	c.connects[conn.GetFd()] = conn
+	fd, id := conn.GetFd(), conn.GetID()
+	c.connects[fd] = conn
+
+	// 认证超时检测，每个连接只计时一次，替换连接时不会重新计时
+	if c.options.AuthTimeout > 0 && c.authTimers[fd] == nil {
+		c.authTimers[fd] = time.AfterFunc(c.options.AuthTimeout, func() {
+			c.authTimeout(fd, id)
+		})
+	}
+
 	return len(c.connects)
 }
 
+//authTimeout 超时仍未认证的连接断开，websocket使用1008状态码关闭
+func (c *ConnectManager) authTimeout(fd, id int) {
+	c.Lock()
+	conn, ok := c.connects[fd]
+
+	// 连接已断开（fd可能已被新连接复用）
+	if !ok || conn.GetID() != id {
+		c.Unlock()
+		return
+	}
+	delete(c.authTimers, fd)
+	c.Unlock()
+
+	if conn.IsAuthenticated() {
+		return
+	}
+
+	util.Logger.Infof("connect fd[%d] id[%d] authentication timeout", fd, id)
+	if closer, ok := conn.(iface.IWebsocketCloser); ok {
+		_ = closer.CloseCode(1008, "authentication timeout")
+		return
+	}
+	_ = conn.Close()
+}
+
 //Get 通过connID获取连接实例
 func (c *ConnectManager) Get(connFD int) iface.IConnect {
 	c.Lock()
@@ -54,6 +91,15 @@ func (c *ConnectManager) Remove(conn iface.IConnect) {
 	c.Lock()
 	defer c.Unlock()
 	delete(c.connects, conn.GetFd())
+	c.stopAuthTimer(conn.GetFd())
+}
+
+//stopAuthTimer 连接断开时停止认证超时的定时器，调用方需要加锁
+func (c *ConnectManager) stopAuthTimer(fd int) {
+	if timer, ok := c.authTimers[fd]; ok {
+		timer.Stop()
+		delete(c.authTimers, fd)
+	}
 }
 
 //Len 获取有多少个连接
@@ -82,36 +128,49 @@ func (c *ConnectManager) ClearByEpFd(epfd int) {
 
 		// 从所有连接中删除
 		delete(c.connects, connID)
+		c.stopAuthTimer(connID)
 	}
 }
 
 //ClearAll 清除所有连接
 func (c *ConnectManager) ClearAll() {
 	c.Lock()
-	defer c.Unlock()
+	connects := c.connects
+	c.connects = make(map[int]iface.IConnect)
+	c.Unlock()
 
-	for _, connect := range c.connects {
+	// Close时会调用Remove，不能在加锁时关闭
+	for _, connect := range connects {
 		_ = connect.Close()
 	}
-	c.connects = make(map[int]iface.IConnect)
 }
 
-//HeartbeatCheck 心跳检测
+//connectIdleTime 每个连接可以单独设置允许空闲的时间
+type connectIdleTime interface {
+	GetIdleTime() time.Duration
+}
+
+//HeartbeatCheck 心跳检测，连接单独设置的空闲时间优先于HeartbeatIdleTime
 func (c *ConnectManager) HeartbeatCheck() {
 
 	if int(c.options.HeartbeatCheckInterval) <= 0 || int(c.options.HeartbeatIdleTime) < 0 {
 		return
 	}
 
-	idleTime := int64(c.options.HeartbeatIdleTime / time.Second)
+	ticker := time.NewTicker(c.options.HeartbeatCheckInterval)
+	defer ticker.Stop()
 
-	// 在遍历所有连接时，不会加锁，不能影响到正常操作，但可能会有
 	for {
 		select {
-		case now := <-time.Tick(c.options.HeartbeatCheckInterval):
-			for _, connect := range c.connects {
-				lastMessageTime := connect.GetLastMessageTime()
-				if now.Unix()-lastMessageTime.Unix() < idleTime {
+		case now := <-ticker.C:
+			for _, connect := range c.GetConnects() {
+				idleTime := c.options.HeartbeatIdleTime
+				if conn, ok := connect.(connectIdleTime); ok && conn.GetIdleTime() != 0 {
+					idleTime = conn.GetIdleTime()
+				}
+
+				// 未配置空闲时间，或者设置了不检测
+				if idleTime <= 0 || now.Sub(connect.GetLastMessageTime()) < idleTime {
 					continue
 				}
 
@@ -126,7 +185,10 @@ func (c *ConnectManager) HeartbeatCheck() {
 
 //GetConnects 获取所有连接
 func (c *ConnectManager) GetConnects() []iface.IConnect {
-	connects := make([]iface.IConnect, 0, c.Len())
+	c.RLock()
+	defer c.RUnlock()
+
+	connects := make([]iface.IConnect, 0, len(c.connects))
 	for _, connect := range c.connects {
 		connects = append(connects, connect)
 	}
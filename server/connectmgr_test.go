@@ -0,0 +1,135 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//authTestConnect 只实现认证超时检测使用的方法，记录关闭的方式
+type authTestConnect struct {
+	iface.IConnect
+	fd            int
+	id            int
+	authenticated bool
+	locker        sync.Mutex
+	closed        int    // 关闭的次数
+	code          uint16 // websocket关闭的状态码
+}
+
+func (c *authTestConnect) GetFd() int            { return c.fd }
+func (c *authTestConnect) GetID() int            { return c.id }
+func (c *authTestConnect) IsAuthenticated() bool { return c.authenticated }
+func (c *authTestConnect) Close() error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.closed++
+	return nil
+}
+
+//result 关闭的次数和状态码
+func (c *authTestConnect) result() (int, uint16) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.closed, c.code
+}
+
+//authTestWebsocket websocket连接使用状态码关闭
+type authTestWebsocket struct {
+	*authTestConnect
+}
+
+func (c *authTestWebsocket) CloseCode(code uint16, reason string) error {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.closed++
+	c.code = code
+	return nil
+}
+
+func TestConnectManagerAuthTimeout(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		run    func(t *testing.T, mgr *ConnectManager, connect *authTestConnect) iface.IConnect // 返回添加到connectMgr中的连接
+		closed int
+		code   uint16
+	}{
+		{"unauthenticated", func(t *testing.T, mgr *ConnectManager, connect *authTestConnect) iface.IConnect {
+			mgr.Add(connect)
+			return connect
+		}, 1, 0},
+		{"websocket", func(t *testing.T, mgr *ConnectManager, connect *authTestConnect) iface.IConnect {
+			websocket := &authTestWebsocket{connect}
+			mgr.Add(websocket)
+			return websocket
+		}, 1, 1008},
+		{"authenticated", func(t *testing.T, mgr *ConnectManager, connect *authTestConnect) iface.IConnect {
+			connect.authenticated = true
+			mgr.Add(connect)
+			return connect
+		}, 0, 0},
+		{"removed", func(t *testing.T, mgr *ConnectManager, connect *authTestConnect) iface.IConnect {
+			mgr.Add(connect)
+			mgr.Remove(connect)
+			return nil
+		}, 0, 0},
+		{"replaced", func(t *testing.T, mgr *ConnectManager, connect *authTestConnect) iface.IConnect {
+			// 协议探测完成后替换连接，不会重新计时
+			mgr.Add(&authTestConnect{fd: connect.fd, id: connect.id})
+			mgr.Lock()
+			timer := mgr.authTimers[connect.fd]
+			mgr.Unlock()
+			mgr.Add(connect)
+			mgr.Lock()
+			defer mgr.Unlock()
+			if mgr.authTimers[connect.fd] != timer {
+				t.Fatal("timer is restarted")
+			}
+			return connect
+		}, 1, 0},
+		{"fd reused", func(t *testing.T, mgr *ConnectManager, connect *authTestConnect) iface.IConnect {
+			// 旧连接的定时器不会关闭复用了fd的新连接
+			old := &authTestConnect{fd: connect.fd, id: connect.id + 1}
+			mgr.Add(old)
+			mgr.Remove(old)
+			connect.authenticated = true
+			mgr.Add(connect)
+			mgr.authTimeout(old.fd, old.id)
+			return connect
+		}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := &ConnectManager{
+				connects:   map[int]iface.IConnect{},
+				authTimers: map[int]*time.Timer{},
+				options:    parseOption(WithAuthTimeout(timeout)),
+			}
+			connect := &authTestConnect{fd: 5, id: 1}
+			added := tt.run(t, mgr, connect)
+
+			// 等待定时器执行
+			time.Sleep(timeout + timeout)
+			closed, code := connect.result()
+			if closed != tt.closed || code != tt.code {
+				t.Fatalf("closed %d times with code %d, want %d times with code %d", closed, code, tt.closed, tt.code)
+			}
+
+			// 定时器执行后或者连接断开后都会删除
+			mgr.Lock()
+			timers := len(mgr.authTimers)
+			mgr.Unlock()
+			if timers != 0 {
+				t.Fatalf("%d timers left", timers)
+			}
+			if added != nil && mgr.Get(connect.fd) != added {
+				t.Fatal("connect is removed from connectMgr")
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+var (
+	requestType = reflect.TypeOf((*iface.IRequest)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+//handlerRouter 将 func(request iface.IRequest, in *T) (out R, err error) 形式的函数适配为IRouter
+//in使用codec解码，out使用codec编码后以相同的msgID回复给客户端
+type handlerRouter struct {
+	fn      reflect.Value
+	in      reflect.Type // 请求参数类型
+	hasOut  bool         // 是否有返回值需要回复
+	options *Options
+}
+
+//newHandlerRouter 支持以下两种函数签名，签名有误时会panic
+// func(request iface.IRequest, in *T) (out R, err error)
+// func(request iface.IRequest, in *T) error
+func newHandlerRouter(handler interface{}, options *Options) iface.IRouter {
+
+	fn := reflect.ValueOf(handler)
+	typ := fn.Type()
+	if typ.Kind() != reflect.Func {
+		log.Panicf("handler must be a func, got %s", typ)
+	}
+
+	if typ.NumIn() != 2 || typ.In(0) != requestType {
+		log.Panicf("handler %s must be func(iface.IRequest, *T)", typ)
+	}
+
+	if typ.NumOut() < 1 || typ.NumOut() > 2 || typ.Out(typ.NumOut()-1) != errorType {
+		log.Panicf("handler %s must return (R, error) or error", typ)
+	}
+
+	return &handlerRouter{
+		fn:      fn,
+		in:      typ.In(1),
+		hasOut:  typ.NumOut() == 2,
+		options: options,
+	}
+}
+
+//Do 不经过RouterMgr直接调用时，也能正常回复
+func (h *handlerRouter) Do(request iface.IRequest) {
+	sendReply(request, h.reply(request), h.options)
+}
+
+//reply 解码 -> 执行，返回值经过中间件后编码回复
+func (h *handlerRouter) reply(request iface.IRequest) *util.Reply {
+
+	msgID := request.GetMessage().ID()
+
+	// 解码
+	in, err := h.decode(request.GetMessage().Bytes())
+	if err != nil {
+		return &util.Reply{MsgID: msgID, Err: fmt.Errorf("%w: %v", util.CodecDecodeFail, err)}
+	}
+
+	outs := h.fn.Call([]reflect.Value{reflect.ValueOf(request), in})
+
+	// 执行出错
+	if err, _ := outs[len(outs)-1].Interface().(error); err != nil {
+		return &util.Reply{MsgID: msgID, Err: err}
+	}
+
+	if !h.hasOut {
+		return nil
+	}
+
+	// 没有需要回复的数据
+	out := outs[0]
+	if (out.Kind() == reflect.Ptr || out.Kind() == reflect.Interface) && out.IsNil() {
+		return nil
+	}
+
+	return util.NewReply(msgID, out.Interface())
+}
+
+//decode 根据参数类型创建实例后解码
+func (h *handlerRouter) decode(data []byte) (reflect.Value, error) {
+
+	// 指针类型，直接解码到新创建的实例中
+	if h.in.Kind() == reflect.Ptr {
+		in := reflect.New(h.in.Elem())
+		if err := h.options.Codec.Unmarshal(data, in.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+		return in, nil
+	}
+
+	in := reflect.New(h.in)
+	if err := h.options.Codec.Unmarshal(data, in.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return in.Elem(), nil
+}
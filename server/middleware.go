@@ -1,31 +1,137 @@
 package server
 
-import "github.com/ikilobyte/netman/iface"
+import (
+	"github.com/ikilobyte/netman/iface"
+)
 
 type MiddlewareGroup struct {
+	parent      *MiddlewareGroup
 	middlewares []iface.MiddlewareFunc
-	routers     map[uint32]iface.IRouter
+	routes      []*routeEntry
+	ranges      [][2]uint32 // 匹配的msgID范围
+	mgr         *RouterMgr
 }
 
 //newMiddlewareGroup .
-func newMiddlewareGroup(callables ...iface.MiddlewareFunc) iface.IMiddlewareGroup {
+func newMiddlewareGroup(mgr *RouterMgr, parent *MiddlewareGroup, callables ...iface.MiddlewareFunc) *MiddlewareGroup {
 	group := &MiddlewareGroup{
+		parent:      parent,
 		middlewares: callables,
-		routers:     make(map[uint32]iface.IRouter),
+		routes:      make([]*routeEntry, 0),
+		ranges:      make([][2]uint32, 0),
+		mgr:         mgr,
 	}
 
 	return group
 }
 
-//AddRouter 添加路由
-func (m *MiddlewareGroup) AddRouter(msgID uint32, router iface.IRouter) {
-	m.routers[msgID] = router
+//AddRouter 添加路由，middlewares只对这个路由生效，在分组中间件之后执行，启动后添加失败时只记录日志
+func (m *MiddlewareGroup) AddRouter(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	logAddError(m.TryAddRouter(msgID, router, middlewares...))
 }
 
+//TryAddRouter 添加路由，启动后与已有的路由冲突时返回util.RouterConflict
+func (m *MiddlewareGroup) TryAddRouter(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return m.addEntry(&routeEntry{
+		kind:        exactRoute,
+		msgID:       msgID,
+		router:      router,
+		middlewares: middlewares,
+		group:       m,
+	})
+}
+
+//AddRangeRouter 添加范围路由，msgID在[from, to]范围内且没有精确匹配的路由时执行
+func (m *MiddlewareGroup) AddRangeRouter(from, to uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	logAddError(m.TryAddRangeRouter(from, to, router, middlewares...))
+}
+
+//TryAddRangeRouter 添加范围路由，启动后与已有的路由冲突（包括与范围、掩码路由重叠）时返回util.RouterConflict
+func (m *MiddlewareGroup) TryAddRangeRouter(from, to uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return m.addEntry(&routeEntry{
+		kind:        rangeRoute,
+		from:        from,
+		to:          to,
+		router:      router,
+		middlewares: middlewares,
+		group:       m,
+	})
+}
+
+//AddMaskRouter 添加掩码路由，msgID & mask == value 且没有精确匹配的路由时执行
+func (m *MiddlewareGroup) AddMaskRouter(mask, value uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	logAddError(m.TryAddMaskRouter(mask, value, router, middlewares...))
+}
+
+//TryAddMaskRouter 添加掩码路由，启动后与已有的路由冲突（包括与范围、掩码路由重叠）时返回util.RouterConflict
+func (m *MiddlewareGroup) TryAddMaskRouter(mask, value uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return m.addEntry(&routeEntry{
+		kind:        maskRoute,
+		msgID:       value & mask,
+		mask:        mask,
+		router:      router,
+		middlewares: middlewares,
+		group:       m,
+	})
+}
+
+//Group 创建子分组，执行顺序：父分组中间件 -> 子分组中间件
+func (m *MiddlewareGroup) Group(callable iface.MiddlewareFunc, more ...iface.MiddlewareFunc) iface.IMiddlewareGroup {
+	ms := []iface.MiddlewareFunc{
+		callable,
+	}
+	return m.mgr.addGroup(newMiddlewareGroup(m.mgr, m, append(ms, more...)...))
+}
+
+//Range msgID在[from, to]范围内的路由，即使不是在当前分组中添加的，也会执行当前分组的中间件
+func (m *MiddlewareGroup) Range(from, to uint32) iface.IMiddlewareGroup {
+	_ = m.mgr.update(func() func() {
+		m.ranges = append(m.ranges, [2]uint32{from, to})
+		return func() {
+			m.ranges = m.ranges[:len(m.ranges)-1]
+		}
+	})
+	return m
+}
+
+//GetMiddlewares 获取中间件，父分组的中间件在前
 func (m *MiddlewareGroup) GetMiddlewares() []iface.MiddlewareFunc {
-	return m.middlewares
+	middlewares := make([]iface.MiddlewareFunc, 0)
+	if m.parent != nil {
+		middlewares = append(middlewares, m.parent.GetMiddlewares()...)
+	}
+	return append(middlewares, m.middlewares...)
 }
 
 func (m *MiddlewareGroup) GetRouters() map[uint32]iface.IRouter {
-	return m.routers
+	m.mgr.locker.Lock()
+	defer m.mgr.locker.Unlock()
+
+	routers := make(map[uint32]iface.IRouter)
+	for _, entry := range m.routes {
+		if entry.kind == exactRoute {
+			routers[entry.msgID] = entry.router
+		}
+	}
+	return routers
+}
+
+//addEntry 保存路由定义，启动后添加重复的路由会失败
+func (m *MiddlewareGroup) addEntry(entry *routeEntry) error {
+	return m.mgr.update(func() func() {
+		m.routes = append(m.routes, entry)
+		return func() {
+			m.routes = m.routes[:len(m.routes)-1]
+		}
+	})
+}
+
+//contains 当前分组是否为group本身或者group的父分组
+func (m *MiddlewareGroup) contains(group *MiddlewareGroup) bool {
+	for g := group; g != nil; g = g.parent {
+		if g == m {
+			return true
+		}
+	}
+	return false
 }
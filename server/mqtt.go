@@ -0,0 +1,431 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+// Mqtt 创建一个MQTT 3.1.1 broker，支持QoS 0、1的发布订阅、通配符订阅、保留消息、遗嘱消息
+// 客户端的keepalive使用心跳检测实现，同一个连接的报文按顺序处理，会话不会持久化（CleanSession为false时也按新会话处理）
+func Mqtt(ip string, port int, opts ...Option) *Server {
+	opts = append([]Option{
+		WithPacker(util.NewMqttPacker()),
+		WithOrderedDispatch(),
+		WithHeartbeatCheckInterval(time.Second),
+	}, opts...)
+
+	server, options := createTcpServer(ip, port, opts...)
+
+	// 应用层协议模式
+	options.Application = common.MqttMode
+
+	if _, ok := options.Packer.(*util.MqttPacker); !ok {
+		log.Panicln("mqtt mode must use util.MqttPacker")
+	}
+
+	// 所有报文都交给broker处理
+	server.mqtt = newMqttBroker(options)
+	for packetType := util.MqttConnect; packetType <= util.MqttDisconnect; packetType++ {
+		server.AddRouter(uint32(packetType), server.mqtt)
+	}
+	return server
+}
+
+// Publish MQTT模式下发布消息给订阅了这个主题的客户端，qos最大为1，retain为true时保存为保留消息（payload为空时删除）
+func (s *Server) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if s.mqtt == nil {
+		log.Panicln("Publish is only available in mqtt mode, see server.Mqtt")
+		return nil
+	}
+
+	if !util.ValidMqttTopic(topic) {
+		return util.MqttTopicInvalid
+	}
+
+	if qos > 1 {
+		qos = 1
+	}
+
+	s.mqtt.publish(&util.MqttMessage{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     qos,
+		Retain:  retain,
+	})
+	return nil
+}
+
+//mqttBroker 管理MQTT会话、订阅和保留消息，同时是所有报文的路由
+type mqttBroker struct {
+	options  *Options
+	locker   sync.Mutex
+	clients  map[string]*mqttSession      // clientID => 会话
+	connects map[int]*mqttSession         // connID => 会话
+	topics   *mqttTopicNode               // 订阅树
+	retained map[string]*util.MqttMessage // 主题 => 保留消息
+}
+
+//mqttSession 一个客户端的会话，连接断开时删除
+type mqttSession struct {
+	connect  iface.IConnect
+	clientID string
+	will     *util.MqttMessage // 遗嘱消息，连接异常断开时发布
+	filters  map[string]byte   // 订阅的主题过滤器 => 授予的QoS
+	packetID uint32            // 发送QoS1消息时分配的报文标识符
+	removed  bool              // 已删除
+}
+
+func newMqttBroker(options *Options) *mqttBroker {
+	return &mqttBroker{
+		options:  options,
+		clients:  make(map[string]*mqttSession),
+		connects: make(map[int]*mqttSession),
+		topics:   newMqttTopicNode(),
+		retained: make(map[string]*util.MqttMessage),
+	}
+}
+
+//Do 处理一个报文，协议错误时断开连接
+func (b *mqttBroker) Do(request iface.IRequest) {
+	packet, ok := request.GetMessage().(*util.MqttPacket)
+	if !ok {
+		return
+	}
+
+	connect := request.GetConnect()
+	session := b.session(connect)
+
+	// 连接已断开（如：被同一个客户端ID的新连接踢下线）
+	if session == nil && connect.Context().Err() != nil {
+		return
+	}
+
+	// CONNECT必须是第一个报文，且只能发送一次
+	var err error
+	if (packet.Type == util.MqttConnect) != (session == nil) {
+		err = util.MqttProtocolError
+	} else {
+		switch packet.Type {
+		case util.MqttConnect:
+			err = b.connect(connect, packet)
+		case util.MqttPublish:
+			err = b.receive(session, packet)
+		case util.MqttPuback:
+			// 不会重发消息，收到确认后不需要处理
+			_, err = util.ParseMqttPacketID(packet)
+		case util.MqttSubscribe:
+			err = b.subscribe(session, packet)
+		case util.MqttUnsubscribe:
+			err = b.unsubscribe(session, packet)
+		case util.MqttPingreq:
+			b.send(connect, util.MqttPingrespPacket())
+		case util.MqttDisconnect:
+			b.disconnect(session)
+		default:
+			// 不支持QoS2，其它报文只能由服务端发送
+			err = util.MqttProtocolError
+		}
+	}
+
+	if err != nil {
+		util.Logger.Infof("mqtt connect fd[%d] id[%d] packet type[%d] error：%v", connect.GetFd(), connect.GetID(), packet.Type, err)
+		_ = connect.Close()
+	}
+}
+
+//connect 处理CONNECT，认证通过后创建会话，同一个客户端ID的旧连接会被断开
+func (b *mqttBroker) connect(connect iface.IConnect, packet *util.MqttPacket) error {
+	info, err := util.ParseMqttConnect(packet)
+	if err != nil {
+		return err
+	}
+
+	// 支持3.1.1和3.1
+	if !(info.ProtocolName == "MQTT" && info.ProtocolLevel == 4) && !(info.ProtocolName == "MQIsdp" && info.ProtocolLevel == 3) {
+		return b.refuse(connect, util.MqttUnacceptableProtocol)
+	}
+
+	// 客户端ID为空时由服务端分配，需要保存会话时必须提供
+	if info.ClientID == "" {
+		if !info.CleanSession {
+			return b.refuse(connect, util.MqttIdentifierRejected)
+		}
+		info.ClientID = fmt.Sprintf("netman-%d-%d", connect.GetID(), time.Now().UnixNano())
+	}
+
+	// 认证，未配置时身份信息为客户端ID
+	var identity interface{} = info.ClientID
+	if b.options.MqttAuthenticator != nil {
+		identity, err = b.options.MqttAuthenticator(connect, info)
+		if err != nil {
+			util.Logger.Infof("mqtt connect fd[%d] id[%d] client[%s] authentication failed：%v", connect.GetFd(), connect.GetID(), info.ClientID, err)
+			return b.refuse(connect, util.MqttNotAuthorized)
+		}
+	}
+	connect.SetIdentity(identity)
+
+	// 超过keepalive的1.5倍时间没有收到报文时断开连接，0表示不检测
+	if conn, ok := connect.(interface{ SetIdleTime(time.Duration) }); ok {
+		idleTime := time.Duration(info.KeepAlive) * time.Second * 3 / 2
+		if idleTime == 0 {
+			idleTime = -1
+		}
+		conn.SetIdleTime(idleTime)
+	}
+
+	session := &mqttSession{
+		connect:  connect,
+		clientID: info.ClientID,
+		will:     info.Will,
+		filters:  make(map[string]byte),
+	}
+
+	// 同一个客户端ID的旧连接替换为新连接，查找、删除和保存在同一次加锁中完成，同时连接时只会保留一个
+	var will *util.MqttMessage
+	b.locker.Lock()
+	old := b.clients[info.ClientID]
+	if old != nil {
+		will = b.removeLocked(old)
+	}
+	b.clients[info.ClientID] = session
+	b.connects[connect.GetID()] = session
+	b.locker.Unlock()
+
+	// 旧连接断开，会发布旧连接的遗嘱消息
+	if old != nil {
+		util.Logger.Infof("mqtt client[%s] connect id[%d] takeover connect id[%d]", info.ClientID, connect.GetID(), old.connect.GetID())
+		if will != nil {
+			b.publish(will)
+		}
+		_ = old.connect.Close()
+	}
+
+	// 连接断开时删除会话
+	go func() {
+		<-connect.Context().Done()
+		b.remove(session)
+	}()
+
+	b.send(connect, util.MqttConnackPacket(false, util.MqttAccepted))
+	return nil
+}
+
+//refuse 拒绝连接，回复CONNACK后断开
+func (b *mqttBroker) refuse(connect iface.IConnect, code byte) error {
+	b.send(connect, util.MqttConnackPacket(false, code))
+	_ = connect.Close()
+	return nil
+}
+
+//receive 处理客户端发布的消息，经过发布钩子后转发给订阅者
+func (b *mqttBroker) receive(session *mqttSession, packet *util.MqttPacket) error {
+	message, err := util.ParseMqttPublish(packet)
+	if err != nil {
+		return err
+	}
+	if message.QoS > 1 {
+		return fmt.Errorf("qos %d is not supported", message.QoS)
+	}
+
+	// 钩子中可能修改消息，先保存需要确认的信息
+	qos, packetID := message.QoS, message.PacketID
+	message.Dup = false
+
+	if hook := b.options.MqttPublishHook; hook != nil {
+		err = hook(session.connect, message)
+		if err == nil && !util.ValidMqttTopic(message.Topic) {
+			err = util.MqttTopicInvalid
+		}
+	}
+
+	if err != nil {
+		util.Logger.Infof("mqtt client[%s] publish %s dropped：%v", session.clientID, message.Topic, err)
+	} else {
+		b.publish(message)
+	}
+
+	if qos == 1 {
+		b.send(session.connect, util.MqttAckPacket(util.MqttPuback, packetID))
+	}
+	return nil
+}
+
+//publish 保存保留消息，转发给订阅者，使用发布和订阅中较小的QoS
+func (b *mqttBroker) publish(message *util.MqttMessage) {
+	subscribers := make(map[*mqttSession]byte)
+
+	b.locker.Lock()
+	if message.Retain {
+		if len(message.Payload) == 0 {
+			delete(b.retained, message.Topic)
+		} else {
+			b.retained[message.Topic] = &util.MqttMessage{Topic: message.Topic, Payload: message.Payload, QoS: message.QoS}
+		}
+	}
+	b.topics.match(strings.Split(message.Topic, "/"), strings.HasPrefix(message.Topic, "$"), subscribers)
+	b.locker.Unlock()
+
+	// 只支持QoS 0、1，遗嘱消息、钩子修改后的消息可能是QoS2
+	maxQoS := message.QoS
+	if maxQoS > 1 {
+		maxQoS = 1
+	}
+
+	for session, qos := range subscribers {
+		if maxQoS < qos {
+			qos = maxQoS
+		}
+		b.deliver(session, message, qos, false)
+	}
+}
+
+//subscribe 处理SUBSCRIBE，最大授予QoS1，回复SUBACK后发送匹配的保留消息
+func (b *mqttBroker) subscribe(session *mqttSession, packet *util.MqttPacket) error {
+	packetID, subscriptions, err := util.ParseMqttSubscribe(packet)
+	if err != nil {
+		return err
+	}
+
+	type retainedMessage struct {
+		message *util.MqttMessage
+		qos     byte
+	}
+
+	codes := make([]byte, len(subscriptions))
+	retained := make([]retainedMessage, 0)
+
+	b.locker.Lock()
+	for i, subscription := range subscriptions {
+		if !util.ValidMqttTopicFilter(subscription.Filter) {
+			codes[i] = 0x80
+			continue
+		}
+
+		qos := subscription.QoS
+		if qos > 1 {
+			qos = 1
+		}
+		codes[i] = qos
+
+		// 已订阅时替换
+		session.filters[subscription.Filter] = qos
+		b.topics.add(strings.Split(subscription.Filter, "/"), session, qos)
+
+		for topic, message := range b.retained {
+			if util.MqttTopicMatch(subscription.Filter, topic) {
+				granted := qos
+				if message.QoS < granted {
+					granted = message.QoS
+				}
+				retained = append(retained, retainedMessage{message: message, qos: granted})
+			}
+		}
+	}
+	b.locker.Unlock()
+
+	b.send(session.connect, util.MqttSubackPacket(packetID, codes))
+	for _, item := range retained {
+		b.deliver(session, item.message, item.qos, true)
+	}
+	return nil
+}
+
+//unsubscribe 处理UNSUBSCRIBE，未订阅的主题过滤器直接忽略
+func (b *mqttBroker) unsubscribe(session *mqttSession, packet *util.MqttPacket) error {
+	packetID, filters, err := util.ParseMqttUnsubscribe(packet)
+	if err != nil {
+		return err
+	}
+
+	b.locker.Lock()
+	for _, filter := range filters {
+		if _, ok := session.filters[filter]; !ok {
+			continue
+		}
+		delete(session.filters, filter)
+		b.topics.remove(strings.Split(filter, "/"), session)
+	}
+	b.locker.Unlock()
+
+	b.send(session.connect, util.MqttAckPacket(util.MqttUnsuback, packetID))
+	return nil
+}
+
+//disconnect 客户端正常断开，不发布遗嘱消息
+func (b *mqttBroker) disconnect(session *mqttSession) {
+	b.locker.Lock()
+	session.will = nil
+	b.locker.Unlock()
+
+	_ = session.connect.Close()
+}
+
+//remove 删除会话和订阅，有遗嘱消息时发布，可以重复调用
+func (b *mqttBroker) remove(session *mqttSession) {
+	b.locker.Lock()
+	will := b.removeLocked(session)
+	b.locker.Unlock()
+
+	if will != nil {
+		b.publish(will)
+	}
+}
+
+//removeLocked 删除会话和订阅，返回需要发布的遗嘱消息，已删除时返回nil，调用时需要持有locker
+func (b *mqttBroker) removeLocked(session *mqttSession) *util.MqttMessage {
+	if session.removed {
+		return nil
+	}
+	session.removed = true
+
+	for filter := range session.filters {
+		b.topics.remove(strings.Split(filter, "/"), session)
+	}
+	delete(b.connects, session.connect.GetID())
+	if b.clients[session.clientID] == session {
+		delete(b.clients, session.clientID)
+	}
+
+	will := session.will
+	session.will = nil
+	return will
+}
+
+//session 连接的会话，未发送CONNECT或者已删除时返回nil
+func (b *mqttBroker) session(connect iface.IConnect) *mqttSession {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.connects[connect.GetID()]
+}
+
+//deliver 发送消息给一个会话，QoS1时分配报文标识符
+func (b *mqttBroker) deliver(session *mqttSession, message *util.MqttMessage, qos byte, retain bool) {
+	publish := &util.MqttMessage{
+		Topic:   message.Topic,
+		Payload: message.Payload,
+		QoS:     qos,
+		Retain:  retain,
+	}
+
+	// 报文标识符不能为0
+	for qos > 0 && publish.PacketID == 0 {
+		publish.PacketID = uint16(atomic.AddUint32(&session.packetID, 1))
+	}
+
+	b.send(session.connect, publish.Encode())
+}
+
+//send 发送报文，发送失败时只记录日志，连接断开后会删除会话
+func (b *mqttBroker) send(connect iface.IConnect, packet []byte) {
+	if _, err := connect.Send(0, packet); err != nil {
+		util.Logger.Errorf("mqtt connect fd[%d] id[%d] send error：%v", connect.GetFd(), connect.GetID(), err)
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//mqttTestConnect 只实现broker使用的方法，记录发送的报文
+type mqttTestConnect struct {
+	iface.IConnect
+	id       int
+	ctx      context.Context
+	cancel   context.CancelFunc
+	locker   sync.Mutex
+	sent     [][]byte
+	identity interface{}
+}
+
+func newMqttTestConnect(id int) *mqttTestConnect {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mqttTestConnect{id: id, ctx: ctx, cancel: cancel}
+}
+
+func (c *mqttTestConnect) GetID() int                       { return c.id }
+func (c *mqttTestConnect) GetFd() int                       { return c.id }
+func (c *mqttTestConnect) Context() context.Context         { return c.ctx }
+func (c *mqttTestConnect) SetIdentity(identity interface{}) { c.identity = identity }
+func (c *mqttTestConnect) Close() error                     { c.cancel(); return nil }
+func (c *mqttTestConnect) Send(_ uint32, bs []byte) (int, error) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.sent = append(c.sent, append([]byte(nil), bs...))
+	return len(bs), nil
+}
+
+//packets 取出已发送的报文
+func (c *mqttTestConnect) packets(t *testing.T) []*util.MqttPacket {
+	t.Helper()
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	packets := make([]*util.MqttPacket, 0)
+	for _, bs := range c.sent {
+		_, messages, err := util.NewMqttPacker().Decode(bs)
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("invalid packet %v：%v", bs, err)
+		}
+		packets = append(packets, messages[0].(*util.MqttPacket))
+	}
+	c.sent = nil
+	return packets
+}
+
+type mqttTestRequest struct {
+	iface.IRequest
+	connect iface.IConnect
+	message iface.IMessage
+}
+
+func (r *mqttTestRequest) GetConnect() iface.IConnect { return r.connect }
+func (r *mqttTestRequest) GetMessage() iface.IMessage { return r.message }
+
+func mqttTestString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func mqttTestPacket(t *testing.T, first byte, parts ...[]byte) *util.MqttPacket {
+	t.Helper()
+	remaining := make([]byte, 0)
+	for _, part := range parts {
+		remaining = append(remaining, part...)
+	}
+	_, messages, err := util.NewMqttPacker().Decode(append([]byte{first, byte(len(remaining))}, remaining...))
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("invalid packet：%v", err)
+	}
+	return messages[0].(*util.MqttPacket)
+}
+
+//mqttTestConnectPacket CONNECT报文，will不为空时带遗嘱消息（主题和内容相同）
+func mqttTestConnectPacket(t *testing.T, clientID, will string) *util.MqttPacket {
+	flags := byte(0x02)
+	payload := mqttTestString(clientID)
+	if will != "" {
+		flags |= 0x04
+		payload = append(payload, mqttTestString(will)...)
+		payload = append(payload, mqttTestString(will)...)
+	}
+	return mqttTestPacket(t, util.MqttConnect<<4, mqttTestString("MQTT"), []byte{0x04, flags, 0x00, 0x00}, payload)
+}
+
+func mqttTestSubscribePacket(t *testing.T, filter string) *util.MqttPacket {
+	return mqttTestPacket(t, util.MqttSubscribe<<4|0x02, []byte{0x00, 0x01}, mqttTestString(filter), []byte{0x01})
+}
+
+func mqttTestDo(b *mqttBroker, connect iface.IConnect, packet *util.MqttPacket) {
+	b.Do(&mqttTestRequest{connect: connect, message: packet})
+}
+
+func TestMqttBrokerTakeover(t *testing.T) {
+	b := newMqttBroker(&Options{})
+
+	watcher := newMqttTestConnect(100)
+	mqttTestDo(b, watcher, mqttTestConnectPacket(t, "watcher", ""))
+	mqttTestDo(b, watcher, mqttTestSubscribePacket(t, "will/#"))
+	watcher.packets(t)
+
+	old := newMqttTestConnect(1)
+	mqttTestDo(b, old, mqttTestConnectPacket(t, "client", "will/client"))
+	mqttTestDo(b, old, mqttTestSubscribePacket(t, "a/#"))
+	old.packets(t)
+
+	// 同一个客户端ID的新连接替换旧连接，旧连接断开并发布遗嘱消息
+	connect := newMqttTestConnect(2)
+	mqttTestDo(b, connect, mqttTestConnectPacket(t, "client", ""))
+	if old.ctx.Err() == nil {
+		t.Fatalf("old connect is not closed")
+	}
+	if packets := connect.packets(t); len(packets) != 1 || packets[0].Type != util.MqttConnack || packets[0].Remaining[1] != util.MqttAccepted {
+		t.Fatalf("connack = %v", packets)
+	}
+
+	packets := watcher.packets(t)
+	if len(packets) != 1 || packets[0].Type != util.MqttPublish {
+		t.Fatalf("will packets = %v", packets)
+	}
+	if message, _ := util.ParseMqttPublish(packets[0]); message.Topic != "will/client" {
+		t.Fatalf("will topic = %s", message.Topic)
+	}
+
+	// 旧连接的订阅已删除，之后的报文不再处理
+	b.publish(&util.MqttMessage{Topic: "a/b", Payload: []byte("x")})
+	mqttTestDo(b, old, mqttTestPacket(t, util.MqttPingreq<<4))
+	if packets := old.packets(t); len(packets) != 0 {
+		t.Fatalf("old connect packets = %v", packets)
+	}
+
+	b.locker.Lock()
+	session := b.clients["client"]
+	_, oldExists := b.connects[old.GetID()]
+	b.locker.Unlock()
+	if session == nil || session.connect != connect || oldExists {
+		t.Fatalf("session is not replaced")
+	}
+}
+
+func TestMqttBrokerConcurrentTakeover(t *testing.T) {
+	connects := make([]*mqttTestConnect, 20)
+
+	// 所有连接都认证通过后再继续，尽量同时替换会话
+	var ready sync.WaitGroup
+	ready.Add(len(connects))
+	b := newMqttBroker(&Options{
+		MqttAuthenticator: func(connect iface.IConnect, info *util.MqttConnectInfo) (interface{}, error) {
+			ready.Done()
+			ready.Wait()
+			return info.ClientID, nil
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := range connects {
+		connects[i] = newMqttTestConnect(i + 1)
+		wg.Add(1)
+		go func(connect *mqttTestConnect) {
+			defer wg.Done()
+			mqttTestDo(b, connect, mqttTestConnectPacket(t, "client", ""))
+		}(connects[i])
+	}
+	wg.Wait()
+
+	// 只保留一个会话，其它连接都已断开
+	b.locker.Lock()
+	session := b.clients["client"]
+	sessions := len(b.connects)
+	b.locker.Unlock()
+
+	alive := 0
+	for _, connect := range connects {
+		if connect.ctx.Err() == nil {
+			alive++
+			if session == nil || session.connect != connect {
+				t.Fatalf("alive connect id[%d] is not the current session", connect.GetID())
+			}
+		}
+	}
+	if alive != 1 || sessions != 1 {
+		t.Fatalf("alive = %d, sessions = %d, want 1", alive, sessions)
+	}
+}
+
+func TestMqttBrokerRetained(t *testing.T) {
+	b := newMqttBroker(&Options{})
+
+	connect := newMqttTestConnect(1)
+	mqttTestDo(b, connect, mqttTestConnectPacket(t, "client", ""))
+	connect.packets(t)
+
+	b.publish(&util.MqttMessage{Topic: "r/1", Payload: []byte("x"), QoS: 1, Retain: true})
+	b.publish(&util.MqttMessage{Topic: "r/2", Payload: []byte("y"), Retain: true})
+	b.publish(&util.MqttMessage{Topic: "other", Payload: []byte("z"), Retain: true})
+
+	// 订阅后先回复SUBACK，再发送匹配的保留消息，QoS取较小的值
+	mqttTestDo(b, connect, mqttTestSubscribePacket(t, "r/+"))
+	packets := connect.packets(t)
+	if len(packets) != 3 || packets[0].Type != util.MqttSuback {
+		t.Fatalf("packets = %v", packets)
+	}
+
+	retained := make(map[string]*util.MqttMessage)
+	for _, packet := range packets[1:] {
+		message, err := util.ParseMqttPublish(packet)
+		if err != nil {
+			t.Fatalf("parse publish：%v", err)
+		}
+		if !message.Retain {
+			t.Fatalf("%s retain flag is not set", message.Topic)
+		}
+		retained[message.Topic] = message
+	}
+	if retained["r/1"] == nil || retained["r/1"].QoS != 1 || string(retained["r/1"].Payload) != "x" {
+		t.Fatalf("r/1 = %+v", retained["r/1"])
+	}
+	if retained["r/2"] == nil || retained["r/2"].QoS != 0 {
+		t.Fatalf("r/2 = %+v", retained["r/2"])
+	}
+
+	// 订阅者收到的实时消息不带retain标记，空的保留消息删除已保存的消息
+	b.publish(&util.MqttMessage{Topic: "r/1", Retain: true})
+	packets = connect.packets(t)
+	if len(packets) != 1 {
+		t.Fatalf("packets = %v", packets)
+	}
+	if message, _ := util.ParseMqttPublish(packets[0]); message.Retain {
+		t.Fatalf("live message retain flag is set")
+	}
+
+	b.locker.Lock()
+	_, exists := b.retained["r/1"]
+	b.locker.Unlock()
+	if exists {
+		t.Fatalf("empty retained message is not deleted")
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+//mqttTopicNode 订阅树，每个节点是主题过滤器的一个层级，+、#作为普通的层级保存
+type mqttTopicNode struct {
+	children    map[string]*mqttTopicNode
+	subscribers map[*mqttSession]byte // 订阅到这个层级的会话 => 授予的QoS
+}
+
+func newMqttTopicNode() *mqttTopicNode {
+	return &mqttTopicNode{
+		children:    make(map[string]*mqttTopicNode),
+		subscribers: make(map[*mqttSession]byte),
+	}
+}
+
+//add 添加订阅，已订阅时更新QoS
+func (n *mqttTopicNode) add(levels []string, session *mqttSession, qos byte) {
+	node := n
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			child = newMqttTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers[session] = qos
+}
+
+//remove 删除订阅，没有订阅和子节点的节点也会删除，返回当前节点是否为空
+func (n *mqttTopicNode) remove(levels []string, session *mqttSession) bool {
+	if len(levels) == 0 {
+		delete(n.subscribers, session)
+	} else if child, ok := n.children[levels[0]]; ok && child.remove(levels[1:], session) {
+		delete(n.children, levels[0])
+	}
+	return len(n.subscribers) == 0 && len(n.children) == 0
+}
+
+//match 收集订阅了这个主题的会话，同一个会话匹配多个订阅时使用最大的QoS
+//system为true时（以$开头的主题）通配符不匹配第一个层级
+func (n *mqttTopicNode) match(levels []string, system bool, result map[*mqttSession]byte) {
+
+	// #匹配当前层级之后的所有层级，包括父级本身，如：a/#匹配a
+	if child, ok := n.children["#"]; ok && !system {
+		child.collect(result)
+	}
+
+	if len(levels) == 0 {
+		n.collect(result)
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], false, result)
+	}
+	if child, ok := n.children["+"]; ok && !system {
+		child.match(levels[1:], false, result)
+	}
+}
+
+//collect 当前层级的订阅
+func (n *mqttTopicNode) collect(result map[*mqttSession]byte) {
+	for session, qos := range n.subscribers {
+		if granted, ok := result[session]; !ok || qos > granted {
+			result[session] = qos
+		}
+	}
+}
@@ -1,14 +1,21 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/ikilobyte/netman/common"
 
 	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
 )
 
 //Options 可选项配置，未配置时使用默认值
@@ -28,8 +35,75 @@ type Options struct {
 	WebsocketHandler       iface.IWebsocketHandler // websocket回调
 	Application            common.ApplicationMode  // 应用层协议类型
 	UDPPacketBufferLength  uint                    // 每次读取UDP数据报的长度
+	PanicHandler           PanicHandler            // 中间件或路由出现panic时的回调
+	HandlerTimeout         time.Duration           // 路由执行的超时时间，默认：0（不检测）
+	TimeoutHandler         TimeoutHandler          // 路由执行超时的回调
+	Codec                  iface.ICodec            // AddHandler注册的路由使用的编解码，默认：json
+	ErrorHandler           ErrorHandler            // 路由解码失败、执行返回错误时的回调
+	ErrorMsgID             uint32                  // 标准错误包的消息ID
+	ErrorReply             bool                    // 未配置ErrorHandler时，是否回复标准错误包
+	WebsocketEnvelope      iface.IEnvelope         // websocket消息信封，配置后websocket消息可以使用路由
+	ReadLimitRate          float64                 // 每个连接每秒允许接收的消息数量，默认：0（不限制）
+	ReadLimitBurst         int                     // 每个连接允许突发的消息数量
+	ReadLimitAction        common.LimitAction      // 超出限制时的处理方式，只支持丢弃和关闭连接
+	AuthMsgIDs             []uint32                // 认证前允许访问的消息ID，配置后其它消息需要认证后才能访问
+	AuthTimeout            time.Duration           // 连接建立后多长时间内未认证则断开，默认：0（不检测）
+	WebsocketAuthenticator WebsocketAuthenticator  // websocket握手时认证，失败时响应401
+	BaseContext            context.Context         // 服务的上下文，所有连接的上下文都派生自这里，默认：context.Background()
+	StreamBufferSize       int                     // 流式路由未读取的数据达到这个值时暂停读取连接，默认：1MB
+	OrderedDispatch        bool                    // 同一个连接的消息按接收顺序依次执行，RESP模式默认开启
+	HTTPHandler            http.Handler            // websocket端口上非升级的HTTP请求交给这里处理，未配置时只能升级为websocket
+	WebsocketCompression   bool                    // websocket握手时协商permessage-deflate压缩
+	WebsocketCompressLevel int                     // 压缩级别
+	WebsocketCompressMin   int                     // 长度不小于这个值的消息才压缩
+	WebsocketDeflateParams DeflateParams           // permessage-deflate的协商参数
+	WebsocketOrigins       []string                // 允许握手的Origin，为空时不限制
+	WebsocketSubprotocols  []string                // 服务端支持的子协议（Sec-WebSocket-Protocol）
+	RequireSubprotocol     bool                    // 没有双方都支持的子协议时拒绝握手
+	MqttAuthenticator      MqttAuthenticator       // MQTT收到CONNECT时认证，失败时回复CONNACK（未授权）并断开
+	MqttPublishHook        MqttPublishHook         // MQTT客户端发布消息时调用，可以修改或拦截消息
+	ProxyProtocol          bool                    // 连接的最前面是PROXY协议头（v1、v2），使用其中的客户端地址
+	ProxyTrusted           []*net.IPNet            // 允许连接的代理（负载均衡）地址，为空时不限制
+	Sniff                  bool                    // 根据连接最前面的数据探测TLS和应用层协议，一个端口同时支持多种协议
+	Sniffers               []Sniffer               // 协议探测规则，按顺序匹配，都不匹配时使用Application
+	Protocol               ProtocolFactory         // 自定义应用层协议，配置后所有连接使用这个协议，不使用Application
+	outbound               outboundChain           // 发送拦截器，通过Server.UseOutbound添加
+	ctx                    context.Context         // 派生自BaseContext，服务停止时取消
+	cancel                 context.CancelFunc      //
+	isStreamRoute          func(msgID uint32) bool // 是否为流式路由
 }
 
+//PanicHandler 中间件、路由执行过程中出现panic时的回调，可以在这里给客户端回复错误消息或者关闭连接
+type PanicHandler = func(ctx iface.IContext, recovered interface{})
+
+//TimeoutHandler 路由执行时间超过配置的超时时间时的回调，此时路由仍在执行中
+type TimeoutHandler = func(ctx iface.IContext, timeout time.Duration)
+
+//ErrorHandler 路由解码失败、执行返回错误时的回调，统一在这里给客户端回复错误消息
+type ErrorHandler = func(request iface.IRequest, err error)
+
+//WebsocketAuthenticator websocket握手时根据query参数和header认证，返回的identity会设置到连接上，返回错误时拒绝握手
+type WebsocketAuthenticator = func(connect iface.IConnect, query url.Values, header http.Header) (identity interface{}, err error)
+
+//MqttAuthenticator MQTT收到CONNECT时认证，返回的identity会设置到连接上，返回错误时拒绝连接
+type MqttAuthenticator = func(connect iface.IConnect, info *util.MqttConnectInfo) (identity interface{}, err error)
+
+//MqttPublishHook MQTT客户端发布消息时调用，可以修改message的主题、内容，返回错误时丢弃这个消息（QoS1仍然回复PUBACK）
+type MqttPublishHook = func(connect iface.IConnect, message *util.MqttMessage) error
+
+//DeflateParams permessage-deflate的协商参数（RFC 7692）
+type DeflateParams struct {
+	ServerNoContextTakeover bool // 每个消息单独压缩，不保留上下文，节省内存，压缩率较低，客户端要求时也会开启
+	ClientNoContextTakeover bool // 要求客户端每个消息单独压缩，解压时不需要保留之前的数据
+	ClientMaxWindowBits     int  // 要求客户端使用的最大窗口（8~15），0表示不要求，客户端未声明支持时忽略
+}
+
+//SniffFunc 根据连接最前面已接收的数据（TLS连接是解密后的数据）判断是否为某个协议
+type SniffFunc = func(head []byte) common.SniffResult
+
+//ProtocolFactory 创建自定义应用层协议的连接，返回的连接需要嵌入baseConnect并实现DecodePacket
+type ProtocolFactory = func(baseConnect *BaseConnect) iface.IProtocolConnect
+
 type Option = func(opts *Options)
 
 //parseOption 解析可选项
@@ -39,6 +113,12 @@ func parseOption(opts ...Option) *Options {
 		opt(options)
 	}
 
+	// 服务的上下文，服务停止时取消
+	if options.BaseContext == nil {
+		options.BaseContext = context.Background()
+	}
+	options.ctx, options.cancel = context.WithCancel(options.BaseContext)
+
 	return options
 }
 
@@ -126,3 +206,260 @@ func WithUDPPacketBufferLength(length uint) Option {
 		opts.UDPPacketBufferLength = length
 	}
 }
+
+//WithWebsocketEnvelope websocket消息的信封格式，配置后会从消息中解析出msgID交给对应的路由处理，
+//找不到路由时仍然交给WebsocketHandler.Message处理，connect.Send也会使用这个格式封装
+func WithWebsocketEnvelope(envelope iface.IEnvelope) Option {
+	return func(opts *Options) {
+		opts.WebsocketEnvelope = envelope
+	}
+}
+
+//WithReadLimit 在事件循环中限制每个连接接收消息的速率，超出限制的消息不会交给路由处理
+//action只支持common.LimitDrop（丢弃消息）和common.LimitClose（关闭连接）
+func WithReadLimit(rate float64, burst int, action common.LimitAction) Option {
+	return func(opts *Options) {
+		opts.ReadLimitRate = rate
+		opts.ReadLimitBurst = burst
+		opts.ReadLimitAction = action
+	}
+}
+
+//WithAuth 开启连接认证，msgIDs为认证前允许访问的消息ID（如：登录），其它消息在认证前会被拒绝并交给ErrorHandler处理（util.AuthRequired）
+//在认证路由中认证成功后调用 request.GetConnect().SetIdentity(identity)
+func WithAuth(msgIDs ...uint32) Option {
+	return func(opts *Options) {
+		opts.AuthMsgIDs = msgIDs
+	}
+}
+
+//WithAuthTimeout 连接建立后超过这个时间仍未认证时断开连接
+func WithAuthTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.AuthTimeout = timeout
+	}
+}
+
+//WithWebsocketAuthenticator websocket握手时认证，认证成功的连接无需再通过认证路由认证
+func WithWebsocketAuthenticator(authenticator WebsocketAuthenticator) Option {
+	return func(opts *Options) {
+		opts.WebsocketAuthenticator = authenticator
+	}
+}
+
+//WithBaseContext 服务的上下文，取消时所有连接、消息的上下文也会取消
+func WithBaseContext(ctx context.Context) Option {
+	return func(opts *Options) {
+		opts.BaseContext = ctx
+	}
+}
+
+//WithStreamBufferSize 流式路由未读取的数据达到这个值时暂停读取连接，路由读取后恢复，默认：1MB
+func WithStreamBufferSize(size int) Option {
+	return func(opts *Options) {
+		opts.StreamBufferSize = size
+	}
+}
+
+//WithOrderedDispatch 同一个连接的消息按接收顺序依次执行（回复的顺序与请求一致），不同连接之间仍然并发执行
+func WithOrderedDispatch() Option {
+	return func(opts *Options) {
+		opts.OrderedDispatch = true
+	}
+}
+
+//WithHTTPHandler websocket端口上非升级的HTTP请求（健康检查、静态页面等）交给handler处理，同一个连接的请求按顺序处理
+func WithHTTPHandler(handler http.Handler) Option {
+	return func(opts *Options) {
+		opts.HTTPHandler = handler
+	}
+}
+
+//WithWebsocketCompression websocket握手时协商permessage-deflate，长度不小于threshold的Text、Binary消息压缩后发送
+//level取值范围：flate.HuffmanOnly ~ flate.BestCompression，启动时检查，解压后的长度受MaxBodyLength限制（未配置时为16MB）
+func WithWebsocketCompression(level int, threshold int) Option {
+	return func(opts *Options) {
+		opts.WebsocketCompression = true
+		opts.WebsocketCompressLevel = level
+		opts.WebsocketCompressMin = threshold
+	}
+}
+
+//WithWebsocketDeflateParams permessage-deflate的上下文、窗口大小等协商参数，需要同时配置WithWebsocketCompression，启动时检查
+func WithWebsocketDeflateParams(params DeflateParams) Option {
+	return func(opts *Options) {
+		opts.WebsocketDeflateParams = params
+	}
+}
+
+//WithWebsocketOrigins 允许握手的Origin，如：https://example.com、https://*.example.com，其它Origin回复403
+//没有Origin的请求（非浏览器客户端）不限制
+func WithWebsocketOrigins(origins ...string) Option {
+	return func(opts *Options) {
+		opts.WebsocketOrigins = append(opts.WebsocketOrigins, origins...)
+	}
+}
+
+//WithWebsocketSubprotocols 服务端支持的子协议，握手时按客户端的顺序选择第一个支持的，通过connect.GetSubprotocol()获取
+func WithWebsocketSubprotocols(protocols ...string) Option {
+	return func(opts *Options) {
+		opts.WebsocketSubprotocols = append(opts.WebsocketSubprotocols, protocols...)
+	}
+}
+
+//WithRequireSubprotocol 客户端没有提供WithWebsocketSubprotocols中的任何子协议时回复400，默认不回复Sec-WebSocket-Protocol继续握手
+func WithRequireSubprotocol() Option {
+	return func(opts *Options) {
+		opts.RequireSubprotocol = true
+	}
+}
+
+//WithMqttAuthenticator MQTT收到CONNECT时根据客户端ID、用户名、密码认证，未配置时所有连接都可以连接
+func WithMqttAuthenticator(authenticator MqttAuthenticator) Option {
+	return func(opts *Options) {
+		opts.MqttAuthenticator = authenticator
+	}
+}
+
+//WithMqttPublishHook MQTT客户端发布消息时调用，可以用于鉴权、记录日志、转发到其它服务
+func WithMqttPublishHook(hook MqttPublishHook) Option {
+	return func(opts *Options) {
+		opts.MqttPublishHook = hook
+	}
+}
+
+//WithProxyProtocol 开启PROXY协议，每个TCP连接都需要先发送PROXY协议头（在TLS握手之前），GetAddress返回客户端的真实地址
+//trusted为允许连接的代理地址，可以是IP或者CIDR，如：10.0.0.0/8，其它地址的连接直接断开，为空时不限制，格式有误时会panic
+func WithProxyProtocol(trusted ...string) Option {
+	nets := make([]*net.IPNet, 0, len(trusted))
+	for _, item := range trusted {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Panicf("invalid proxy trusted address %s：%v", item, err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return func(opts *Options) {
+		opts.ProxyProtocol = true
+		opts.ProxyTrusted = nets
+	}
+}
+
+//WithSniff 开启协议探测，根据连接最前面的数据选择TLS和应用层协议，配置了TLS证书时也接受非TLS连接
+//未传入规则时HTTP请求使用websocket协议（需要配置WithWebsocketHandler），其它数据使用Application
+func WithSniff(sniffers ...Sniffer) Option {
+	return func(opts *Options) {
+		opts.Sniff = true
+		opts.Sniffers = append(opts.Sniffers, sniffers...)
+	}
+}
+
+//WithWebsocketHandler websocket回调，非websocket服务开启协议探测时也可以接收websocket连接
+func WithWebsocketHandler(handler iface.IWebsocketHandler) Option {
+	return func(opts *Options) {
+		opts.WebsocketHandler = handler
+	}
+}
+
+//WithProtocol 自定义应用层协议，每个新连接都通过factory创建，解码出的消息按msgID交给路由处理
+func WithProtocol(factory ProtocolFactory) Option {
+	return func(opts *Options) {
+		opts.Protocol = factory
+	}
+}
+
+//WithPanicHandler 中间件或路由出现panic时的回调，框架会先记录日志和堆栈信息
+func WithPanicHandler(handler PanicHandler) Option {
+	return func(opts *Options) {
+		opts.PanicHandler = handler
+	}
+}
+
+//WithHandlerTimeout 所有路由的执行超时时间，超时后会记录日志并执行TimeoutHandler，不会中断路由的执行，但是消息的上下文会被取消
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.HandlerTimeout = timeout
+	}
+}
+
+//WithTimeoutHandler 路由执行超时的回调
+func WithTimeoutHandler(handler TimeoutHandler) Option {
+	return func(opts *Options) {
+		opts.TimeoutHandler = handler
+	}
+}
+
+//WithCodec AddHandler注册的路由使用的编解码方式，默认：json
+func WithCodec(codec iface.ICodec) Option {
+	return func(opts *Options) {
+		opts.Codec = codec
+	}
+}
+
+//WithErrorHandler 路由解码失败、执行返回错误时的回调
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(opts *Options) {
+		opts.ErrorHandler = handler
+	}
+}
+
+//WithErrorMsgID 路由返回错误时，使用这个消息ID回复标准错误包（util.ErrorPacket），配置了ErrorHandler时不生效
+//启动时检查配置的codec能否编码标准错误包
+func WithErrorMsgID(msgID uint32) Option {
+	return func(opts *Options) {
+		opts.ErrorMsgID = msgID
+		opts.ErrorReply = true
+	}
+}
+
+//authorized 未开启认证、连接已认证或者是认证前允许访问的消息
+func (o *Options) authorized(request iface.IRequest) bool {
+	if len(o.AuthMsgIDs) == 0 || request.GetConnect().IsAuthenticated() {
+		return true
+	}
+
+	msgID := request.GetMessage().ID()
+	for _, id := range o.AuthMsgIDs {
+		if id == msgID {
+			return true
+		}
+	}
+	return false
+}
+
+//checkErrorPacket 配置了WithErrorMsgID时，标准错误包需要能使用配置的codec编码
+func (o *Options) checkErrorPacket() error {
+	if !o.ErrorReply || o.ErrorHandler != nil {
+		return nil
+	}
+	if _, err := o.Codec.Marshal(&util.ErrorPacket{}); err != nil {
+		return fmt.Errorf("codec %s can not encode util.ErrorPacket：%w", o.Codec.Name(), err)
+	}
+	return nil
+}
+
+//handleError 优先使用ErrorHandler，其次是标准错误包，都未配置时只记录日志
+func (o *Options) handleError(request iface.IRequest, err error) {
+	if o.ErrorHandler == nil && o.ErrorReply {
+		sendErrorPacket(request, err, o)
+		return
+	}
+
+	if o.ErrorHandler == nil {
+		util.Logger.
+			WithField("connID", request.GetConnect().GetID()).
+			WithField("msgID", request.GetMessage().ID()).
+			Errorf("handler error %v", err)
+		return
+	}
+	o.ErrorHandler(request, err)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//orderedDispatcher 同一个连接的消息按接收顺序依次执行，不同连接之间并发执行
+type orderedDispatcher struct {
+	locker sync.Mutex
+	queues map[int][]iface.IContext // connID => 待执行的消息，存在时表示这个连接有goroutine正在执行
+}
+
+func newOrderedDispatcher() *orderedDispatcher {
+	return &orderedDispatcher{
+		queues: make(map[int][]iface.IContext),
+	}
+}
+
+//dispatch 加入连接的队列，没有正在执行的goroutine时创建一个
+func (d *orderedDispatcher) dispatch(ctx iface.IContext, routerMgr *RouterMgr, options *Options) {
+	connID := ctx.GetConnect().GetID()
+
+	d.locker.Lock()
+	queue, running := d.queues[connID]
+	d.queues[connID] = append(queue, ctx)
+	d.locker.Unlock()
+
+	if !running {
+		go d.run(connID, routerMgr, options)
+	}
+}
+
+//run 依次执行队列中的消息，队列为空时退出
+func (d *orderedDispatcher) run(connID int, routerMgr *RouterMgr, options *Options) {
+	for {
+		d.locker.Lock()
+		queue := d.queues[connID]
+		if len(queue) == 0 {
+			delete(d.queues, connID)
+			d.locker.Unlock()
+			return
+		}
+		ctx := queue[0]
+		queue[0] = nil
+		d.queues[connID] = queue[1:]
+		d.locker.Unlock()
+
+		routerMgr.Dispatch(ctx, options)
+	}
+}
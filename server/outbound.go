@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//outboundInterceptor 发送拦截器，msgIDs为空时对所有消息生效
+type outboundInterceptor struct {
+	callable iface.OutboundFunc
+	msgIDs   map[uint32]bool
+}
+
+//match 是否对这个消息生效
+func (o *outboundInterceptor) match(msgID uint32) bool {
+	return len(o.msgIDs) == 0 || o.msgIDs[msgID]
+}
+
+//outboundChain 发送拦截器链，所有发送消息的地方（Send、Text、Binary）都会经过这里
+type outboundChain struct {
+	locker       sync.Mutex
+	interceptors atomic.Value // []*outboundInterceptor 每次添加都会生成新的slice，发送时无需加锁
+}
+
+//add 添加拦截器，按添加顺序执行
+func (o *outboundChain) add(callable iface.OutboundFunc, msgIDs ...uint32) {
+	o.locker.Lock()
+	defer o.locker.Unlock()
+
+	interceptor := &outboundInterceptor{
+		callable: callable,
+		msgIDs:   make(map[uint32]bool),
+	}
+	for _, msgID := range msgIDs {
+		interceptor.msgIDs[msgID] = true
+	}
+
+	interceptors := o.load()
+	replaced := make([]*outboundInterceptor, 0, len(interceptors)+1)
+	replaced = append(replaced, interceptors...)
+	o.interceptors.Store(append(replaced, interceptor))
+}
+
+//load 当前生效的拦截器
+func (o *outboundChain) load() []*outboundInterceptor {
+	interceptors, _ := o.interceptors.Load().([]*outboundInterceptor)
+	return interceptors
+}
+
+//send 依次执行拦截器后调用write发送，拦截器返回错误时取消发送并返回这个错误，不调用next时消息会被丢弃
+func (o *outboundChain) send(connect iface.IConnect, message iface.IMessage, write func(message iface.IMessage) (int, error)) (int, error) {
+
+	interceptors := o.load()
+	if len(interceptors) == 0 {
+		return write(message)
+	}
+
+	n := 0
+	var call func(index int, message iface.IMessage) error
+	call = func(index int, message iface.IMessage) error {
+		for ; index < len(interceptors); index++ {
+			if interceptor := interceptors[index]; interceptor.match(message.ID()) {
+				next := index + 1
+				return interceptor.callable(connect, message, func(message iface.IMessage) error {
+					return call(next, message)
+				})
+			}
+		}
+
+		var err error
+		n, err = write(message)
+		return err
+	}
+
+	if err := call(0, message); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+//newOutboundMessage 要发送的消息
+func newOutboundMessage(msgID uint32, bs []byte, opcode uint8) iface.IMessage {
+	message := &util.Message{
+		MsgID:       msgID,
+		IsWebSocket: opcode > 0,
+		Opcode:      opcode,
+	}
+	message.SetData(bs)
+	return message
+}
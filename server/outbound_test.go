@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//outboundTestAppend 在消息后面追加suffix的拦截器
+func outboundTestAppend(suffix string) iface.OutboundFunc {
+	return func(connect iface.IConnect, message iface.IMessage, next iface.OutboundNext) error {
+		return next(newOutboundMessage(message.ID(), append(message.Bytes(), suffix...), 0))
+	}
+}
+
+func TestOutboundChain(t *testing.T) {
+	errCanceled := errors.New("canceled")
+
+	tests := []struct {
+		name  string
+		setup func(o *outboundChain)
+		msgID uint32
+		want  string // 实际发送的内容，空表示没有发送
+		err   error
+	}{
+		{"no interceptor", func(o *outboundChain) {}, 1, "data", nil},
+		{"in order", func(o *outboundChain) {
+			o.add(outboundTestAppend("-a"))
+			o.add(outboundTestAppend("-b"))
+		}, 1, "data-a-b", nil},
+		{"msgID matched", func(o *outboundChain) {
+			o.add(outboundTestAppend("-a"), 1, 2)
+			o.add(outboundTestAppend("-b"), 3)
+		}, 2, "data-a", nil},
+		{"msgID not matched", func(o *outboundChain) {
+			o.add(outboundTestAppend("-a"), 2)
+		}, 1, "data", nil},
+		{"canceled", func(o *outboundChain) {
+			o.add(func(iface.IConnect, iface.IMessage, iface.OutboundNext) error { return errCanceled })
+			o.add(outboundTestAppend("-b"))
+		}, 1, "", errCanceled},
+		{"dropped", func(o *outboundChain) {
+			o.add(outboundTestAppend("-a"))
+			o.add(func(iface.IConnect, iface.IMessage, iface.OutboundNext) error { return nil })
+		}, 1, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &outboundChain{}
+			tt.setup(o)
+
+			sent := ""
+			n, err := o.send(nil, newOutboundMessage(tt.msgID, []byte("data"), 0), func(message iface.IMessage) (int, error) {
+				sent = string(message.Bytes())
+				return len(sent), nil
+			})
+			if err != tt.err || sent != tt.want || n != len(tt.want) {
+				t.Fatalf("send = %d %q %v, want %q %v", n, sent, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestOutboundConnect(t *testing.T) {
+	var intercepted []iface.IConnect
+	interceptor := func(connect iface.IConnect, message iface.IMessage, next iface.OutboundNext) error {
+		intercepted = append(intercepted, connect)
+		return nil
+	}
+
+	// 拦截器的参数是应用层协议的连接，而不是嵌入的BaseConnect
+	router, _, _ := newRouterTestConnect(t)
+	router.options.outbound.add(interceptor)
+	_, _ = router.Send(1, []byte("data"))
+
+	websocket := newWebsocketTestConnect(nil, nil, WithWebsocketEnvelope(util.NewJSONEnvelope()))
+	websocket.options.outbound.add(interceptor)
+	_, _ = websocket.Send(1, []byte("data"))
+	_, _ = websocket.Text([]byte("data"))
+	_, _ = websocket.Binary([]byte("data"))
+
+	want := []iface.IConnect{router, websocket, websocket, websocket}
+	if len(intercepted) != len(want) {
+		t.Fatalf("intercepted %d messages, want %d", len(intercepted), len(want))
+	}
+	for i := range want {
+		if intercepted[i] != want[i] {
+			t.Fatalf("message %d connect = %T", i, intercepted[i])
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+)
+
+//newProtocol 创建连接的应用层协议，配置了factory时使用自定义协议
+func newProtocol(baseConnect *BaseConnect, application common.ApplicationMode, factory ProtocolFactory) iface.IConnect {
+	var connect iface.IConnect
+	switch {
+	case factory != nil:
+		connect = factory(baseConnect) // 自定义应用层协议
+	case application == common.WebsocketMode:
+		connect = newWebsocketProtocol(baseConnect) // websocket协议
+	default:
+		connect = newRouterProtocol(baseConnect) // 路由模式、RESP模式
+	}
+
+	baseConnect.self = connect
+
+	// self设置后才执行onopen事件，和onclose的参数是同一个连接，协议探测已完成
+	atomic.CompareAndSwapInt32(&baseConnect.opened, -1, 0)
+	baseConnect.open()
+	return connect
+}
+
+// ReadData 读取数据，开启TLS时是解密后的数据，非阻塞模式下没有数据时返回unix.EAGAIN
+func (c *BaseConnect) ReadData(bs []byte) (int, error) {
+	return c.readData(bs)
+}
+
+// WriteData 发送已封包的数据，开启TLS时先加密，内核缓冲区满时放入发送队列，可写后继续发送
+func (c *BaseConnect) WriteData(dataPack []byte) (int, error) {
+	if c.GetTLSEnable() {
+		c.tlsWritePacketSize = len(dataPack)
+		return c.tlsLayer.Write(dataPack)
+	}
+	return c.Write(dataPack)
+}
+
+// SendWith 先执行发送拦截器，再使用encode封包后发送，自定义协议可以在Send中调用
+func (c *BaseConnect) SendWith(msgID uint32, bs []byte, encode func(message iface.IMessage) ([]byte, error)) (int, error) {
+	return c.options.outbound.send(c.self, newOutboundMessage(msgID, bs, 0), func(message iface.IMessage) (int, error) {
+		dataPack, err := encode(message)
+		if err != nil {
+			return 0, err
+		}
+		return c.WriteData(dataPack)
+	})
+}
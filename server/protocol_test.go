@@ -0,0 +1,184 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+	"golang.org/x/sys/unix"
+)
+
+//lineTestProtocol 自定义协议，只实现DecodePacket和Send
+type lineTestProtocol struct {
+	*BaseConnect
+}
+
+func (c *lineTestProtocol) DecodePacket() (iface.IMessage, error) {
+	return nil, nil
+}
+
+func (c *lineTestProtocol) Send(msgID uint32, bs []byte) (int, error) {
+	return c.SendWith(msgID, bs, func(message iface.IMessage) ([]byte, error) {
+		return append(message.Bytes(), '\n'), nil
+	})
+}
+
+//protocolTestHooks 记录onopen事件的连接
+type protocolTestHooks chan iface.IConnect
+
+func (h protocolTestHooks) OnOpen(connect iface.IConnect) { h <- connect }
+func (h protocolTestHooks) OnClose(iface.IConnect)        {}
+
+func TestNewProtocol(t *testing.T) {
+	factory := func(baseConnect *BaseConnect) iface.IProtocolConnect {
+		return &lineTestProtocol{BaseConnect: baseConnect}
+	}
+
+	tests := []struct {
+		name        string
+		application common.ApplicationMode
+		factory     ProtocolFactory
+		want        func(connect iface.IConnect) bool
+	}{
+		{"router", common.RouterMode, nil, func(connect iface.IConnect) bool {
+			_, ok := connect.(*routerProtocol)
+			return ok
+		}},
+		{"websocket", common.WebsocketMode, nil, func(connect iface.IConnect) bool {
+			_, ok := connect.(*websocketProtocol)
+			return ok
+		}},
+		{"factory", common.WebsocketMode, factory, func(connect iface.IConnect) bool {
+			_, ok := connect.(*lineTestProtocol)
+			return ok
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hooks := make(protocolTestHooks, 1)
+			base := newBaseConnect(1, -1, &net.TCPAddr{}, parseOption(WithHooks(hooks)))
+			connect := newProtocol(base, tt.application, tt.factory)
+			if !tt.want(connect) {
+				t.Fatalf("protocol = %T", connect)
+			}
+			if base.self != connect {
+				t.Fatalf("self = %T, want %T", base.self, connect)
+			}
+
+			// onopen的参数是应用层协议的连接
+			select {
+			case opened := <-hooks:
+				if opened != connect {
+					t.Fatalf("onopen connect = %T", opened)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("onopen is not called")
+			}
+		})
+	}
+}
+
+func TestProtocolSendWith(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair：%v", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	// 发送拦截器的参数是应用层协议的连接，修改后的消息交给协议封包
+	var intercepted iface.IConnect
+	options := parseOption(WithProtocol(func(baseConnect *BaseConnect) iface.IProtocolConnect {
+		return &lineTestProtocol{BaseConnect: baseConnect}
+	}))
+	options.outbound.add(func(connect iface.IConnect, message iface.IMessage, next iface.OutboundNext) error {
+		intercepted = connect
+		return next(newOutboundMessage(message.ID(), append(message.Bytes(), '!'), 0))
+	})
+
+	connect := newProtocol(newBaseConnect(1, fds[0], &net.TCPAddr{}, options), common.RouterMode, options.Protocol)
+	if _, err := connect.Send(1, []byte("hello")); err != nil {
+		t.Fatalf("send：%v", err)
+	}
+	if intercepted != connect {
+		t.Fatalf("interceptor connect = %T", intercepted)
+	}
+
+	buffer := make([]byte, 64)
+	n, err := unix.Read(fds[1], buffer)
+	if err != nil {
+		t.Fatalf("read：%v", err)
+	}
+	if string(buffer[:n]) != "hello!\n" {
+		t.Fatalf("peer received %q", buffer[:n])
+	}
+}
+
+func TestBaseConnectOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		sniff bool
+	}{
+		{"proxy", []Option{WithProxyProtocol()}, false},
+		{"sniff", []Option{WithSniff()}, true},
+		{"proxy and sniff", []Option{WithProxyProtocol(), WithSniff()}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+			if err != nil {
+				t.Fatalf("socketpair：%v", err)
+			}
+			defer unix.Close(fds[0])
+			defer unix.Close(fds[1])
+
+			hooks := make(protocolTestHooks, 2)
+			options := parseOption(append(tt.opts, WithHooks(hooks))...)
+			base := newBaseConnect(1, fds[0], &net.TCPAddr{}, options)
+
+			// 协议探测中、PROXY协议头读取之前都不执行onopen事件
+			if tt.sniff {
+				newSniffConnect(base)
+			} else {
+				newProtocol(base, common.RouterMode, nil)
+			}
+			if options.ProxyProtocol {
+				if _, err := unix.Write(fds[1], []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1000 2000\r\n")); err != nil {
+					t.Fatalf("write：%v", err)
+				}
+				if _, err := base.ReadProxyHeader(); err != nil || base.GetProxyHeader() == nil {
+					t.Fatalf("read proxy header：%v", err)
+				}
+			}
+
+			var connect iface.IConnect = base.self
+			if tt.sniff {
+				time.Sleep(10 * time.Millisecond)
+				if len(hooks) != 0 {
+					t.Fatal("onopen is called while sniffing")
+				}
+				connect = newProtocol(base, common.RouterMode, nil)
+			}
+
+			// 只执行一次，参数是应用层协议的连接
+			select {
+			case opened := <-hooks:
+				if opened != connect {
+					t.Fatalf("onopen connect = %T", opened)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("onopen is not called")
+			}
+			base.open()
+			time.Sleep(10 * time.Millisecond)
+			if len(hooks) != 0 {
+				t.Fatal("onopen is called twice")
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io"
+	"net"
+
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+//trustedProxy 开启PROXY协议时，连接是否来自受信任的代理，未配置受信任的地址时不限制
+func (o *Options) trustedProxy(addr net.Addr) bool {
+	if !o.ProxyProtocol || len(o.ProxyTrusted) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range o.ProxyTrusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+//proxyEnabled 是否需要先读取PROXY协议头，UDP不支持
+func (c *BaseConnect) proxyEnabled() bool {
+	return c.options.ProxyProtocol && !c.IsUDP()
+}
+
+// ReadProxyHeader 开启PROXY协议时，在TLS握手、解码之前读取PROXY协议头，返回是否可以继续处理这次可读事件
+// 先通过MSG_PEEK查看数据，只读取属于包头的部分，之后的数据（如：TLS握手）仍留在内核缓冲区中
+func (c *BaseConnect) ReadProxyHeader() (bool, error) {
+	if !c.proxyEnabled() || c.proxyHeader != nil {
+		return true, nil
+	}
+
+	buffer := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(c.fd, buffer, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	if err != nil {
+		if err == unix.EAGAIN || err == unix.EINTR {
+			return false, nil
+		}
+		return false, err
+	}
+	if n == 0 {
+		return false, io.EOF
+	}
+
+	buf := append(c.proxyBuffer, buffer[:n]...)
+	header, length, err := util.ParseProxyHeader(buf)
+	if err != nil {
+		return false, err
+	}
+
+	// 数据不完整时查看到的数据都属于包头，需要读取出来，否则会一直收到可读事件
+	consume := n
+	if length > 0 {
+		consume = length - len(c.proxyBuffer)
+	}
+	if read, err := unix.Read(c.fd, buffer[:consume]); err != nil || read != consume {
+		return false, util.ProxyHeaderFail
+	}
+
+	if length == 0 {
+		c.proxyBuffer = buf
+		return false, nil
+	}
+
+	// 替换为客户端的真实地址
+	c.proxyBuffer = nil
+	c.proxyHeader = header
+	if !header.Local && header.Source != nil {
+		c.Address = header.Source
+	}
+
+	// 包头读取完后才执行onopen事件，这时已经是客户端的真实地址
+	c.open()
+
+	// 后面没有数据时等下一次可读事件，避免TLS握手阻塞事件循环
+	return n > consume, nil
+}
+
+// GetProxyHeader 获取PROXY协议头，未开启PROXY协议或者还未接收时返回nil
+func (c *BaseConnect) GetProxyHeader() *util.ProxyHeader {
+	return c.proxyHeader
+}
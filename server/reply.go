@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//replier 有返回值的路由，返回值经过中间件后由框架回复
+type replier interface {
+	reply(request iface.IRequest) *util.Reply
+}
+
+//replyRouter 将IReplyRouter适配为IRouter，这样就可以在分组中间件中使用
+type replyRouter struct {
+	router  iface.IReplyRouter
+	options *Options
+}
+
+//newReplyRouter .
+func newReplyRouter(router iface.IReplyRouter, options *Options) iface.IRouter {
+	return &replyRouter{
+		router:  router,
+		options: options,
+	}
+}
+
+//Do 不经过RouterMgr直接调用时，也能正常回复
+func (r *replyRouter) Do(request iface.IRequest) {
+	sendReply(request, r.reply(request), r.options)
+}
+
+func (r *replyRouter) reply(request iface.IRequest) *util.Reply {
+	msgID, payload, err := r.router.Do(request)
+	return &util.Reply{
+		MsgID:   msgID,
+		Payload: payload,
+		Err:     err,
+	}
+}
+
+//sendReply 将路由的返回值回复给客户端，返回了错误时交给ErrorHandler处理
+func sendReply(request iface.IRequest, reply *util.Reply, options *Options) {
+
+	if reply == nil {
+		return
+	}
+
+	if reply.Err != nil {
+		options.handleError(request, reply.Err)
+		return
+	}
+
+	if reply.Payload == nil {
+		return
+	}
+
+	bs, err := encodePayload(reply.Payload, options)
+	if err != nil {
+		options.handleError(request, fmt.Errorf("%w: %v", util.CodecEncodeFail, err))
+		return
+	}
+
+	if _, err := request.GetConnect().Send(reply.MsgID, bs); err != nil {
+		util.Logger.Errorf("send reply error %v", err)
+	}
+}
+
+//sendErrorPacket 回复标准错误包
+func sendErrorPacket(request iface.IRequest, err error, options *Options) {
+
+	packet := &util.ErrorPacket{
+		MsgID: request.GetMessage().ID(),
+		Error: err.Error(),
+	}
+
+	var e *util.Error
+	if errors.As(err, &e) {
+		packet.Code = e.Code
+	}
+
+	bs, err := encodePayload(packet, options)
+	if err != nil {
+		util.Logger.Errorf("encode error packet error %v", err)
+		return
+	}
+
+	if _, err := request.GetConnect().Send(options.ErrorMsgID, bs); err != nil {
+		util.Logger.Errorf("send error packet error %v", err)
+	}
+}
+
+//encodePayload []byte和string原样返回，其它类型使用codec编码
+func encodePayload(payload interface{}, options *Options) ([]byte, error) {
+	switch value := payload.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	}
+	return options.Codec.Marshal(payload)
+}
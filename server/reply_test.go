@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//replyTestCodec 只能编码指定类型的codec，如：google protobuf的proto.Message
+type replyTestCodec struct{}
+
+func (c replyTestCodec) Name() string { return "test" }
+func (c replyTestCodec) Marshal(v interface{}) ([]byte, error) {
+	return nil, errors.New("not a proto.Message")
+}
+func (c replyTestCodec) Unmarshal([]byte, interface{}) error { return nil }
+
+func TestCheckErrorPacket(t *testing.T) {
+	handler := func(request iface.IRequest, err error) {}
+
+	tests := []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"no error reply", []Option{WithCodec(replyTestCodec{})}, true},
+		{"json", []Option{WithErrorMsgID(500), WithCodec(util.NewJSONCodec())}, true},
+		{"gob", []Option{WithErrorMsgID(500), WithCodec(util.NewGobCodec())}, true},
+		{"gogo protobuf", []Option{WithErrorMsgID(500), WithCodec(util.NewGogoProtoCodec())}, true},
+		{"unusable codec", []Option{WithErrorMsgID(500), WithCodec(replyTestCodec{})}, false},
+		{"error handler", []Option{WithErrorMsgID(500), WithCodec(replyTestCodec{}), WithErrorHandler(handler)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseOption(tt.opts...).checkErrorPacket()
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSendErrorPacketGogoProto(t *testing.T) {
+	options := parseOption(WithErrorMsgID(500), WithCodec(util.NewGogoProtoCodec()))
+	connect := newMqttTestConnect(1)
+	request := &mqttTestRequest{connect: connect, message: &util.Message{MsgID: 7}}
+
+	options.handleError(request, util.NewError(429, "rate limit exceeded"))
+
+	if len(connect.sent) != 1 {
+		t.Fatalf("sent = %d packets, want 1", len(connect.sent))
+	}
+	var packet util.ErrorPacket
+	if err := util.NewGogoProtoCodec().Unmarshal(connect.sent[0], &packet); err != nil {
+		t.Fatalf("unmarshal：%v", err)
+	}
+	if packet != (util.ErrorPacket{MsgID: 7, Code: 429, Error: "rate limit exceeded"}) {
+		t.Fatalf("packet = %+v", packet)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+// Resp 创建一个Redis协议（RESP2/RESP3）的server，通过AddCommand根据命令名添加路由，可以使用redis-cli等客户端访问
+// 同一个连接的命令按顺序执行，内置了HELLO命令（切换协议版本），未添加的命令回复unknown command
+func Resp(ip string, port int, opts ...Option) *Server {
+	packer := util.NewRespPacker()
+	opts = append([]Option{WithPacker(packer), WithOrderedDispatch()}, opts...)
+
+	server, options := createTcpServer(ip, port, opts...)
+
+	// 应用层协议模式
+	options.Application = common.RespMode
+
+	if _, ok := options.Packer.(*util.RespPacker); !ok {
+		log.Panicln("resp mode must use util.RespPacker")
+	}
+
+	server.AddCommand("HELLO", new(respHello))
+	server.NotFound(new(respUnknownCommand))
+	return server
+}
+
+// AddCommand RESP模式下根据命令名添加路由，命令名不区分大小写，已添加的命令会被替换，命令的参数通过util.RespArgs获取
+func (s *Server) AddCommand(name string, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	packer, ok := s.options.Packer.(*util.RespPacker)
+	if s.options.Application != common.RespMode || !ok {
+		log.Panicln("AddCommand is only available in resp mode, see server.Resp")
+		return
+	}
+
+	// 已添加的命令（包括内置的HELLO）会被替换
+	if err := s.routerMgr.Replace(packer.Bind(name), router, middlewares...); err != nil {
+		util.Logger.Errorf("add command %s error：%v", name, err)
+	}
+}
+
+// respHello HELLO [protover [AUTH username password] [SETNAME clientname]]，切换协议版本并回复服务信息
+type respHello struct{}
+
+func (h *respHello) Do(request iface.IRequest) {
+	args := util.RespArgs(request.GetMessage())
+	connect := request.GetConnect()
+	packer, _ := connect.GetPacker().(*util.RespPacker)
+
+	version := 0
+	if packer != nil {
+		version = packer.Version()
+	}
+
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			_ = util.NewRespWriter(connect).Error("ERR Protocol version is not an integer or out of range").Flush()
+			return
+		}
+		if v != 2 && v != 3 {
+			_ = util.NewRespWriter(connect).Error("NOPROTO unsupported protocol version").Flush()
+			return
+		}
+		version = v
+	}
+
+	// 认证需要使用单独的命令，不能在HELLO中忽略
+	for _, arg := range args[1:] {
+		if strings.EqualFold(string(arg), "AUTH") {
+			_ = util.NewRespWriter(connect).Error("ERR AUTH in HELLO is not supported").Flush()
+			return
+		}
+	}
+
+	if packer != nil {
+		packer.SetVersion(version)
+	}
+
+	w := util.NewRespWriter(connect)
+	w.Map(6)
+	w.BulkString("server").BulkString("netman")
+	w.BulkString("proto").Integer(int64(version))
+	w.BulkString("id").Integer(int64(connect.GetID()))
+	w.BulkString("mode").BulkString("standalone")
+	w.BulkString("role").BulkString("master")
+	w.BulkString("modules").Array(0)
+	_ = w.Flush()
+}
+
+// respUnknownCommand 未添加的命令，与redis的错误信息相同
+type respUnknownCommand struct{}
+
+func (u *respUnknownCommand) Do(request iface.IRequest) {
+	args := util.RespArgs(request.GetMessage())
+	if len(args) == 0 {
+		return
+	}
+
+	rest := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		rest = append(rest, fmt.Sprintf("'%s'", arg))
+	}
+
+	message := fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0], strings.Join(rest, " "))
+	_ = util.NewRespWriter(request.GetConnect()).Error(message).Flush()
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+type routeKind = uint8
+
+const (
+	exactRoute routeKind = iota // 精确匹配
+	rangeRoute                  // msgID在[from, to]范围内
+	maskRoute                   // msgID & mask == value
+	anyRoute                    // 匹配所有消息
+)
+
+// routeEntry 路由定义
+type routeEntry struct {
+	kind        routeKind
+	msgID       uint32 // 精确匹配的msgID，掩码匹配时为value
+	from        uint32 // 范围匹配的起始msgID
+	to          uint32 // 范围匹配的结束msgID
+	mask        uint32 // 掩码
+	router      iface.IRouter
+	middlewares []iface.MiddlewareFunc // 只对这个路由生效的中间件
+	group       *MiddlewareGroup       // 所属分组，nil表示不属于任何分组
+}
+
+// match msgID是否匹配这个路由
+func (e *routeEntry) match(msgID uint32) bool {
+	switch e.kind {
+	case rangeRoute:
+		return msgID >= e.from && msgID <= e.to
+	case maskRoute:
+		return msgID&e.mask == e.msgID
+	case anyRoute:
+		return true
+	}
+	return msgID == e.msgID
+}
+
+// overlaps 两个范围、掩码路由是否可以匹配同一个msgID
+func (e *routeEntry) overlaps(other *routeEntry) bool {
+	switch {
+	case e.kind == rangeRoute && other.kind == rangeRoute:
+		return e.from <= other.to && other.from <= e.to
+	case e.kind == maskRoute && other.kind == maskRoute:
+		return (e.msgID^other.msgID)&e.mask&other.mask == 0
+	}
+
+	// 范围和掩码：范围内第一个匹配掩码的msgID
+	r, m := e, other
+	if r.kind == maskRoute {
+		r, m = other, e
+	}
+	msgID, ok := nextMaskMatch(r.from, m.mask, m.msgID)
+	return ok && msgID <= r.to
+}
+
+// nextMaskMatch 不小于from且 msgID & mask == value 的最小msgID，不存在时返回false
+func nextMaskMatch(from, mask, value uint32) (uint32, bool) {
+	value &= mask
+	raise := -1 // 最低的可以从0改为1的非掩码位，改为1后结果大于from
+
+	for i := 31; i >= 0; i-- {
+		bit := uint32(1) << uint(i)
+		if mask&bit == 0 {
+			if from&bit == 0 {
+				raise = i
+			}
+			continue
+		}
+		if from&bit == value&bit {
+			continue
+		}
+
+		// 掩码位为1、from为0：高位与from相同，低位取最小值
+		if value&bit != 0 {
+			return from&^(bit<<1-1) | value&(bit<<1-1), true
+		}
+
+		// 掩码位为0、from为1：需要把更高的一个非掩码位改为1
+		if raise < 0 {
+			return 0, false
+		}
+		bit = uint32(1) << uint(raise)
+		return from&^(bit<<1-1) | bit | value&(bit-1), true
+	}
+	return from, true
+}
+
+// String 路由的描述，也用于判断是否重复添加
+func (e *routeEntry) String() string {
+	switch e.kind {
+	case rangeRoute:
+		return fmt.Sprintf("range[%d-%d]", e.from, e.to)
+	case maskRoute:
+		return fmt.Sprintf("mask[%#x=%#x]", e.mask, e.msgID)
+	case anyRoute:
+		return "any"
+	}
+	return fmt.Sprintf("%d", e.msgID)
+}
+
+// RouteInfo 路由信息，用于查看当前生效的路由表
+type RouteInfo struct {
+	Route       string        // 路由，如：1、range[1-10]、mask[0xffff0000=0x10000]、any
+	Router      string        // 路由的类型
+	Middlewares int           // 中间件数量，不包含全局中间件
+	Grouped     bool          // 是否属于分组
+	Timeout     time.Duration // 执行超时时间，0表示使用全局配置
+}
+
+// rangeGroup 范围匹配的分组
+type rangeGroup struct {
+	group       *MiddlewareGroup
+	ranges      [][2]uint32
+	middlewares []iface.MiddlewareFunc
+}
+
+// match msgID是否在范围内
+func (g *rangeGroup) match(msgID uint32) bool {
+	for _, r := range g.ranges {
+		if msgID >= r[0] && msgID <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTable 路由表，生成后只读，修改路由时会生成一个新的路由表替换，分发消息时无需加锁
+type routeTable struct {
+	entries           []*routeEntry                     // 所有的路由，按添加顺序
+	inner             map[uint32]*routeEntry            // 精确匹配的路由
+	routeMiddleware   map[uint32][]iface.MiddlewareFunc // 精确匹配的路由中间件
+	patterns          []*routeEntry                     // 范围、掩码匹配的路由，互不重叠
+	any               *routeEntry                       // 匹配所有消息的路由，精确匹配、范围、掩码路由都不匹配时执行
+	rangeGroups       []*rangeGroup                     // 范围匹配的分组
+	globalMiddlewares []iface.MiddlewareFunc            // 全局中间件
+	notFound          iface.IRouter                     // 找不到路由时执行
+	timeouts          map[uint32]time.Duration          // 路由执行超时时间
+	streaming         bool                              // 是否有流式路由
+}
+
+// newRouteTable 空的路由表
+func newRouteTable() *routeTable {
+	return &routeTable{
+		entries:           make([]*routeEntry, 0),
+		inner:             make(map[uint32]*routeEntry),
+		routeMiddleware:   make(map[uint32][]iface.MiddlewareFunc),
+		patterns:          make([]*routeEntry, 0),
+		rangeGroups:       make([]*rangeGroup, 0),
+		globalMiddlewares: make([]iface.MiddlewareFunc, 0),
+		timeouts:          make(map[uint32]time.Duration),
+	}
+}
+
+// match 根据msgID匹配路由：精确匹配 -> 范围、掩码匹配 -> Any -> NotFound
+func (t *routeTable) match(msgID uint32) (iface.IRouter, []iface.MiddlewareFunc, error) {
+
+	if entry, ok := t.inner[msgID]; ok {
+		return entry.router, t.routeMiddleware[msgID], nil
+	}
+
+	for _, entry := range t.patterns {
+		if entry.match(msgID) {
+			return entry.router, t.resolveMiddlewares(entry, msgID), nil
+		}
+	}
+
+	if t.any != nil {
+		return t.any.router, t.resolveMiddlewares(t.any, msgID), nil
+	}
+
+	if t.notFound != nil {
+		return t.notFound, t.rangeMiddlewares(nil, msgID), nil
+	}
+
+	return nil, t.rangeMiddlewares(nil, msgID), util.RouterNotFound
+}
+
+// isStream msgID匹配的是否为流式路由
+func (t *routeTable) isStream(msgID uint32) bool {
+	if !t.streaming {
+		return false
+	}
+
+	if entry, ok := t.inner[msgID]; ok {
+		_, ok = entry.router.(*streamRouter)
+		return ok
+	}
+
+	for _, entry := range t.patterns {
+		if entry.match(msgID) {
+			_, ok := entry.router.(*streamRouter)
+			return ok
+		}
+	}
+
+	if t.any != nil {
+		_, ok := t.any.router.(*streamRouter)
+		return ok
+	}
+	return false
+}
+
+// resolveMiddlewares 合并一个路由的中间件（不包含全局中间件）
+func (t *routeTable) resolveMiddlewares(entry *routeEntry, msgID uint32) []iface.MiddlewareFunc {
+
+	// 范围匹配的分组
+	middlewares := t.rangeMiddlewares(entry.group, msgID)
+
+	// 所属分组
+	if entry.group != nil {
+		middlewares = append(middlewares, entry.group.GetMiddlewares()...)
+	}
+
+	// 路由中间件
+	return append(middlewares, entry.middlewares...)
+}
+
+// rangeMiddlewares 范围匹配的分组中间件，路由本身所属的分组及其父分组无需重复添加
+func (t *routeTable) rangeMiddlewares(owner *MiddlewareGroup, msgID uint32) []iface.MiddlewareFunc {
+	middlewares := make([]iface.MiddlewareFunc, 0)
+	for _, group := range t.rangeGroups {
+		if group.group.contains(owner) || !group.match(msgID) {
+			continue
+		}
+		middlewares = append(middlewares, group.middlewares...)
+	}
+	return middlewares
+}
+
+// routes 当前路由表中的所有路由
+func (t *routeTable) routes() []RouteInfo {
+	entries := t.entries
+	if t.any != nil {
+		entries = append(entries[:len(entries):len(entries)], t.any)
+	}
+
+	infos := make([]RouteInfo, 0, len(entries))
+	for _, entry := range entries {
+		info := RouteInfo{
+			Route:   entry.String(),
+			Router:  fmt.Sprintf("%T", entry.router),
+			Grouped: entry.group != nil,
+		}
+		if entry.kind == exactRoute {
+			info.Middlewares = len(t.routeMiddleware[entry.msgID])
+			info.Timeout = t.timeouts[entry.msgID]
+		} else {
+			info.Middlewares = len(t.resolveMiddlewares(entry, entry.msgID))
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
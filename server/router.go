@@ -14,6 +14,10 @@ type routerProtocol struct {
 	readBuffer       *bytes.Buffer // 未读取完整的一个数据包
 	packDataLength   uint32        // 数据包体长度，如果这个值 == 0，那就是从头开始读取，没有未读取完整的数据
 	temporaryMessage iface.IMessage
+	streamBuffer     []byte           // IStreamDecoder未解码的数据
+	pending          []iface.IMessage // IStreamDecoder已解码未处理的消息
+	body             *util.BodyStream // 流式路由正在接收的包体
+	bodyRemain       uint32           // 流式路由未接收的包体长度
 }
 
 //newRouterProtocol .
@@ -28,39 +32,77 @@ func newRouterProtocol(baseConnect *BaseConnect) iface.IConnect {
 	return connect
 }
 
-//Close 关闭连接
+//Close 关闭连接，重置未解码完的数据后由BaseConnect关闭
 func (c *routerProtocol) Close() error {
 
-	// 移除事件监听
-	_ = c.GetPoller().Remove(c.fd)
-
-	// 从管理类中移除
-	c.GetConnectMgr().Remove(c)
-
-	// 关闭连接
-	err := unix.Close(c.fd)
-
 	// 重置为0
 	c.packDataLength = 0
 
 	// 重置
 	c.readBuffer = nil
+	c.streamBuffer = nil
+	c.pending = nil
 
-	// 关闭成功才执行
-	if c.hooks != nil && err == nil {
-		c.hooks.OnClose(c)
+	// 流式路由的包体不完整
+	if c.body != nil {
+		c.body.Finish(io.ErrUnexpectedEOF)
+		c.body = nil
 	}
 
-	return err
+	return c.BaseConnect.Close()
 }
 
-//DecodePacket 解码出一个数据包
+//DecodePacket 解码出一个数据包，包体读取完整后交给IBodyUnpacker处理（解压、校验等）
 func (c *routerProtocol) DecodePacket() (iface.IMessage, error) {
+	message, err := c.decodePacket()
+	if err != nil || message == nil {
+		return message, err
+	}
+
+	// 超出接收速率限制的消息在解压、校验之前丢弃
+	if message.Len() > 0 {
+		if err := c.BaseConnect.Allow(); err != nil {
+			return nil, dropMessage(message, err)
+		}
+	}
+
+	// 流式路由的包体还未接收
+	if _, ok := message.(*util.StreamMessage); ok {
+		return message, nil
+	}
+
+	if err := unpackBody(c.packer, message); err != nil {
+		// 校验失败等情况下丢弃这个消息，不断开连接
+		if err == util.MessageDropped {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+//decodePacket 解码出一个数据包
+func (c *routerProtocol) decodePacket() (iface.IMessage, error) {
+
+	// 先处理上次解码出来的消息（IStreamDecoder）
+	if len(c.pending) > 0 {
+		return c.popPending(), nil
+	}
 
 	if c.IsUDP() {
 		return c.receiveFromUDP()
 	}
 
+	// 流式路由的包体
+	if c.body != nil {
+		return c.decodeBody()
+	}
+
+	// 变长包头的协议，基于缓冲区解码
+	if decoder, ok := c.packer.(iface.IStreamDecoder); ok {
+		return c.decodeStream(decoder)
+	}
+
 	if c.packDataLength <= 0 {
 
 		// 读取包头
@@ -97,6 +139,11 @@ func (c *routerProtocol) DecodePacket() (iface.IMessage, error) {
 			return message, nil
 		}
 
+		// 流式路由，包头读取完后立即交给路由，包体边接收边交给路由
+		if c.options.isStreamRoute != nil && c.options.isStreamRoute(message.ID()) {
+			return c.beginBody(message), nil
+		}
+
 		// 设置长度数据
 		c.packDataLength = uint32(message.Len())
 		c.temporaryMessage = message
@@ -160,29 +207,16 @@ func (c *routerProtocol) DecodePacket() (iface.IMessage, error) {
 
 		// 已完成了TLS握手
 		if c.GetHandshakeCompleted() && c.tlsRawSize >= int(remain) {
-			return c.DecodePacket()
+			return c.decodePacket()
 		}
 	}
 
 	return nil, nil
 }
 
-//Send 写数据
+//Send 写数据，先执行发送拦截器
 func (c *routerProtocol) Send(msgID uint32, bytes []byte) (int, error) {
-
-	// 1、封包
-	dataPack, err := c.packer.Pack(msgID, bytes)
-	if err != nil {
-		return 0, err
-	}
-
-	// 2、发送
-	if c.GetTLSEnable() {
-		c.tlsWritePacketSize = len(dataPack)
-		return c.tlsLayer.Write(dataPack)
-	}
-
-	return c.Write(dataPack)
+	return c.options.outbound.send(c.self, newOutboundMessage(msgID, bytes, 0), c.writeMessage)
 }
 
 //receiveFromUDP 从udp数据包中解析出数据
@@ -198,6 +232,12 @@ func (c *routerProtocol) receiveFromUDP() (iface.IMessage, error) {
 	}
 
 	netAddr := util.SockaddrToUDPAddr(sockaddr)
+
+	// 一个数据报中可能有多个消息
+	if decoder, ok := c.packer.(iface.IStreamDecoder); ok {
+		return c.decodeDatagram(decoder, buffer[:n])
+	}
+
 	if n < headLen {
 		return nil, fmt.Errorf("udp message not packet %v", netAddr.String())
 	}
@@ -217,3 +257,27 @@ func (c *routerProtocol) receiveFromUDP() (iface.IMessage, error) {
 	message.SetData(buffer[headLen : headLen+message.Len()])
 	return message, nil
 }
+
+//Allow 速率限制在DecodePacket中检查
+func (c *routerProtocol) Allow() error {
+	return nil
+}
+
+//dropMessage 丢弃超出接收速率限制的消息，流式路由需要丢弃未接收的包体，需要关闭连接时返回io.EOF
+func dropMessage(message iface.IMessage, err error) error {
+	if closer, ok := message.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	if err == io.EOF {
+		return io.EOF
+	}
+	return nil
+}
+
+//unpackBody packer实现了IBodyUnpacker时，处理读取完整的包体
+func unpackBody(packer iface.IPacker, message iface.IMessage) error {
+	if unpacker, ok := packer.(iface.IBodyUnpacker); ok {
+		return unpacker.UnPackBody(message)
+	}
+	return nil
+}
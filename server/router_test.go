@@ -0,0 +1,176 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+//routerTestPoller 只实现连接使用的方法，记录暂停、恢复读事件的次数
+type routerTestPoller struct {
+	iface.IPoller
+	mgr     *ConnectManager
+	locker  sync.Mutex
+	paused  int
+	resumed int
+}
+
+func (p *routerTestPoller) Remove(int) error                     { return nil }
+func (p *routerTestPoller) GetConnectMgr() iface.IConnectManager { return p.mgr }
+func (p *routerTestPoller) PauseRead(int, int) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.paused++
+	return nil
+}
+func (p *routerTestPoller) ResumeRead(int, int) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.resumed++
+	return nil
+}
+
+//counts 暂停、恢复读事件的次数
+func (p *routerTestPoller) counts() (int, int) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	return p.paused, p.resumed
+}
+
+//newRouterTestConnect 使用socketpair的路由模式连接，已添加到connectMgr，返回连接和对端的fd
+func newRouterTestConnect(t *testing.T, opts ...Option) (*routerProtocol, *routerTestPoller, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair：%v", err)
+	}
+	t.Cleanup(func() {
+		_ = unix.Close(fds[0])
+		_ = unix.Close(fds[1])
+	})
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		t.Fatalf("set nonblock：%v", err)
+	}
+
+	options := parseOption(opts...)
+	poller := &routerTestPoller{mgr: &ConnectManager{
+		connects:   map[int]iface.IConnect{},
+		authTimers: map[int]*time.Timer{},
+		options:    options,
+	}}
+	base := newBaseConnect(1, fds[0], &net.TCPAddr{}, options)
+	base.SetPoller(poller)
+	connect := newProtocol(base, common.RouterMode, nil).(*routerProtocol)
+	poller.mgr.Add(connect)
+	return connect, poller, fds[1]
+}
+
+//routerTestHooks 记录onclose事件的连接
+type routerTestHooks struct {
+	closed []iface.IConnect
+}
+
+func (h *routerTestHooks) OnOpen(iface.IConnect)          {}
+func (h *routerTestHooks) OnClose(connect iface.IConnect) { h.closed = append(h.closed, connect) }
+
+func TestRouterProtocolClose(t *testing.T) {
+	hooks := &routerTestHooks{}
+	c, poller, _ := newRouterTestConnect(t, WithHooks(hooks))
+	fd := c.fd
+
+	// 未解码完的数据、流式路由未接收完的包体
+	body := util.NewBodyStream(10, 0, nil, nil)
+	c.body = body
+	c.streamBuffer = []byte{1, 2}
+	c.pending = []iface.IMessage{&util.Message{}}
+	c.packDataLength = 5
+	c.sniffData = []byte{3}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("close：%v", err)
+	}
+	if poller.mgr.Get(fd) != nil {
+		t.Fatal("connect is not removed from connectMgr")
+	}
+	if len(hooks.closed) != 1 || hooks.closed[0] != c {
+		t.Fatalf("onclose connects = %v", hooks.closed)
+	}
+	if c.body != nil || c.streamBuffer != nil || c.pending != nil || c.packDataLength != 0 || c.sniffData != nil {
+		t.Fatal("decode state is not reset")
+	}
+	if c.Context().Err() == nil {
+		t.Fatal("context is not canceled")
+	}
+	if _, err := ioutil.ReadAll(body); err != io.ErrUnexpectedEOF {
+		t.Fatalf("body err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestRouterProtocolDecodeStream(t *testing.T) {
+	packer := util.NewVarintPacker()
+	stream := make([]byte, 0)
+	want := []string{"a", "", "hello", string(make([]byte, 300))}
+	for i, data := range want {
+		dataPack, err := packer.Pack(uint32(i+1), []byte(data))
+		if err != nil {
+			t.Fatalf("pack：%v", err)
+		}
+		stream = append(stream, dataPack...)
+	}
+
+	// 每次收到size个字节，不完整的数据保存在streamBuffer中，一次读取可能解码出多个消息
+	for _, size := range []int{1, 2, 3, 7, len(stream)} {
+		c, _, peer := newRouterTestConnect(t, WithPacker(util.NewVarintPacker()))
+		messages := make([]iface.IMessage, 0)
+		for offset := 0; offset < len(stream); offset += size {
+			end := offset + size
+			if end > len(stream) {
+				end = len(stream)
+			}
+			if _, err := unix.Write(peer, stream[offset:end]); err != nil {
+				t.Fatalf("write：%v", err)
+			}
+
+			for {
+				message, err := c.DecodePacket()
+				if err != nil {
+					t.Fatalf("size %d：decode：%v", size, err)
+				}
+				if message == nil {
+					break
+				}
+				messages = append(messages, message)
+				if !c.HasPending() {
+					break
+				}
+			}
+		}
+
+		if len(messages) != len(want) {
+			t.Fatalf("size %d：decoded %d messages, want %d", size, len(messages), len(want))
+		}
+		for i, message := range messages {
+			if message.ID() != uint32(i+1) || string(message.Bytes()) != want[i] {
+				t.Fatalf("size %d：message %d = %d %q", size, i, message.ID(), message.Bytes())
+			}
+		}
+		if len(c.streamBuffer) != 0 {
+			t.Fatalf("size %d：%d bytes left in streamBuffer", size, len(c.streamBuffer))
+		}
+	}
+
+	// 连接断开
+	c, _, peer := newRouterTestConnect(t, WithPacker(util.NewVarintPacker()))
+	_ = unix.Shutdown(peer, unix.SHUT_WR)
+	if _, err := c.DecodePacket(); err != io.EOF {
+		t.Fatalf("decode after shutdown err = %v, want EOF", err)
+	}
+}
@@ -1,33 +1,261 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/ikilobyte/netman/common"
 	"github.com/ikilobyte/netman/iface"
 	"github.com/ikilobyte/netman/util"
+	"github.com/sirupsen/logrus"
 )
 
 type RouterMgr struct {
-	inner             map[uint32]iface.IRouter          // 所有的路由
-	routeMiddleware   map[uint32][]iface.MiddlewareFunc // 路由中间件
-	globalMiddlewares []iface.MiddlewareFunc            // 全局中间件
-	middlewareGroup   []iface.IMiddlewareGroup
+	table             atomic.Value             // *routeTable 当前生效的路由表，每次修改都会生成新的路由表替换
+	locker            sync.Mutex               // 修改路由定义时加锁
+	globalMiddlewares []iface.MiddlewareFunc   // 全局中间件
+	middlewareGroup   []*MiddlewareGroup       // 所有的分组，包含子分组
+	routes            []*routeEntry            // 不属于任何分组的路由
+	notFound          iface.IRouter            // 找不到路由时执行
+	any               *routeEntry              // 匹配所有消息的路由，在其它路由之后匹配
+	timeouts          map[uint32]time.Duration // 路由执行超时时间
+	resolved          bool                     // 是否已经执行过ResolveGroup，之后的修改会立即生效
 }
 
-// NewRouterMgr 中间件执行顺序 globalMiddleware -> routerMiddleware
+// NewRouterMgr 中间件执行顺序 globalMiddleware -> rangeGroupMiddleware -> groupMiddleware -> routerMiddleware
 func NewRouterMgr() *RouterMgr {
-	return &RouterMgr{
-		inner:             make(map[uint32]iface.IRouter),
-		routeMiddleware:   make(map[uint32][]iface.MiddlewareFunc),
+	r := &RouterMgr{
 		globalMiddlewares: make([]iface.MiddlewareFunc, 0),
-		middlewareGroup:   make([]iface.IMiddlewareGroup, 0),
+		middlewareGroup:   make([]*MiddlewareGroup, 0),
+		routes:            make([]*routeEntry, 0),
+		timeouts:          make(map[uint32]time.Duration),
 	}
+	r.table.Store(newRouteTable())
+	return r
 }
 
-// Add 添加路由
-func (r *RouterMgr) Add(msgID uint32, router iface.IRouter) {
-	r.inner[msgID] = router
+// Add 添加路由，middlewares只对这个路由生效，启动后添加失败时只记录日志，需要判断结果时使用TryAdd
+func (r *RouterMgr) Add(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	logAddError(r.TryAdd(msgID, router, middlewares...))
+}
+
+// TryAdd 添加路由，启动后与已有的路由冲突时返回util.RouterConflict，可以在运行中调用
+func (r *RouterMgr) TryAdd(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return r.addEntry(&routeEntry{
+		kind:        exactRoute,
+		msgID:       msgID,
+		router:      router,
+		middlewares: middlewares,
+	})
+}
+
+// AddRange 添加范围路由，msgID在[from, to]范围内且没有精确匹配的路由时执行
+func (r *RouterMgr) AddRange(from, to uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	logAddError(r.TryAddRange(from, to, router, middlewares...))
+}
+
+// TryAddRange 添加范围路由，启动后与已有的路由冲突（包括与范围、掩码路由重叠）时返回util.RouterConflict
+func (r *RouterMgr) TryAddRange(from, to uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return r.addEntry(&routeEntry{
+		kind:        rangeRoute,
+		from:        from,
+		to:          to,
+		router:      router,
+		middlewares: middlewares,
+	})
+}
+
+// AddMask 添加掩码路由，msgID & mask == value 且没有精确匹配的路由时执行
+func (r *RouterMgr) AddMask(mask, value uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	logAddError(r.TryAddMask(mask, value, router, middlewares...))
+}
+
+// TryAddMask 添加掩码路由，启动后与已有的路由冲突（包括与范围、掩码路由重叠）时返回util.RouterConflict
+func (r *RouterMgr) TryAddMask(mask, value uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return r.addEntry(&routeEntry{
+		kind:        maskRoute,
+		msgID:       value & mask,
+		mask:        mask,
+		router:      router,
+		middlewares: middlewares,
+	})
+}
+
+// addEntry 保存路由定义，启动后添加重复的路由会失败
+func (r *RouterMgr) addEntry(entry *routeEntry) error {
+	return r.update(func() func() {
+		r.routes = append(r.routes, entry)
+		return func() {
+			r.routes = r.routes[:len(r.routes)-1]
+		}
+	})
+}
+
+// logAddError 不返回错误的添加方法，失败时记录日志
+func logAddError(err error) {
+	if err != nil {
+		util.Logger.Errorf("add router error：%v", err)
+	}
+}
+
+// Replace 替换路由，保留原来所属的分组，不存在时添加
+func (r *RouterMgr) Replace(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	entry := &routeEntry{
+		kind:        exactRoute,
+		msgID:       msgID,
+		router:      router,
+		middlewares: middlewares,
+	}
+
+	return r.update(func() func() {
+		routes := &r.routes
+		index := indexOfEntry(r.routes, entry.String())
+		for _, group := range r.middlewareGroup {
+			if index >= 0 {
+				break
+			}
+			if index = indexOfEntry(group.routes, entry.String()); index >= 0 {
+				routes = &group.routes
+				entry.group = group
+			}
+		}
+
+		// 不存在时添加
+		if index < 0 {
+			*routes = append(*routes, entry)
+			return func() {
+				*routes = (*routes)[:len(*routes)-1]
+			}
+		}
+
+		// 替换为新的路由定义，正在使用旧路由表的goroutine不受影响
+		old := (*routes)[index]
+		replaced := make([]*routeEntry, len(*routes))
+		copy(replaced, *routes)
+		replaced[index] = entry
+		*routes = replaced
+		return func() {
+			replaced[index] = old
+		}
+	})
+}
+
+// Remove 删除路由，key为RouteInfo.Route，如：1、range[1-10]、mask[0xffff0000=0x10000]、any
+func (r *RouterMgr) Remove(key string) error {
+	return r.update(func() func() {
+		removed := false
+		routes := r.routes
+		r.routes = removeEntry(r.routes, key, &removed)
+
+		anyEntry := r.any
+		if r.any != nil && r.any.String() == key {
+			r.any = nil
+			removed = true
+		}
+
+		groupRoutes := make([][]*routeEntry, len(r.middlewareGroup))
+		for i, group := range r.middlewareGroup {
+			groupRoutes[i] = group.routes
+			group.routes = removeEntry(group.routes, key, &removed)
+		}
+
+		if !removed {
+			return nil
+		}
+
+		return func() {
+			r.routes = routes
+			r.any = anyEntry
+			for i, group := range r.middlewareGroup {
+				group.routes = groupRoutes[i]
+			}
+		}
+	})
+}
+
+// RemoveGroup 删除分组，包括子分组和分组中的路由
+func (r *RouterMgr) RemoveGroup(group iface.IMiddlewareGroup) error {
+	target, ok := group.(*MiddlewareGroup)
+	if !ok {
+		return util.RouterNotFound
+	}
+
+	return r.update(func() func() {
+		groups := r.middlewareGroup
+		remain := make([]*MiddlewareGroup, 0, len(groups))
+		for _, g := range groups {
+			if !target.contains(g) {
+				remain = append(remain, g)
+			}
+		}
+
+		if len(remain) == len(groups) {
+			return nil
+		}
+
+		r.middlewareGroup = remain
+		return func() {
+			r.middlewareGroup = groups
+		}
+	})
+}
+
+// Use 添加全局中间件
+func (r *RouterMgr) Use(callable iface.MiddlewareFunc) {
+	_ = r.update(func() func() {
+		r.globalMiddlewares = append(r.globalMiddlewares, callable)
+		return func() {
+			r.globalMiddlewares = r.globalMiddlewares[:len(r.globalMiddlewares)-1]
+		}
+	})
+}
+
+// SetNotFound 找不到路由时执行
+func (r *RouterMgr) SetNotFound(router iface.IRouter) {
+	_ = r.update(func() func() {
+		old := r.notFound
+		r.notFound = router
+		return func() {
+			r.notFound = old
+		}
+	})
+}
+
+// SetAny 匹配所有消息的路由，精确匹配、范围、掩码路由都不匹配时执行，在NotFound之前，重复设置时替换
+func (r *RouterMgr) SetAny(router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	entry := &routeEntry{
+		kind:        anyRoute,
+		router:      router,
+		middlewares: middlewares,
+	}
+
+	_ = r.update(func() func() {
+		old := r.any
+		r.any = entry
+		return func() {
+			r.any = old
+		}
+	})
+}
+
+// SetTimeout 设置单个路由的执行超时时间，优先级高于全局配置的HandlerTimeout
+func (r *RouterMgr) SetTimeout(msgID uint32, timeout time.Duration) {
+	_ = r.update(func() func() {
+		old, ok := r.timeouts[msgID]
+		r.timeouts[msgID] = timeout
+		return func() {
+			if ok {
+				r.timeouts[msgID] = old
+			} else {
+				delete(r.timeouts, msgID)
+			}
+		}
+	})
 }
 
 // NewGroup 中间一个中间件组
@@ -35,38 +263,160 @@ func (r *RouterMgr) NewGroup(callable iface.MiddlewareFunc, more ...iface.Middle
 	ms := []iface.MiddlewareFunc{
 		callable,
 	}
-	group := newMiddlewareGroup(append(ms, more...)...)
-	r.middlewareGroup = append(r.middlewareGroup, group)
+	return r.addGroup(newMiddlewareGroup(r, nil, append(ms, more...)...))
+}
+
+// addGroup 保存分组，子分组也保存在这里
+func (r *RouterMgr) addGroup(group *MiddlewareGroup) *MiddlewareGroup {
+	_ = r.update(func() func() {
+		r.middlewareGroup = append(r.middlewareGroup, group)
+		return func() {
+			r.middlewareGroup = r.middlewareGroup[:len(r.middlewareGroup)-1]
+		}
+	})
 	return group
 }
 
-// ResolveGroup 处理路由分组的数据
+// ResolveGroup 处理路由分组的数据，同一个msgID重复添加、范围和掩码路由之间重叠时返回错误，之后的修改会立即生效
 func (r *RouterMgr) ResolveGroup() error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if err := r.rebuild(); err != nil {
+		return err
+	}
+	r.resolved = true
+	return nil
+}
+
+// update 修改路由定义，已启动时会重新生成路由表，生成失败时撤销本次修改
+// apply 返回撤销的方法，返回nil表示没有修改
+func (r *RouterMgr) update(apply func() func()) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	undo := apply()
+	if !r.resolved {
+		return nil
+	}
+
+	if undo == nil {
+		return util.RouterNotFound
+	}
+
+	if err := r.rebuild(); err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// rebuild 根据路由定义生成新的路由表，调用方需要加锁
+func (r *RouterMgr) rebuild() error {
+
+	table := newRouteTable()
+	table.entries = append(table.entries, r.routes...)
 	for _, group := range r.middlewareGroup {
-		for routerID, router := range group.GetRouters() {
-			r.routeMiddleware[routerID] = group.GetMiddlewares()
-			r.Add(routerID, router)
+		table.entries = append(table.entries, group.routes...)
+		if len(group.ranges) > 0 {
+			table.rangeGroups = append(table.rangeGroups, &rangeGroup{
+				group:       group,
+				ranges:      append([][2]uint32{}, group.ranges...),
+				middlewares: group.GetMiddlewares(),
+			})
+		}
+	}
+	table.globalMiddlewares = append(table.globalMiddlewares, r.globalMiddlewares...)
+	table.notFound = r.notFound
+	table.any = r.any
+	if r.any != nil {
+		if _, ok := r.any.router.(*streamRouter); ok {
+			table.streaming = true
 		}
 	}
+	for msgID, timeout := range r.timeouts {
+		table.timeouts[msgID] = timeout
+	}
+
+	exists := make(map[string]bool)
+	conflicts := make([]string, 0)
+
+	for _, entry := range table.entries {
+		if exists[entry.String()] {
+			conflicts = append(conflicts, entry.String())
+			continue
+		}
+		exists[entry.String()] = true
+
+		if _, ok := entry.router.(*streamRouter); ok {
+			table.streaming = true
+		}
+
+		// 范围、掩码路由之间不能重叠，精确匹配的路由优先，可以与它们重叠
+		if entry.kind != exactRoute {
+			for _, pattern := range table.patterns {
+				if pattern.overlaps(entry) {
+					conflicts = append(conflicts, fmt.Sprintf("%s overlaps %s", entry, pattern))
+				}
+			}
+			table.patterns = append(table.patterns, entry)
+			continue
+		}
+		table.inner[entry.msgID] = entry
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: msgID %s", util.RouterConflict, strings.Join(conflicts, ","))
+	}
+
+	// 范围分组需要全部处理后才能合并中间件
+	for msgID, entry := range table.inner {
+		table.routeMiddleware[msgID] = table.resolveMiddlewares(entry, msgID)
+	}
+
+	r.table.Store(table)
 	return nil
 }
 
+// getTable 当前生效的路由表
+func (r *RouterMgr) getTable() *routeTable {
+	return r.table.Load().(*routeTable)
+}
+
+// Routes 当前生效的路由表中的所有路由
+func (r *RouterMgr) Routes() []RouteInfo {
+	return r.getTable().routes()
+}
+
+// isStreamRoute 是否为流式路由，连接读取完包头后判断
+func (r *RouterMgr) isStreamRoute(msgID uint32) bool {
+	return r.getTable().isStream(msgID)
+}
+
 // Get 根据msgID获取路由
 func (r *RouterMgr) Get(msgID uint32) (iface.IRouter, error) {
-
-	router, ok := r.inner[msgID]
-	if ok {
-		return router, nil
-	}
-	return nil, util.RouterNotFound
+	router, _, err := r.getTable().match(msgID)
+	return router, err
 }
 
-func (r *RouterMgr) Do(ctx iface.IContext) error {
+// Do 执行路由，有返回值的路由返回*util.Reply
+func (r *RouterMgr) Do(ctx iface.IContext) (interface{}, error) {
 	// 根据msgID获取router
 	request := ctx.GetRequest()
 	router, err := r.Get(request.GetMessage().ID())
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return r.do(request, router), nil
+}
+
+// do 执行路由
+func (r *RouterMgr) do(request iface.IRequest, router iface.IRouter) interface{} {
+
+	// 有返回值的路由，返回值交给中间件
+	if rr, ok := router.(replier); ok {
+		return rr.reply(request)
 	}
 
 	// 执行方法
@@ -74,41 +424,164 @@ func (r *RouterMgr) Do(ctx iface.IContext) error {
 	return nil
 }
 
+// routerNotFound 没有配置NotFound路由时，交给ErrorHandler或者回复标准错误包，都未配置时只记录日志
+func (r *RouterMgr) routerNotFound(request iface.IRequest, options *Options) {
+	if options.ErrorHandler != nil || options.ErrorReply {
+		options.handleError(request, util.RouterNotFound)
+		return
+	}
+	util.Logger.Infoln(fmt.Errorf("do handler err %s msgID %d", util.RouterNotFound, request.GetMessage().ID()))
+}
+
 // Dispatch 路由分发和中间件执行
 func (r *RouterMgr) Dispatch(ctx iface.IContext, options *Options) {
 
+	// 中间件和路由出现panic时不能影响到整个进程
+	defer r.recover(ctx, options)
+
+	// 流式路由的消息处理完后丢弃未读取的数据，否则连接会一直暂停读取
+	if closer, ok := ctx.GetMessage().(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	request := ctx.GetRequest()
 
+	// 开启认证后，未认证的连接只能访问认证路由
+	if !options.authorized(request) {
+		options.handleError(request, util.AuthRequired)
+		return
+	}
+
+	// websocket信封解析失败的消息没有路由，交给ErrorHandler处理，可以回复错误给客户端
+	if message, ok := request.GetMessage().(*envelopeFailMessage); ok {
+		options.handleError(request, message.err)
+		return
+	}
+
+	// 整个分发过程使用同一个路由表，执行过程中修改路由不会影响到这条消息
+	table := r.getTable()
+
+	// 路由执行超时检测，只记录，不会中断执行，上下文会在超时后取消
+	if timeout := r.getTimeout(table, request.GetMessage().ID(), options); timeout > 0 {
+		begin := time.Now()
+		if c, ok := ctx.(deadliner); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = c.WithDeadline(begin.Add(timeout))
+			request = ctx.GetRequest()
+			defer cancel()
+		}
+		timer := time.AfterFunc(timeout, func() {
+			r.timeout(ctx, options, timeout)
+		})
+		defer func() {
+			if !timer.Stop() {
+				r.logger(ctx).Warnf("slow handler finished, elapsed %v", time.Since(begin))
+			}
+		}()
+	}
+
+	// 匹配路由
+	router, routeMiddlewares, err := table.match(request.GetMessage().ID())
+
 	// 合并中间件
 	middlewares := make([]iface.MiddlewareFunc, 0)
 
 	// 全局中间件
-	middlewares = append(middlewares, r.globalMiddlewares...)
+	middlewares = append(middlewares, table.globalMiddlewares...)
 
 	// 路由中间件
-	middlewares = append(middlewares, r.routeMiddleware[request.GetMessage().ID()]...)
+	middlewares = append(middlewares, routeMiddlewares...)
 
 	// 先执行中间件
-	util.NewPipeline().
+	result := util.NewPipeline().
 		Send(ctx).
 		Through(r.Conversion(middlewares)).
 		Then(func(value interface{}) interface{} {
 
-			var err error
-
-			// 当前Server是websocket协议
-			if options.Application == common.WebsocketMode {
+			// 当前连接是websocket协议（开启协议探测时不一定与Server相同），未配置信封或者找不到路由时交给WebsocketHandler处理
+			if isWebsocket(ctx.GetConnect()) && options.WebsocketHandler != nil && (options.WebsocketEnvelope == nil || err != nil) {
 				options.WebsocketHandler.Message(ctx.GetRequest())
-				return err
+				return nil
 			}
 
-			// TCP or UDP
-			if err = r.Do(ctx); err != nil {
-				util.Logger.Infoln(fmt.Errorf("do handler err %s", err))
+			// 找不到路由
+			if err != nil {
+				r.routerNotFound(request, options)
+				return err
 			}
 
-			return err
+			return r.do(request, router)
 		})
+
+	// 路由或中间件的返回值，由框架回复给客户端
+	if reply, ok := result.(*util.Reply); ok {
+		sendReply(request, reply, options)
+	}
+}
+
+// isWebsocket 连接是否为websocket协议，包括自定义协议中实现了iface.IWebsocketConnect的连接
+func isWebsocket(connect iface.IConnect) bool {
+	websocket, ok := connect.(iface.IWebsocketConnect)
+	return ok && websocket.IsWebsocket()
+}
+
+// deadliner 可以设置截止时间的上下文
+type deadliner interface {
+	WithDeadline(deadline time.Time) (iface.IContext, context.CancelFunc)
+}
+
+// getTimeout 获取路由的超时时间
+func (r *RouterMgr) getTimeout(table *routeTable, msgID uint32, options *Options) time.Duration {
+	if timeout, ok := table.timeouts[msgID]; ok {
+		return timeout
+	}
+	return options.HandlerTimeout
+}
+
+// timeout 路由执行超时
+func (r *RouterMgr) timeout(ctx iface.IContext, options *Options, timeout time.Duration) {
+	r.logger(ctx).Warnf("handler timeout, exceed %v", timeout)
+	if options.TimeoutHandler != nil {
+		options.TimeoutHandler(ctx, timeout)
+	}
+}
+
+// recover 捕获panic，记录连接信息和堆栈后交给PanicHandler处理
+func (r *RouterMgr) recover(ctx iface.IContext, options *Options) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	r.logger(ctx).
+		WithField("stack", string(debug.Stack())).
+		Errorf("dispatch panic: %v", recovered)
+
+	if options.PanicHandler == nil {
+		return
+	}
+
+	// PanicHandler自身出现panic时，只记录日志
+	defer func() {
+		if err := recover(); err != nil {
+			r.logger(ctx).Errorf("panic handler panic: %v", err)
+		}
+	}()
+	options.PanicHandler(ctx, recovered)
+}
+
+// logger 带上连接上下文的日志
+func (r *RouterMgr) logger(ctx iface.IContext) *logrus.Entry {
+	connect := ctx.GetConnect()
+	entry := util.Logger.
+		WithField("connID", connect.GetID()).
+		WithField("fd", connect.GetFd()).
+		WithField("msgID", ctx.GetMessage().ID())
+
+	if address := connect.GetAddress(); address != nil {
+		entry = entry.WithField("address", address.String())
+	}
+	return entry
 }
 
 // Conversion 将中间件转换为stage类型
@@ -129,3 +602,26 @@ func (s *stage) Process(value interface{}, next iface.NextFunc) interface{} {
 		return next(ctx)
 	})
 }
+
+// indexOfEntry 根据key查找路由定义的位置
+func indexOfEntry(routes []*routeEntry, key string) int {
+	for i, entry := range routes {
+		if entry.String() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeEntry 删除key对应的路由定义，返回新的slice，不修改原来的slice
+func removeEntry(routes []*routeEntry, key string, removed *bool) []*routeEntry {
+	remain := make([]*routeEntry, 0, len(routes))
+	for _, entry := range routes {
+		if entry.String() == key {
+			*removed = true
+			continue
+		}
+		remain = append(remain, entry)
+	}
+	return remain
+}
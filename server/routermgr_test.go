@@ -0,0 +1,472 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+)
+
+//routeTestRouter 只用于匹配的路由，名称用于判断匹配的是哪个路由
+type routeTestRouter string
+
+func (r routeTestRouter) Do(iface.IRequest) {}
+
+//routeTestName 匹配到的路由名称，找不到时为空
+func routeTestName(t *testing.T, r *RouterMgr, msgID uint32) string {
+	t.Helper()
+	router, err := r.Get(msgID)
+	if err != nil {
+		return ""
+	}
+	return string(router.(routeTestRouter))
+}
+
+func TestRouterMgrAny(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(r *RouterMgr)
+		msgID  uint32
+		want   string
+		routes int
+	}{
+		{"any only", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+		}, 1, "any", 1},
+		{"range added after any", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+			r.AddRange(100, 199, routeTestRouter("range"))
+		}, 150, "range", 2},
+		{"outside range", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+			r.AddRange(100, 199, routeTestRouter("range"))
+		}, 200, "any", 2},
+		{"mask added after any", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+			r.AddMask(0xffff0000, 0x00010000, routeTestRouter("mask"))
+		}, 0x00010005, "mask", 2},
+		{"exact added after any", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+			r.Add(1, routeTestRouter("exact"))
+		}, 1, "exact", 2},
+		{"group range added after any", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+			r.NewGroup(nil).AddRangeRouter(100, 199, routeTestRouter("group"))
+		}, 150, "group", 2},
+		{"replace any", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+			r.SetAny(routeTestRouter("other"))
+		}, 1, "other", 1},
+		{"any before not found", func(r *RouterMgr) {
+			r.SetNotFound(routeTestRouter("notFound"))
+			r.SetAny(routeTestRouter("any"))
+		}, 1, "any", 1},
+		{"remove any", func(r *RouterMgr) {
+			r.SetNotFound(routeTestRouter("notFound"))
+			r.SetAny(routeTestRouter("any"))
+			_ = r.Remove("any")
+		}, 1, "notFound", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouterMgr()
+			tt.setup(r)
+			if err := r.ResolveGroup(); err != nil {
+				t.Fatalf("resolve：%v", err)
+			}
+			if got := routeTestName(t, r, tt.msgID); got != tt.want {
+				t.Fatalf("msgID %d matched %q, want %q", tt.msgID, got, tt.want)
+			}
+			if routes := len(r.Routes()); routes != tt.routes {
+				t.Fatalf("routes = %d, want %d", routes, tt.routes)
+			}
+		})
+	}
+
+	// 启动后添加的范围路由优先于已有的Any
+	r := NewRouterMgr()
+	r.SetAny(routeTestRouter("any"))
+	if err := r.ResolveGroup(); err != nil {
+		t.Fatalf("resolve：%v", err)
+	}
+	if err := r.TryAddRange(100, 199, routeTestRouter("range")); err != nil {
+		t.Fatalf("add range：%v", err)
+	}
+	if got := routeTestName(t, r, 150); got != "range" {
+		t.Fatalf("matched %q after adding range at runtime", got)
+	}
+}
+
+func TestRouteEntryOverlaps(t *testing.T) {
+	rangeEntry := func(from, to uint32) *routeEntry {
+		return &routeEntry{kind: rangeRoute, from: from, to: to}
+	}
+	maskEntry := func(mask, value uint32) *routeEntry {
+		return &routeEntry{kind: maskRoute, mask: mask, msgID: value & mask}
+	}
+
+	tests := []struct {
+		name string
+		a, b *routeEntry
+		want bool
+	}{
+		{"range contains", rangeEntry(1, 100), rangeEntry(50, 60), true},
+		{"range edge", rangeEntry(1, 100), rangeEntry(100, 200), true},
+		{"range adjacent", rangeEntry(1, 100), rangeEntry(101, 200), false},
+		{"range single", rangeEntry(5, 5), rangeEntry(5, 5), true},
+		{"range max", rangeEntry(0xfffffff0, 0xffffffff), rangeEntry(0xffffffff, 0xffffffff), true},
+		{"mask same module", maskEntry(0xffff0000, 0x10000), maskEntry(0xff000000, 0), true},
+		{"mask other module", maskEntry(0xffff0000, 0x10000), maskEntry(0xffff0000, 0x20000), false},
+		{"mask disjoint bits", maskEntry(0xff00, 0x100), maskEntry(0x00ff, 0x01), true},
+		{"mask conflicting bit", maskEntry(0x1, 0x1), maskEntry(0x3, 0x2), false},
+		{"mask in range", rangeEntry(0x100, 0x1ff), maskEntry(0xff00, 0x100), true},
+		{"range in mask", maskEntry(0xff00, 0x100), rangeEntry(256, 300), true},
+		{"range before mask", rangeEntry(0, 0xff), maskEntry(0xff00, 0x100), false},
+		{"range after mask", rangeEntry(0x200, 0x2ff), maskEntry(0xff00, 0x100), false},
+		{"range between mask values", rangeEntry(3, 5), maskEntry(0x7, 0x6), false},
+		{"range hits mask value", rangeEntry(3, 6), maskEntry(0x7, 0x6), true},
+		{"range hits higher period", rangeEntry(9, 14), maskEntry(0x7, 0x6), true},
+		{"odd mask in range", rangeEntry(10, 11), maskEntry(0x1, 0x1), true},
+		{"even mask in single range", rangeEntry(11, 11), maskEntry(0x1, 0x0), false},
+		{"mask max value", rangeEntry(0xfffffff0, 0xffffffff), maskEntry(0x80000000, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.overlaps(tt.b); got != tt.want {
+				t.Fatalf("%s overlaps %s = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := tt.b.overlaps(tt.a); got != tt.want {
+				t.Fatalf("%s overlaps %s = %v, want %v", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextMaskMatch(t *testing.T) {
+	// 与逐个查找的结果比较，掩码只在低6位，高位可以进位，结果不超过from+64
+	for mask := uint32(0); mask < 64; mask++ {
+		for value := uint32(0); value < 64; value++ {
+			if value&^mask != 0 {
+				continue
+			}
+			for from := uint32(0); from < 64; from++ {
+				want := from
+				for want&mask != value {
+					want++
+				}
+				if got, ok := nextMaskMatch(from, mask, value); !ok || got != want {
+					t.Fatalf("nextMaskMatch(%d, %#x, %#x) = %d %v, want %d", from, mask, value, got, ok, want)
+				}
+			}
+		}
+	}
+
+	// 大于from的msgID都不匹配
+	if got, ok := nextMaskMatch(0xffffffff, 0x1, 0x0); ok {
+		t.Fatalf("nextMaskMatch overflow = %d", got)
+	}
+	if got, ok := nextMaskMatch(0x80000001, 0x80000000, 0x0); ok {
+		t.Fatalf("nextMaskMatch high bit = %d", got)
+	}
+}
+
+func TestRouterMgrConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(r *RouterMgr)
+		conflict bool
+	}{
+		{"duplicate exact", func(r *RouterMgr) {
+			r.Add(1, routeTestRouter("a"))
+			r.Add(1, routeTestRouter("b"))
+		}, true},
+		{"exact in range", func(r *RouterMgr) {
+			r.AddRange(1, 100, routeTestRouter("range"))
+			r.Add(50, routeTestRouter("exact"))
+		}, false},
+		{"overlapping ranges", func(r *RouterMgr) {
+			r.AddRange(1, 100, routeTestRouter("a"))
+			r.AddRange(50, 60, routeTestRouter("b"))
+		}, true},
+		{"adjacent ranges", func(r *RouterMgr) {
+			r.AddRange(1, 100, routeTestRouter("a"))
+			r.AddRange(101, 200, routeTestRouter("b"))
+		}, false},
+		{"mask overlaps range", func(r *RouterMgr) {
+			r.AddRange(0x10000, 0x100ff, routeTestRouter("range"))
+			r.AddMask(0xffff0000, 0x10000, routeTestRouter("mask"))
+		}, true},
+		{"overlapping masks", func(r *RouterMgr) {
+			r.AddMask(0xffff0000, 0x10000, routeTestRouter("a"))
+			r.AddMask(0x0000ffff, 0x1, routeTestRouter("b"))
+		}, true},
+		{"group range overlaps top level range", func(r *RouterMgr) {
+			r.AddRange(1, 100, routeTestRouter("a"))
+			r.NewGroup(nil).AddRangeRouter(100, 200, routeTestRouter("b"))
+		}, true},
+		{"any with ranges", func(r *RouterMgr) {
+			r.SetAny(routeTestRouter("any"))
+			r.AddRange(1, 100, routeTestRouter("a"))
+			r.AddMask(0xffff0000, 0x10000, routeTestRouter("b"))
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouterMgr()
+			tt.setup(r)
+			if err := r.ResolveGroup(); errors.Is(err, util.RouterConflict) != tt.conflict {
+				t.Fatalf("err = %v, want conflict %v", err, tt.conflict)
+			}
+		})
+	}
+}
+
+func TestRouterMgrConflictAtRuntime(t *testing.T) {
+	r := NewRouterMgr()
+	r.AddRange(1, 100, routeTestRouter("range"))
+	r.Add(50, routeTestRouter("exact"))
+	if err := r.ResolveGroup(); err != nil {
+		t.Fatalf("resolve：%v", err)
+	}
+
+	// 重叠的路由添加失败，路由表不变
+	if err := r.TryAddRange(50, 60, routeTestRouter("overlap")); !errors.Is(err, util.RouterConflict) {
+		t.Fatalf("overlapping range err = %v", err)
+	}
+	if err := r.TryAddMask(0xff, 0x10, routeTestRouter("overlap")); !errors.Is(err, util.RouterConflict) {
+		t.Fatalf("overlapping mask err = %v", err)
+	}
+	if err := r.TryAddRange(101, 200, routeTestRouter("next")); err != nil {
+		t.Fatalf("adjacent range err = %v", err)
+	}
+
+	// 精确匹配优先于范围路由
+	for msgID, want := range map[uint32]string{1: "range", 50: "exact", 55: "range", 150: "next", 201: ""} {
+		if got := routeTestName(t, r, msgID); got != want {
+			t.Fatalf("msgID %d matched %q, want %q", msgID, got, want)
+		}
+	}
+	if routes := len(r.Routes()); routes != 3 {
+		t.Fatalf("routes = %d, want 3", routes)
+	}
+}
+
+func TestRouterMgrUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(r *RouterMgr, group iface.IMiddlewareGroup) error
+		err    error
+		want   map[uint32]string // 修改后msgID匹配的路由，空表示找不到
+	}{
+		{"add", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.TryAdd(3, routeTestRouter("b"))
+		}, nil, map[uint32]string{1: "a", 3: "b"}},
+		{"add duplicate", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.TryAdd(1, routeTestRouter("b"))
+		}, util.RouterConflict, map[uint32]string{1: "a"}},
+		{"add duplicate to group", func(r *RouterMgr, group iface.IMiddlewareGroup) error {
+			return group.TryAddRouter(1, routeTestRouter("b"))
+		}, util.RouterConflict, map[uint32]string{1: "a", 2: "g"}},
+		{"add overlapping range", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.TryAddRange(150, 250, routeTestRouter("b"))
+		}, util.RouterConflict, map[uint32]string{150: "range", 250: ""}},
+		{"replace", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.Replace(1, routeTestRouter("b"))
+		}, nil, map[uint32]string{1: "b"}},
+		{"replace group route", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.Replace(2, routeTestRouter("b"))
+		}, nil, map[uint32]string{2: "b"}},
+		{"replace missing", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.Replace(3, routeTestRouter("b"))
+		}, nil, map[uint32]string{3: "b"}},
+		{"remove", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.Remove("1")
+		}, nil, map[uint32]string{1: "", 2: "g"}},
+		{"remove range", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.Remove("range[100-199]")
+		}, nil, map[uint32]string{150: ""}},
+		{"remove missing", func(r *RouterMgr, _ iface.IMiddlewareGroup) error {
+			return r.Remove("9")
+		}, util.RouterNotFound, map[uint32]string{1: "a", 2: "g"}},
+		{"remove group", func(r *RouterMgr, group iface.IMiddlewareGroup) error {
+			return r.RemoveGroup(group)
+		}, nil, map[uint32]string{1: "a", 2: ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouterMgr()
+			r.Add(1, routeTestRouter("a"))
+			r.AddRange(100, 199, routeTestRouter("range"))
+			group := r.NewGroup(nil)
+			group.AddRouter(2, routeTestRouter("g"))
+			if err := r.ResolveGroup(); err != nil {
+				t.Fatalf("resolve：%v", err)
+			}
+
+			// 修改前的路由表不受影响，正在分发的消息使用的仍是旧路由
+			old := r.getTable()
+			routes := len(r.Routes())
+			if err := tt.update(r, group); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			for msgID, want := range tt.want {
+				if got := routeTestName(t, r, msgID); got != want {
+					t.Fatalf("msgID %d matched %q, want %q", msgID, got, want)
+				}
+			}
+			if router, _, _ := old.match(1); router != routeTestRouter("a") {
+				t.Fatalf("old table matched %v", router)
+			}
+
+			// 修改失败时已撤销，路由定义和路由表一致，可以继续修改
+			if tt.err != nil {
+				if got := len(r.Routes()); got != routes {
+					t.Fatalf("routes = %d after failed update, want %d", got, routes)
+				}
+				if r.getTable() != old {
+					t.Fatal("table is replaced after failed update")
+				}
+			}
+			if err := r.TryAdd(4, routeTestRouter("c")); err != nil {
+				t.Fatalf("add after update：%v", err)
+			}
+			if got := routeTestName(t, r, 4); got != "c" {
+				t.Fatalf("msgID 4 matched %q", got)
+			}
+		})
+	}
+}
+
+//routeTestFunc 执行函数的路由
+type routeTestFunc func(request iface.IRequest)
+
+func (f routeTestFunc) Do(request iface.IRequest) { f(request) }
+
+//dispatchTestContext 消息的上下文，连接没有fd
+func dispatchTestContext(msgID uint32, options *Options) iface.IContext {
+	connect := newBaseConnect(1, -1, &net.TCPAddr{}, options)
+	return util.NewContext(util.NewRequest(connect, &util.Message{MsgID: msgID}, nil))
+}
+
+func TestRouterMgrDispatchPanic(t *testing.T) {
+	panicRouter := routeTestFunc(func(iface.IRequest) { panic("router") })
+	panicMiddleware := func(ctx iface.IContext, next iface.Next) interface{} { panic("middleware") }
+
+	tests := []struct {
+		name      string
+		setup     func(r *RouterMgr)
+		handler   PanicHandler
+		recovered interface{} // PanicHandler收到的值，nil表示没有panic
+	}{
+		{"router", func(r *RouterMgr) {
+			r.Add(1, panicRouter)
+		}, nil, "router"},
+		{"middleware", func(r *RouterMgr) {
+			r.Use(panicMiddleware)
+			r.Add(1, routeTestRouter("a"))
+		}, nil, "middleware"},
+		{"route middleware", func(r *RouterMgr) {
+			r.Add(1, routeTestRouter("a"), panicMiddleware)
+		}, nil, "middleware"},
+		{"panic handler panics", func(r *RouterMgr) {
+			r.Add(1, panicRouter)
+		}, func(iface.IContext, interface{}) { panic("handler") }, "router"},
+		{"no panic", func(r *RouterMgr) {
+			r.Add(1, routeTestRouter("a"))
+		}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouterMgr()
+			tt.setup(r)
+			if err := r.ResolveGroup(); err != nil {
+				t.Fatalf("resolve：%v", err)
+			}
+
+			// PanicHandler收到的是原始的panic值，PanicHandler自身panic时也不会影响调用方
+			var recovered interface{}
+			options := parseOption(WithPanicHandler(func(ctx iface.IContext, value interface{}) {
+				recovered = value
+				if tt.handler != nil {
+					tt.handler(ctx, value)
+				}
+			}))
+			r.Dispatch(dispatchTestContext(1, options), options)
+			if recovered != tt.recovered {
+				t.Fatalf("recovered = %v, want %v", recovered, tt.recovered)
+			}
+		})
+	}
+}
+
+func TestRouterMgrDispatchTimeout(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		route    time.Duration // 单个路由的超时时间，小于0表示不设置
+		sleep    time.Duration // 路由的执行时间
+		timedOut bool
+	}{
+		{"fast", -1, 0, false},
+		{"slow", -1, 3 * timeout, true},
+		{"route timeout", 5 * timeout, 3 * timeout, false},
+		{"route timeout disabled", 0, 3 * timeout, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ctxErr error
+			r := NewRouterMgr()
+			r.Add(1, routeTestFunc(func(request iface.IRequest) {
+				time.Sleep(tt.sleep)
+				ctxErr = util.RequestContext(request).Err()
+			}))
+			if tt.route >= 0 {
+				r.SetTimeout(1, tt.route)
+			}
+			if err := r.ResolveGroup(); err != nil {
+				t.Fatalf("resolve：%v", err)
+			}
+
+			// 超时只记录、回调，路由继续执行，上下文在超时后取消
+			timedOut := make(chan time.Duration, 1)
+			options := parseOption(WithHandlerTimeout(timeout), WithTimeoutHandler(func(ctx iface.IContext, timeout time.Duration) {
+				timedOut <- timeout
+			}))
+			ctx := dispatchTestContext(1, options)
+			r.Dispatch(ctx, options)
+
+			select {
+			case got := <-timedOut:
+				if !tt.timedOut || got != timeout {
+					t.Fatalf("timeout handler called with %v", got)
+				}
+				if ctxErr != context.DeadlineExceeded {
+					t.Fatalf("request context err = %v", ctxErr)
+				}
+			default:
+				if tt.timedOut {
+					t.Fatal("timeout handler is not called")
+				}
+				if ctxErr != nil {
+					t.Fatalf("request context err = %v", ctxErr)
+				}
+			}
+
+			// 派生的上下文在执行完后取消，不影响消息原来的上下文
+			if ctx.Err() != nil {
+				t.Fatalf("message context err = %v", ctx.Err())
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ package server
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"runtime"
+	"time"
 
 	"github.com/ikilobyte/netman/common"
 	"github.com/ikilobyte/netman/eventloop"
@@ -33,6 +35,8 @@ type Server struct {
 	packer     iface.IPacker         // 负责封包解包
 	emitCh     chan iface.IContext   // 从这里接收epoll转发过来的消息，然后交给worker去处理
 	routerMgr  *RouterMgr            // 路由统一管理
+	ordered    *orderedDispatcher    // 同一个连接的消息按顺序执行
+	mqtt       *mqttBroker           // MQTT模式的broker
 }
 
 // makeServer 创建tcp server服务器
@@ -48,9 +52,23 @@ func createTcpServer(ip string, port int, opts ...Option) (*Server, *Options) {
 	// 封包解包的实现层，外部可以自行实现IPacker使用自己的封包解包方式
 	if options.Packer == nil {
 		options.Packer = util.NewDataPacker()
+	}
+
+	// 包体最大长度，自定义的packer也需要限制
+	if options.MaxBodyLength > 0 {
 		options.Packer.SetMaxBodyLength(options.MaxBodyLength)
 	}
 
+	// 流式路由暂停读取的阈值
+	if options.StreamBufferSize <= 0 {
+		options.StreamBufferSize = 1 << 20
+	}
+
+	// AddHandler注册的路由默认使用json编解码
+	if options.Codec == nil {
+		options.Codec = util.NewJSONCodec()
+	}
+
 	// 日志保存路径
 	if options.LogOutput != nil {
 		util.Logger.SetOutput(options.LogOutput)
@@ -69,8 +87,11 @@ func createTcpServer(ip string, port int, opts ...Option) (*Server, *Options) {
 		emitCh:     make(chan iface.IContext, 128),
 		packer:     options.Packer,
 		routerMgr:  NewRouterMgr(),
+		ordered:    newOrderedDispatcher(),
 	}
 
+	options.isStreamRoute = server.routerMgr.isStreamRoute
+
 	// 初始化epoll
 	if err := server.eventloop.Init(server.connectMgr); err != nil {
 		log.Panicln(err)
@@ -112,16 +133,128 @@ func Websocket(ip string, port int, handler iface.IWebsocketHandler, opts ...Opt
 	return server
 }
 
-// AddRouter 添加路由处理
-func (s *Server) AddRouter(msgID uint32, router iface.IRouter) {
+// AddRouter 添加路由处理，middlewares只对这个路由生效，启动后添加失败时只记录日志，需要判断结果时使用TryAddRouter
+func (s *Server) AddRouter(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
 
-	// 只有路由模式才可以添加
-	if s.options.Application != common.RouterMode {
-		log.Panicln("application not websocket")
+	// websocket需要配置信封才能从消息中解析出msgID
+	if s.options.Application == common.WebsocketMode && s.options.WebsocketEnvelope == nil {
+		log.Panicln("websocket envelope not set, see server.WithWebsocketEnvelope")
 		return
 	}
 
-	s.routerMgr.Add(msgID, router)
+	s.routerMgr.Add(msgID, router, middlewares...)
+}
+
+// TryAddRouter 添加路由处理，启动后与已有的路由冲突时返回util.RouterConflict，可以在运行中调用
+func (s *Server) TryAddRouter(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	if s.options.Application == common.WebsocketMode && s.options.WebsocketEnvelope == nil {
+		return util.WebsocketEnvelopeNotSet
+	}
+	return s.routerMgr.TryAdd(msgID, router, middlewares...)
+}
+
+// ReplaceRouter 替换路由，保留原来所属的分组，不存在时添加，可以在运行中调用
+func (s *Server) ReplaceRouter(msgID uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return s.routerMgr.Replace(msgID, router, middlewares...)
+}
+
+// RemoveRouter 删除路由，可以在运行中调用
+func (s *Server) RemoveRouter(msgID uint32) error {
+	return s.routerMgr.Remove((&routeEntry{kind: exactRoute, msgID: msgID}).String())
+}
+
+// RemoveRangeRouter 删除范围路由，可以在运行中调用
+func (s *Server) RemoveRangeRouter(from, to uint32) error {
+	return s.routerMgr.Remove((&routeEntry{kind: rangeRoute, from: from, to: to}).String())
+}
+
+// RemoveMaskRouter 删除掩码路由，可以在运行中调用
+func (s *Server) RemoveMaskRouter(mask, value uint32) error {
+	return s.routerMgr.Remove((&routeEntry{kind: maskRoute, mask: mask, msgID: value & mask}).String())
+}
+
+// RemoveGroup 删除分组，包括子分组和分组中的路由，可以在运行中调用
+func (s *Server) RemoveGroup(group iface.IMiddlewareGroup) error {
+	return s.routerMgr.RemoveGroup(group)
+}
+
+// Routes 当前生效的路由表
+func (s *Server) Routes() []RouteInfo {
+	return s.routerMgr.Routes()
+}
+
+// AddRangeRouter 添加范围路由，msgID在[from, to]范围内且没有精确匹配的路由时执行
+func (s *Server) AddRangeRouter(from, to uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	s.routerMgr.AddRange(from, to, router, middlewares...)
+}
+
+// AddMaskRouter 添加掩码路由，msgID & mask == value 且没有精确匹配的路由时执行
+// 如：高16位表示模块，AddMaskRouter(0xffff0000, 0x00010000, router) 匹配模块1的所有消息
+func (s *Server) AddMaskRouter(mask, value uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	s.routerMgr.AddMask(mask, value, router, middlewares...)
+}
+
+// TryAddRangeRouter 添加范围路由，启动后与已有的路由冲突（包括与范围、掩码路由重叠）时返回util.RouterConflict，可以在运行中调用
+func (s *Server) TryAddRangeRouter(from, to uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return s.routerMgr.TryAddRange(from, to, router, middlewares...)
+}
+
+// TryAddMaskRouter 添加掩码路由，启动后与已有的路由冲突（包括与范围、掩码路由重叠）时返回util.RouterConflict，可以在运行中调用
+func (s *Server) TryAddMaskRouter(mask, value uint32, router iface.IRouter, middlewares ...iface.MiddlewareFunc) error {
+	return s.routerMgr.TryAddMask(mask, value, router, middlewares...)
+}
+
+// Any 匹配所有消息的路由，在精确匹配、范围、掩码路由之后，NotFound之前匹配，可以用于将未知的消息转发给其它服务
+// 与添加顺序无关，重复调用时替换，可以在运行中调用
+func (s *Server) Any(router iface.IRouter, middlewares ...iface.MiddlewareFunc) {
+	s.routerMgr.SetAny(router, middlewares...)
+}
+
+// RemoveAny 删除Any设置的路由，可以在运行中调用
+func (s *Server) RemoveAny() error {
+	return s.routerMgr.Remove((&routeEntry{kind: anyRoute}).String())
+}
+
+// NotFound 找不到路由时执行，未配置时交给ErrorHandler或者回复标准错误包，都未配置时只记录日志
+func (s *Server) NotFound(router iface.IRouter) {
+	s.routerMgr.SetNotFound(router)
+}
+
+// AddStreamRouter 添加流式路由，包头读取完后立即执行，包体通过body边接收边读取，不会整个缓存在内存中
+// 路由未读取的数据达到StreamBufferSize时暂停读取这个连接，包体不会经过IBodyUnpacker处理
+func (s *Server) AddStreamRouter(msgID uint32, router iface.IStreamRouter, middlewares ...iface.MiddlewareFunc) {
+	s.AddRouter(msgID, s.StreamRouter(router), middlewares...)
+}
+
+// StreamRouter 将IStreamRouter转换为IRouter，可用于分组中间件：g.AddRouter(msgID, s.StreamRouter(router))
+func (s *Server) StreamRouter(router iface.IStreamRouter) iface.IRouter {
+	return &streamRouter{router: router}
+}
+
+// AddHandler 添加路由处理，handler的签名为 func(request iface.IRequest, in *T) (out R, err error)
+// 或 func(request iface.IRequest, in *T) error，in和out使用配置的codec编解码，out会以相同的msgID回复
+func (s *Server) AddHandler(msgID uint32, handler interface{}) {
+	s.AddRouter(msgID, s.Handler(handler))
+}
+
+// Handler 将handler转换为IRouter，可用于分组中间件：g.AddRouter(msgID, s.Handler(handler))
+func (s *Server) Handler(handler interface{}) iface.IRouter {
+	return newHandlerRouter(handler, s.options)
+}
+
+// AddReplyRouter 添加有返回值的路由，返回值经过中间件后由框架回复给客户端
+func (s *Server) AddReplyRouter(msgID uint32, router iface.IReplyRouter) {
+	s.AddRouter(msgID, s.ReplyRouter(router))
+}
+
+// ReplyRouter 将IReplyRouter转换为IRouter，可用于分组中间件：g.AddRouter(msgID, s.ReplyRouter(router))
+func (s *Server) ReplyRouter(router iface.IReplyRouter) iface.IRouter {
+	return newReplyRouter(router, s.options)
+}
+
+// SetRouterTimeout 设置单个路由的执行超时时间，超时后会记录日志并执行TimeoutHandler
+func (s *Server) SetRouterTimeout(msgID uint32, timeout time.Duration) {
+	s.routerMgr.SetTimeout(msgID, timeout)
 }
 
 // Start 启动
@@ -131,9 +264,25 @@ func (s *Server) Start() {
 	}
 	s.status = started
 
-	// 处理路由分组的数据
+	// 处理路由分组的数据，重复添加的路由不能启动
 	if err := s.routerMgr.ResolveGroup(); err != nil {
 		util.Logger.Errorf("server start error：%v", err)
+		log.Panicln(err)
+	}
+
+	// 检查协议探测规则
+	s.options.resolveSniffers()
+
+	// 检查websocket压缩配置，配置有误不能启动
+	if err := s.options.checkWebsocketCompression(); err != nil {
+		util.Logger.Errorf("server start error：%v", err)
+		log.Panicln(err)
+	}
+
+	// 标准错误包不能使用配置的codec编码时不能启动
+	if err := s.options.checkErrorPacket(); err != nil {
+		util.Logger.Errorf("server start error：%v", err)
+		log.Panicln(err)
 	}
 
 	if err := s.acceptor.Run(s.socket.fd, s.eventloop); err != nil {
@@ -152,6 +301,12 @@ func (s *Server) doMessage() {
 				return
 			}
 
+			// 同一个连接的消息按顺序执行
+			if s.options.OrderedDispatch {
+				s.ordered.dispatch(context, s.routerMgr, s.options)
+				continue
+			}
+
 			// 分发出去
 			go s.routerMgr.Dispatch(context, s.options)
 		}
@@ -160,10 +315,41 @@ func (s *Server) doMessage() {
 
 // Use 全局中间件
 func (s *Server) Use(callable iface.MiddlewareFunc) *Server {
-	s.routerMgr.globalMiddlewares = append(s.routerMgr.globalMiddlewares, callable)
+	s.routerMgr.Use(callable)
+	return s
+}
+
+// HandleHTTP websocket端口上非升级的HTTP请求按pattern交给handler处理，规则与http.ServeMux相同，需要在启动前调用
+// 配置了WithHTTPHandler且不是*http.ServeMux时会panic
+func (s *Server) HandleHTTP(pattern string, handler http.Handler) {
+	if s.options.HTTPHandler == nil {
+		s.options.HTTPHandler = http.NewServeMux()
+	}
+
+	mux, ok := s.options.HTTPHandler.(*http.ServeMux)
+	if !ok {
+		log.Panicln("http handler is not *http.ServeMux, see server.WithHTTPHandler")
+		return
+	}
+	mux.Handle(pattern, handler)
+}
+
+// UseOutbound 添加发送拦截器，msgIDs为空时对所有消息生效，按添加顺序执行，可以在运行中调用
+// 所有发送消息的地方（Send、Text、Binary、Broadcast、框架的回复）都会经过发送拦截器，websocket的Text、Binary的msgID为0
+func (s *Server) UseOutbound(interceptor iface.OutboundFunc, msgIDs ...uint32) *Server {
+	s.options.outbound.add(interceptor, msgIDs...)
 	return s
 }
 
+// Broadcast 给所有连接发送消息，每个连接都会执行发送拦截器
+func (s *Server) Broadcast(msgID uint32, bs []byte) {
+	for _, connect := range s.connectMgr.GetConnects() {
+		if _, err := connect.Send(msgID, bs); err != nil {
+			util.Logger.Errorf("broadcast to connect fd[%d] id[%d] error %v", connect.GetFd(), connect.GetID(), err)
+		}
+	}
+}
+
 // Group 分组中间件
 func (s *Server) Group(callable iface.MiddlewareFunc, more ...iface.MiddlewareFunc) iface.IMiddlewareGroup {
 	return s.routerMgr.NewGroup(callable, more...)
@@ -172,6 +358,7 @@ func (s *Server) Group(callable iface.MiddlewareFunc, more ...iface.MiddlewareFu
 // Stop 停止
 func (s *Server) Stop() {
 	s.status = stopping
+	s.options.cancel()
 	s.connectMgr.ClearAll()
 	s.eventloop.Stop()
 	close(s.emitCh)
@@ -25,9 +25,18 @@ func createUDPServer(ip string, port int, opts ...Option) (*Server, *Options) {
 	// 封包解包的实现层，外部可以自行实现IPacker使用自己的封包解包方式
 	if options.Packer == nil {
 		options.Packer = util.NewDataPacker()
+	}
+
+	// 包体最大长度，自定义的packer也需要限制
+	if options.MaxBodyLength > 0 {
 		options.Packer.SetMaxBodyLength(options.MaxBodyLength)
 	}
 
+	// AddHandler注册的路由默认使用json编解码
+	if options.Codec == nil {
+		options.Codec = util.NewJSONCodec()
+	}
+
 	if options.UDPPacketBufferLength <= 0 {
 		options.UDPPacketBufferLength = 32768
 	}
@@ -50,6 +59,7 @@ func createUDPServer(ip string, port int, opts ...Option) (*Server, *Options) {
 		emitCh:     make(chan iface.IContext, 128),
 		packer:     options.Packer,
 		routerMgr:  NewRouterMgr(),
+		ordered:    newOrderedDispatcher(),
 	}
 
 	// 初始化epoll，用于处理 "长连接" udp client的消息
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"io"
+	"log"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+//maxSniffLength 探测协议最多等待的数据长度，超过后仍然无法判断时使用Application
+const maxSniffLength = 4096
+
+//Sniffer 协议探测规则，Match匹配时连接使用Application和Packer
+type Sniffer struct {
+	Application common.ApplicationMode // 应用层协议，websocket需要配置WithWebsocketHandler
+	Packer      iface.IPacker          // 这个协议使用的packer，为nil时使用WithPacker配置的
+	Match       SniffFunc              // 根据连接最前面的数据判断，如：util.SniffHTTP、util.SniffPrefix
+	Protocol    ProtocolFactory        // 自定义应用层协议，配置后不使用Application
+}
+
+//resolveSniffers 启动时检查协议探测规则，未配置规则时使用默认规则
+func (o *Options) resolveSniffers() {
+	if !o.Sniff {
+		return
+	}
+
+	// 默认规则：配置了websocket回调时，HTTP请求使用websocket协议
+	if len(o.Sniffers) == 0 && o.WebsocketHandler != nil {
+		o.Sniffers = append(o.Sniffers, Sniffer{Application: common.WebsocketMode, Match: util.SniffHTTP})
+	}
+
+	for _, sniffer := range o.Sniffers {
+		if sniffer.Match == nil {
+			log.Panicln("sniffer match func is nil")
+		}
+		if sniffer.Application == common.WebsocketMode && o.WebsocketHandler == nil {
+			log.Panicln("websocket handler not set, see server.WithWebsocketHandler")
+		}
+		if sniffer.Packer != nil && o.MaxBodyLength > 0 {
+			sniffer.Packer.SetMaxBodyLength(o.MaxBodyLength)
+		}
+	}
+}
+
+//sniffConnect 协议探测阶段的连接，根据最前面的数据选择TLS和应用层协议，探测完成后替换为实际的连接
+type sniffConnect struct {
+	*BaseConnect
+	layerDetected bool // 是否已确定使用TLS
+}
+
+func newSniffConnect(baseConnect *BaseConnect) iface.IConnect {
+	connect := &sniffConnect{BaseConnect: baseConnect}
+	baseConnect.self = connect
+	baseConnect.opened = -1 // 探测完成之前不执行onopen事件
+	return connect
+}
+
+//Sniff 读取数据并探测协议，数据不足时返回nil，探测完成后返回实际的连接并替换connectMgr中的连接
+func (c *sniffConnect) Sniff() (iface.IConnect, error) {
+
+	// 1、配置了TLS证书时，先判断是否为TLS握手
+	if !c.layerDetected {
+		if err := c.readRaw(); err != nil {
+			return nil, err
+		}
+
+		if c.options.TlsEnable {
+			switch util.SniffTLS(c.sniffData) {
+			case common.SniffMore:
+				return nil, nil
+			case common.SniffMatch:
+				if err := c.handshake(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		c.layerDetected = true
+	} else if !c.tlsEnable {
+		if err := c.readRaw(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2、TLS连接读取解密后的数据
+	if c.tlsEnable {
+		if err := c.readTLS(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 3、匹配应用层协议
+	sniffer, ok := c.match()
+	if !ok {
+		return nil, nil
+	}
+
+	return c.upgrade(sniffer), nil
+}
+
+//readRaw 读取一次当前可读的原始数据，剩余的数据留在内核缓冲区中
+func (c *sniffConnect) readRaw() error {
+	buffer := make([]byte, maxSniffLength)
+	n, _, err := unix.Recvfrom(c.fd, buffer, unix.MSG_DONTWAIT)
+	if err != nil {
+		if err == unix.EAGAIN || err == unix.EINTR {
+			return nil
+		}
+		return err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	c.sniffData = append(c.sniffData, buffer[:n]...)
+	return nil
+}
+
+//handshake 已读取的数据交给TLS层，握手期间使用阻塞模式，与未开启协议探测时相同
+func (c *sniffConnect) handshake() error {
+	c.sniffRaw, c.sniffData = c.sniffData, nil
+	c.initTLS()
+
+	if err := unix.SetNonblock(c.fd, false); err != nil {
+		return err
+	}
+	if err := c.tlsLayer.Handshake(); err != nil {
+		return err
+	}
+	c.SetHandshakeCompleted()
+	return unix.SetNonblock(c.fd, true)
+}
+
+//readTLS 读取TLS层中所有已解密的数据，TLS层中剩余的数据不会再触发可读事件
+func (c *sniffConnect) readTLS() error {
+	buffer := make([]byte, 16384)
+	for {
+		n, err := c.tlsLayer.Read(buffer)
+		if n > 0 {
+			c.sniffData = append(c.sniffData, buffer[:n]...)
+		}
+		if err != nil {
+			if len(c.sniffData) == 0 && (err == io.EOF || err == unix.EBADF || err == unix.EPIPE) {
+				return io.EOF
+			}
+			break
+		}
+		if n == 0 {
+			break
+		}
+	}
+	c.tlsRawSize = 0
+	return nil
+}
+
+//match 按顺序匹配规则，前面的规则需要更多数据时等待，返回nil表示使用Application
+func (c *sniffConnect) match() (*Sniffer, bool) {
+	if len(c.sniffData) == 0 {
+		return nil, false
+	}
+
+	for i := range c.options.Sniffers {
+		switch c.options.Sniffers[i].Match(c.sniffData) {
+		case common.SniffMatch:
+			return &c.options.Sniffers[i], true
+		case common.SniffMore:
+			if len(c.sniffData) < maxSniffLength {
+				return nil, false
+			}
+		}
+	}
+	return nil, true
+}
+
+//upgrade 创建实际的连接，已读取的数据在sniffData中，由实际的连接继续解码
+func (c *sniffConnect) upgrade(sniffer *Sniffer) iface.IConnect {
+	application, factory := c.options.Application, c.options.Protocol
+	if sniffer != nil {
+		application, factory = sniffer.Application, sniffer.Protocol
+		if sniffer.Packer != nil {
+			c.packer = sniffer.Packer
+			if cloner, ok := sniffer.Packer.(iface.IPackerCloner); ok {
+				c.packer = cloner.Clone()
+			}
+		}
+	}
+
+	connect := newProtocol(c.BaseConnect, application, factory)
+	c.GetConnectMgr().Add(connect)
+	return connect
+}
+
+//DecodePacket 探测完成之前不会解码
+func (c *sniffConnect) DecodePacket() (iface.IMessage, error) {
+	return nil, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io"
+
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+//maxStreamRead 非TLS连接每次最多读取的字节数，剩余的数据等下次可读事件再读取，避免一个连接占用事件循环
+const maxStreamRead = 1 << 20
+
+//decodeStream 读取当前可读的所有数据后使用IStreamDecoder解码，一次可能解码出多个消息，未处理的保存在pending中
+func (c *routerProtocol) decodeStream(decoder iface.IStreamDecoder) (iface.IMessage, error) {
+
+	// 读取到EAGAIN为止，TLS层中可能还有已解密未读取的数据，不读完的话不会再收到可读事件（非TLS连接最多读取maxStreamRead）
+	size := 65536
+	if c.handshakeCompleted {
+		size = 16384
+	}
+
+	total := 0
+	buffer := make([]byte, size)
+	for total < maxStreamRead || c.GetTLSEnable() {
+		n, err := c.readData(buffer)
+		if n > 0 {
+			c.streamBuffer = append(c.streamBuffer, buffer[:n]...)
+			total += n
+		}
+
+		if err == nil && n > 0 {
+			continue
+		}
+
+		// 本次没有读取到数据
+		if total == 0 {
+			if err == nil || err == io.EOF || err == unix.EBADF || err == unix.EPIPE {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+
+		// 已读取到数据，先解码，连接断开的错误在下次读取时处理
+		break
+	}
+
+	if c.GetHandshakeCompleted() {
+		c.tlsRawSize = 0
+	}
+
+	if err := c.decodeBuffer(decoder); err != nil {
+		return nil, err
+	}
+
+	return c.popPending(), nil
+}
+
+//decodeResetter 保存了解码状态的IStreamDecoder，如：util.DelimiterPacker
+type decodeResetter interface {
+	ResetDecode()
+}
+
+//decodeDatagram 解码一个UDP数据报，数据报中不完整的部分会被丢弃
+func (c *routerProtocol) decodeDatagram(decoder iface.IStreamDecoder, datagram []byte) (iface.IMessage, error) {
+	c.streamBuffer = datagram
+	err := c.decodeBuffer(decoder)
+
+	// 数据报中不完整的部分会被丢弃，packer中保存的解码状态也需要重置
+	if resetter, ok := decoder.(decodeResetter); ok && len(c.streamBuffer) > 0 {
+		resetter.ResetDecode()
+	}
+	c.streamBuffer = nil
+	if err != nil {
+		return nil, err
+	}
+	return c.popPending(), nil
+}
+
+//decodeBuffer 解码streamBuffer中的数据，直到数据不完整为止
+func (c *routerProtocol) decodeBuffer(decoder iface.IStreamDecoder) error {
+
+	used := 0
+	for used < len(c.streamBuffer) {
+		consumed, messages, err := decoder.Decode(c.streamBuffer[used:])
+		if err == nil && (consumed < 0 || consumed > len(c.streamBuffer)-used) {
+			err = util.HeadBytesLengthFail
+		}
+
+		// 数据有误，无法继续解码，断开连接
+		if err != nil {
+			util.Logger.Errorf("connect fd[%d] id[%d] stream decode error %v", c.fd, c.id, err)
+			return io.EOF
+		}
+
+		c.pending = append(c.pending, messages...)
+
+		// 数据不完整
+		if consumed == 0 {
+			break
+		}
+		used += consumed
+	}
+
+	// 未解码的数据复制到新的slice，已解码的消息可能引用了原来的数据
+	if used > 0 {
+		c.streamBuffer = append([]byte(nil), c.streamBuffer[used:]...)
+	}
+	return nil
+}
+
+//popPending 取出一个已解码的消息
+func (c *routerProtocol) popPending() iface.IMessage {
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	message := c.pending[0]
+	c.pending[0] = nil
+	c.pending = c.pending[1:]
+	return message
+}
+
+//HasPending 是否还有已解码未处理的消息，或者协议探测时已读取未解码的数据（连接已断开、流式路由暂停读取时不再处理）
+func (c *routerProtocol) HasPending() bool {
+	if len(c.pending) > 0 {
+		return true
+	}
+	return len(c.sniffData) > 0 && c.ctx.Err() == nil && (c.body == nil || !c.body.Full())
+}
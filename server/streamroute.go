@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+//streamRouter 将IStreamRouter适配为IRouter
+type streamRouter struct {
+	router iface.IStreamRouter
+}
+
+//Do 已完整接收的消息（UDP、IStreamDecoder、websocket）也可以交给流式路由
+func (r *streamRouter) Do(request iface.IRequest) {
+	message := request.GetMessage()
+	if stream, ok := message.(*util.StreamMessage); ok {
+		r.router.DoStream(request, stream.Body())
+		return
+	}
+	r.router.DoStream(request, util.BytesBody(message.Bytes()))
+}
+
+//beginBody 包头读取完后创建包体数据流，消息立即交给路由
+func (c *routerProtocol) beginBody(message iface.IMessage) iface.IMessage {
+	c.body = util.NewBodyStream(message.Len(), c.options.StreamBufferSize, c.pauseRead, c.resumeRead)
+	c.bodyRemain = uint32(message.Len())
+	return util.NewStreamMessage(message, c.body)
+}
+
+//decodeBody 读取流式路由的包体，写入数据流，路由未读取的数据太多时暂停读取
+//TLS层中可能还有已解密未读取的数据，需要读取到EAGAIN为止（非TLS连接最多读取maxStreamRead）
+func (c *routerProtocol) decodeBody() (iface.IMessage, error) {
+
+	total := 0
+	for total < maxStreamRead || c.GetTLSEnable() {
+
+		if c.body.Full() {
+			return nil, c.checkPaused()
+		}
+
+		// 如果是TLS，那么每次最大读取16384字节即可
+		size := c.bodyRemain
+		if c.handshakeCompleted && size > 16384 {
+			size = 16384
+		} else if size > 65536 {
+			size = 65536
+		}
+
+		buffer := make([]byte, size)
+		n, err := c.readData(buffer)
+		if n > 0 {
+			c.body.Write(buffer[:n:n])
+			c.bodyRemain -= uint32(n)
+			total += n
+		}
+
+		// 包体读取完整，继续读取下一个数据包
+		if c.bodyRemain == 0 {
+			c.body.Finish(nil)
+			c.body = nil
+			c.tlsRawSize = 0
+			return c.decodePacket()
+		}
+
+		if err != nil {
+			if err == io.EOF || err == unix.EBADF || err == unix.EPIPE {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+
+		if n == 0 {
+			break
+		}
+	}
+	return nil, nil
+}
+
+//checkPaused 暂停读取后仍收到了事件，可能是连接已断开（EPOLLERR、EPOLLHUP）
+func (c *routerProtocol) checkPaused() error {
+	buffer := make([]byte, 1)
+	n, _, err := unix.Recvfrom(c.fd, buffer, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	if err == nil && n == 0 {
+		return io.EOF
+	}
+	if err != nil && err != unix.EAGAIN && err != unix.EINTR {
+		return io.EOF
+	}
+	return nil
+}
+
+//pauseRead 处于可写状态时读事件已经暂停，发送完成后恢复读事件时会再次检查
+func (c *routerProtocol) pauseRead() {
+	if c.state == common.EPollOUT {
+		return
+	}
+	_ = c.GetPoller().PauseRead(c.fd, c.id)
+}
+
+//resumeRead 处于可写状态时由ProceedWrite恢复读事件，连接关闭后不再恢复
+func (c *routerProtocol) resumeRead() {
+	if c.state == common.EPollOUT || c.ctx.Err() != nil {
+		return
+	}
+	_ = c.GetPoller().ResumeRead(c.fd, c.id)
+}
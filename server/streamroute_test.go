@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+func TestRouterProtocolStreamBody(t *testing.T) {
+	c, poller, peer := newRouterTestConnect(t, WithPacker(util.NewDataPacker()), WithStreamBufferSize(8))
+	c.options.isStreamRoute = func(msgID uint32) bool {
+		return msgID == 1
+	}
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 2)
+	stream, _ := c.packer.Pack(1, body)
+	next, _ := c.packer.Pack(2, []byte("next"))
+	stream = append(stream, next...)
+
+	// 包头读取完后立即交给路由
+	header := int(c.packer.GetHeaderLength())
+	if _, err := unix.Write(peer, stream[:header+8]); err != nil {
+		t.Fatalf("write：%v", err)
+	}
+	message, err := c.DecodePacket()
+	streamMessage, ok := message.(*util.StreamMessage)
+	if err != nil || !ok || streamMessage.ID() != 1 {
+		t.Fatalf("decode = %T %v", message, err)
+	}
+
+	// 未读取的数据达到StreamBufferSize时暂停读取，暂停后再收到事件时也不读取
+	for i, data := range [][]byte{stream[header+8:], nil} {
+		if message, err := c.DecodePacket(); message != nil || err != nil {
+			t.Fatalf("decode body = %v %v", message, err)
+		}
+		if paused, resumed := poller.counts(); paused != i+1 || resumed != 0 {
+			t.Fatalf("paused %d resumed %d, want %d 0", paused, resumed, i+1)
+		}
+		if _, err := unix.Write(peer, data); err != nil {
+			t.Fatalf("write：%v", err)
+		}
+	}
+
+	// 路由读取后恢复，继续读取包体和下一个消息
+	chunk, err := streamMessage.Body().Next()
+	if err != nil || !bytes.Equal(chunk, body[:8]) {
+		t.Fatalf("first chunk %q %v", chunk, err)
+	}
+	if _, resumed := poller.counts(); resumed != 1 {
+		t.Fatalf("resumed %d, want 1", resumed)
+	}
+	message, err = c.DecodePacket()
+	if err != nil || message == nil || message.ID() != 2 || string(message.Bytes()) != "next" {
+		t.Fatalf("decode next = %v %v", message, err)
+	}
+	if rest, err := ioutil.ReadAll(streamMessage.Body()); err != nil || !bytes.Equal(rest, body[8:]) {
+		t.Fatalf("rest of body %q %v", rest, err)
+	}
+}
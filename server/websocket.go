@@ -9,9 +9,10 @@ import (
 	"github.com/ikilobyte/netman/iface"
 	"github.com/ikilobyte/netman/util"
 	"io"
+	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"unicode/utf8"
 )
@@ -53,6 +54,18 @@ type websocketProtocol struct {
 	messageMode     uint8      // 消息类型
 	parseHeaderStep uint8      // 解析头数据到了第几个步骤
 	headerBytes     []byte
+	httpBuffer      []byte            // 握手之前已接收未解析的HTTP数据，握手之后剩余的数据会先交给数据帧解析
+	httpLocker      sync.Mutex        // 保护下面的HTTP请求队列
+	httpQueue       []*http.Request   // 待处理的HTTP请求
+	httpRunning     bool              // 是否有goroutine正在处理HTTP请求
+	httpClosing     bool              // 处理完已接收的请求后关闭连接，不再解析新的请求
+	httpEOF         bool              // 客户端已关闭写入，处理完请求后关闭连接
+	httpContinued   bool              // 当前请求是否已回复100 Continue
+	httpChunked     *httpChunkedBody  // 不完整的chunked请求体的解析状态
+	deflate         *websocketDeflate // 握手时协商了permessage-deflate
+	compressed      bool              // 当前消息是否已压缩（第一个分帧的RSV1）
+	request         *http.Request     // 握手请求
+	subprotocol     string            // 握手时协商的子协议
 }
 
 //newWebsocketProtocol
@@ -81,17 +94,9 @@ func newWebsocketProtocol(baseConnect *BaseConnect) iface.IConnect {
 //DecodePacket 读取一个完整的数据包
 func (c *websocketProtocol) DecodePacket() (iface.IMessage, error) {
 
-	// 握手
+	// 握手之前按HTTP请求处理，升级请求完成握手
 	if c.isHandleShake == false {
-
-		// 可能会出现资源不可能的情况，因为是非阻塞的
-		if err := c.handleShake(); err != nil {
-			return nil, err
-		}
-		c.isHandleShake = true
-		// onopen
-		c.options.WebsocketHandler.Open(c)
-		return nil, nil
+		return nil, c.readHTTP()
 	}
 
 	// 解析头部协议
@@ -215,9 +220,9 @@ func (c *websocketProtocol) parseHeadBytes(bs []byte) error {
 	firstByte := bs[0]
 	secondByte := bs[1]
 	c.final = firstByte >> 7 // 当前分帧是否为最后一个包
-	rsv1 := 1 & (firstByte >> 4)
+	rsv1 := 1 & (firstByte >> 6)
 	rsv2 := 1 & (firstByte >> 5)
-	rsv3 := 1 & (firstByte >> 6)
+	rsv3 := 1 & (firstByte >> 4)
 
 	c.opcode = firstByte & 0xf
 	maskd := secondByte >> 7
@@ -225,14 +230,15 @@ func (c *websocketProtocol) parseHeadBytes(bs []byte) error {
 
 	//fmt.Printf("rsv1 %d rsv2 %d rsv3 %d length %d\n", rsv1, rsv2, rsv3, c.fragmentLength)
 
-	// 这三个必须为0
-	if rsv1 == 1 || rsv2 == 1 || rsv3 == 1 {
+	// RSV1表示消息已压缩，只能在协商了permessage-deflate时出现在消息的第一个分帧，其它两个必须为0
+	if rsv1 == 1 && (c.deflate == nil || (c.opcode != TEXTMODE && c.opcode != BINMODE)) || rsv2 == 1 || rsv3 == 1 {
 		return util.WebsocketRsvFail
 	}
 
 	// 保存这个分帧的消息类型
 	if c.opcode == TEXTMODE || c.opcode == BINMODE {
 		c.messageMode = c.opcode
+		c.compressed = rsv1 == 1
 	}
 
 	// 读取数据解析出
@@ -312,52 +318,40 @@ func (c *websocketProtocol) reset() {
 }
 
 //handleShake websocket握手
-func (c *websocketProtocol) handleShake() error {
-
-	buffer := make([]byte, 2048)
-	n, err := c.readData(buffer)
-
-	// 读取数据异常
-	if err != nil {
-		util.Logger.Errorf("websocket handle shake err：%v", err)
-		return err
-	}
-
-	// 连接异常，无需处理
-	if n == 0 {
-		return io.EOF
-	}
-
-	sBuffer := string(buffer)
-
-	// 头部校验
-	headMatches := regexp.MustCompile(`GET /(.*?) HTTP/1.1`).FindStringSubmatch(sBuffer)
-	if len(headMatches) != 2 {
-		util.Logger.Errorf("websocket handle shake protocol err：%v", err)
-		return io.EOF
-	}
-
-	// 边界校验
-	if strings.Index(sBuffer, "Connection: Upgrade") == -1 {
-		util.Logger.Errorf("websocket handle shake Upgrade err：%v", err)
-		return io.EOF
-	}
-
-	// 校验是否有相关key
-	matches := regexp.MustCompile(`Sec-WebSocket-Key: (.+)`).FindStringSubmatch(sBuffer)
-	if len(matches) != 2 {
-		util.Logger.Errorf("websocket handle shake Sec-WebSocket-Key err：%v", err)
+func (c *websocketProtocol) handleShake(request *http.Request) error {
+
+	// 校验升级请求，失败时回复对应的状态码
+	key := strings.TrimSpace(request.Header.Get("Sec-WebSocket-Key"))
+	if err := c.checkUpgrade(request, key); err != nil {
+		util.Logger.Infof("websocket connect fd[%d] id[%d] handle shake fail：%v", c.fd, c.id, err)
+		if err.status == http.StatusUpgradeRequired {
+			_, _ = c.push(httpErrorResponse(err.status, "Sec-WebSocket-Version: 13"))
+		} else {
+			_, _ = c.push(httpErrorResponse(err.status))
+		}
 		return io.EOF
 	}
 
 	// 解析query string
-	split := strings.Split(headMatches[1], "?")
-	if len(split) == 2 {
-		c.query, _ = url.ParseQuery(split[1])
+	c.query = request.URL.Query()
+	c.request = request
+
+	// 子协议，按客户端的顺序选择第一个服务端支持的
+	c.subprotocol = c.options.selectSubprotocol(request.Header.Values("Sec-WebSocket-Protocol"))
+
+	// 握手时认证，失败时响应401
+	if authenticator := c.options.WebsocketAuthenticator; authenticator != nil {
+		identity, err := authenticator(c, c.query, request.Header)
+		if err != nil {
+			util.Logger.Infof("websocket handle shake authenticate fail：%v", err)
+			_, _ = c.push([]byte("HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return io.EOF
+		}
+		c.SetIdentity(identity)
 	}
 
 	// 响应握手协议
-	encodeData := fmt.Sprintf("%s258EAFA5-E914-47DA-95CA-C5AB0DC85B11", strings.Trim(matches[1], "\r\n"))
+	encodeData := fmt.Sprintf("%s258EAFA5-E914-47DA-95CA-C5AB0DC85B11", key)
 	hash := sha1.New()
 	hash.Write([]byte(encodeData))
 	bs := hash.Sum(nil)
@@ -367,33 +361,96 @@ func (c *websocketProtocol) handleShake() error {
 	headers += "Connection: Upgrade\r\n"
 	headers += fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", base64.StdEncoding.EncodeToString(bs))
 	headers += "Sec-WebSocket-Version: 13\r\n"
+	if c.subprotocol != "" {
+		headers += fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", c.subprotocol)
+	}
+
+	// 协商permessage-deflate
+	if c.deflate = negotiateDeflate(request.Header.Values("Sec-WebSocket-Extensions"), c.options); c.deflate != nil {
+		headers += fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", c.deflate.header())
+	}
 	headers += "\r\n"
 
 	// 使用
-	n, err = c.push([]byte(headers))
+	_, err := c.push([]byte(headers))
 	return err
 }
 
-//Text 发送纯文本格式数据
-func (c *websocketProtocol) Text(bs []byte) (int, error) {
+//readData 握手请求之后已接收的数据（客户端未等待握手响应就发送了数据帧）先交给数据帧解析
+func (c *websocketProtocol) readData(bs []byte) (int, error) {
+	if len(c.httpBuffer) > 0 {
+		n := copy(bs, c.httpBuffer)
+		c.httpBuffer = c.httpBuffer[n:]
+		return n, nil
+	}
+	return c.BaseConnect.readData(bs)
+}
 
-	// 第一个字节
-	firstByte := uint8(1 | 128)
-	encode, err := c.encode(firstByte, bs)
-	if err != nil {
-		return 0, err
+//HasPending 握手之后还有已接收未解析的数据，或者协议探测时已读取未解析的数据
+func (c *websocketProtocol) HasPending() bool {
+	if c.ctx.Err() != nil {
+		return false
 	}
+	return c.isHandleShake && len(c.httpBuffer) > 0 || len(c.sniffData) > 0
+}
 
-	return c.push(encode)
+//Text 发送纯文本格式数据，先执行发送拦截器（msgID为0）
+func (c *websocketProtocol) Text(bs []byte) (int, error) {
+	return c.options.outbound.send(c.self, newOutboundMessage(0, bs, TEXTMODE), c.write)
 }
 
-//Binary 发送二进制格式数据
+//Binary 发送二进制格式数据，先执行发送拦截器（msgID为0）
 func (c *websocketProtocol) Binary(bs []byte) (int, error) {
-	firstByte := uint8(2 | 128)
-	encode, err := c.encode(firstByte, bs)
+	return c.options.outbound.send(c.self, newOutboundMessage(0, bs, BINMODE), c.write)
+}
+
+//Send 使用配置的信封封装后发送，未配置信封时不能使用，信封封装之前执行发送拦截器
+func (c *websocketProtocol) Send(msgID uint32, bs []byte) (int, error) {
+
+	envelope := c.options.WebsocketEnvelope
+	if envelope == nil {
+		return 0, util.WebsocketEnvelopeNotSet
+	}
+
+	opcode := uint8(TEXTMODE)
+	if envelope.IsBinary() {
+		opcode = BINMODE
+	}
+
+	return c.options.outbound.send(c.self, newOutboundMessage(msgID, bs, opcode), func(message iface.IMessage) (int, error) {
+		payload, err := envelope.Encode(message.ID(), message.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		return c.write(newOutboundMessage(message.ID(), payload, message.GetOpcode()))
+	})
+}
+
+//write 封装为数据帧后发送
+func (c *websocketProtocol) write(message iface.IMessage) (int, error) {
+
+	// 第一个字节
+	firstByte := message.GetOpcode() | 128
+	payload := message.Bytes()
+
+	// 协商了permessage-deflate时压缩，RSV1标记为已压缩，压缩的上下文需要和发送顺序一致
+	if deflate := c.deflate; deflate != nil && len(payload) >= deflate.threshold && (message.GetOpcode() == TEXTMODE || message.GetOpcode() == BINMODE) {
+		deflate.Lock()
+		defer deflate.Unlock()
+
+		compressed, err := deflate.compress(payload)
+		if err != nil {
+			return 0, err
+		}
+		firstByte |= 0x40
+		payload = compressed
+	}
+
+	encode, err := c.encode(firstByte, payload)
 	if err != nil {
 		return 0, err
 	}
+
 	return c.push(encode)
 }
 
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"encoding/binary"
+	"net/http"
 	"net/url"
 
 	"github.com/ikilobyte/netman/iface"
@@ -77,10 +78,11 @@ func (c *websocketProtocol) remove() {
 	// 从管理类中移除
 	c.GetConnectMgr().Remove(c)
 
+	// 取消连接的上下文
+	c.cancel()
+
 	// 关闭成功才执行
-	if c.hooks != nil {
-		c.hooks.OnClose(c) // tcp onclose
-	}
+	c.onClose() // tcp onclose
 
 	// websocket onclose ，握手成功才执行Close回调
 	if c.isHandleShake {
@@ -97,19 +99,23 @@ func (c *websocketProtocol) remove() {
 
 //CloseCode 内部关闭，并指定相关code
 func (c *websocketProtocol) CloseCode(code uint16, reason string) error {
-	data := bytes.NewBuffer([]byte{})
-	if err := binary.Write(data, binary.BigEndian, code); err != nil {
-		return err
-	}
 
-	// 写入reason
-	data.WriteString(reason)
+	// 握手完成后才能发送close帧，握手失败（如：认证失败）时直接关闭
+	if c.isHandleShake {
+		data := bytes.NewBuffer([]byte{})
+		if err := binary.Write(data, binary.BigEndian, code); err != nil {
+			return err
+		}
 
-	firstByte := uint8(8 | 128)
-	encode, _ := c.encode(firstByte, data.Bytes())
+		// 写入reason
+		data.WriteString(reason)
 
-	// 推送数据
-	_, _ = c.push(encode)
+		firstByte := uint8(8 | 128)
+		encode, _ := c.encode(firstByte, data.Bytes())
+
+		// 推送数据
+		_, _ = c.push(encode)
+	}
 
 	// 删除保存的数据
 	c.remove()
@@ -156,6 +162,40 @@ func (c *websocketProtocol) GetQueryStringParam() url.Values {
 	return c.query
 }
 
+//GetPath 握手请求的路径
+func (c *websocketProtocol) GetPath() string {
+	if c.request == nil {
+		return ""
+	}
+	return c.request.URL.Path
+}
+
+//GetHeader 握手请求的header
+func (c *websocketProtocol) GetHeader() http.Header {
+	if c.request == nil {
+		return make(http.Header)
+	}
+	return c.request.Header
+}
+
+//GetCookie 握手请求中的cookie，不存在时返回http.ErrNoCookie
+func (c *websocketProtocol) GetCookie(name string) (*http.Cookie, error) {
+	if c.request == nil {
+		return nil, http.ErrNoCookie
+	}
+	return c.request.Cookie(name)
+}
+
+//GetSubprotocol 握手时协商的子协议，未协商时为空
+func (c *websocketProtocol) GetSubprotocol() string {
+	return c.subprotocol
+}
+
+//IsWebsocket 实现iface.IWebsocketConnect
+func (c *websocketProtocol) IsWebsocket() bool {
+	return true
+}
+
 //verifyCloseCode 验证code是否在范围内
 func (c *websocketProtocol) verifyCloseCode(code uint16) error {
 
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ikilobyte/netman/util"
+)
+
+const (
+	deflateWindowSize       = 1 << 15  // 最大窗口（32KB），解压时保留这么多数据作为下一个消息的字典
+	defaultMaxInflateLength = 16 << 20 // 未配置MaxBodyLength时解压后的最大长度
+)
+
+//deflateTail 压缩时去掉的同步标记，再加上一个空的最后块，解压时可以正常读取到EOF
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+//websocketDeflate 握手时协商成功的permessage-deflate（RFC 7692），每个连接一个
+type websocketDeflate struct {
+	sync.Mutex                            // 压缩的上下文需要按发送顺序使用，压缩和发送期间加锁
+	level                   int           // 压缩级别
+	threshold               int           // 长度不小于这个值的消息才压缩
+	serverNoContextTakeover bool          // 每个消息单独压缩
+	clientNoContextTakeover bool          // 客户端每个消息单独压缩，解压时不需要保留字典
+	clientMaxWindowBits     int           // 回复给客户端的client_max_window_bits，0时不回复
+	buffer                  *bytes.Buffer // 压缩输出
+	writer                  *flate.Writer //
+	reader                  io.ReadCloser //
+	dict                    []byte        // 之前解压的数据，客户端保留上下文时作为字典
+}
+
+//checkWebsocketCompression 启动时检查permessage-deflate的配置
+func (o *Options) checkWebsocketCompression() error {
+	if !o.WebsocketCompression {
+		return nil
+	}
+	if o.WebsocketCompressLevel < flate.HuffmanOnly || o.WebsocketCompressLevel > flate.BestCompression {
+		return fmt.Errorf("invalid websocket compression level %d", o.WebsocketCompressLevel)
+	}
+	if bits := o.WebsocketDeflateParams.ClientMaxWindowBits; bits != 0 && (bits < 8 || bits > 15) {
+		return fmt.Errorf("invalid websocket client max window bits %d", bits)
+	}
+	return nil
+}
+
+//negotiateDeflate 从客户端的Sec-WebSocket-Extensions中选择第一个可以接受的permessage-deflate，都不接受时返回nil
+func negotiateDeflate(extensions []string, options *Options) *websocketDeflate {
+	if !options.WebsocketCompression {
+		return nil
+	}
+
+	for _, value := range extensions {
+		for _, offer := range strings.Split(value, ",") {
+			if deflate := acceptDeflateOffer(offer, options); deflate != nil {
+				return deflate
+			}
+		}
+	}
+	return nil
+}
+
+//acceptDeflateOffer 参数重复、未知或者值有误时不接受这个offer
+func acceptDeflateOffer(offer string, options *Options) *websocketDeflate {
+	fields := strings.Split(offer, ";")
+	if strings.TrimSpace(fields[0]) != "permessage-deflate" {
+		return nil
+	}
+
+	params := options.WebsocketDeflateParams
+	deflate := &websocketDeflate{
+		level:                   options.WebsocketCompressLevel,
+		threshold:               options.WebsocketCompressMin,
+		serverNoContextTakeover: params.ServerNoContextTakeover,
+		clientNoContextTakeover: params.ClientNoContextTakeover,
+	}
+
+	seen := make(map[string]bool)
+	for _, field := range fields[1:] {
+		name, value := strings.TrimSpace(field), ""
+		if index := strings.Index(name, "="); index >= 0 {
+			name, value = strings.TrimSpace(name[:index]), strings.Trim(strings.TrimSpace(name[index+1:]), `"`)
+		}
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+
+		switch name {
+		case "server_no_context_takeover":
+			if value != "" {
+				return nil
+			}
+			deflate.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if value != "" {
+				return nil
+			}
+			deflate.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			// 压缩使用的flate固定为32KB窗口，客户端要求更小的窗口时无法满足
+			if bits, ok := parseWindowBits(value); !ok || bits != 15 {
+				return nil
+			}
+		case "client_max_window_bits":
+			// 客户端声明支持这个参数后，才能要求客户端使用更小的窗口，不能超过客户端给出的值
+			bits := 15
+			if value != "" {
+				var ok bool
+				if bits, ok = parseWindowBits(value); !ok {
+					return nil
+				}
+			}
+			if params.ClientMaxWindowBits > 0 {
+				if params.ClientMaxWindowBits < bits {
+					bits = params.ClientMaxWindowBits
+				}
+				deflate.clientMaxWindowBits = bits
+			}
+		default:
+			return nil
+		}
+	}
+	return deflate
+}
+
+//parseWindowBits 窗口大小取值范围：8~15
+func parseWindowBits(value string) (int, bool) {
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 8 || bits > 15 || (len(value) > 1 && value[0] == '0') {
+		return 0, false
+	}
+	return bits, true
+}
+
+//header 握手响应中的Sec-WebSocket-Extensions
+func (d *websocketDeflate) header() string {
+	header := "permessage-deflate"
+	if d.serverNoContextTakeover {
+		header += "; server_no_context_takeover"
+	}
+	if d.clientNoContextTakeover {
+		header += "; client_no_context_takeover"
+	}
+	if d.clientMaxWindowBits > 0 {
+		header += fmt.Sprintf("; client_max_window_bits=%d", d.clientMaxWindowBits)
+	}
+	return header
+}
+
+//compress 压缩一个消息，去掉末尾的同步标记（0x00 0x00 0xff 0xff），调用方需要加锁
+func (d *websocketDeflate) compress(data []byte) ([]byte, error) {
+	if d.writer == nil {
+		d.buffer = bytes.NewBuffer([]byte{})
+		writer, err := flate.NewWriter(d.buffer, d.level)
+		if err != nil {
+			return nil, err
+		}
+		d.writer = writer
+	} else if d.serverNoContextTakeover {
+		d.buffer.Reset()
+		d.writer.Reset(d.buffer)
+	}
+
+	if _, err := d.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := d.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	output := d.buffer.Bytes()
+	compressed := append([]byte{}, output[:len(output)-4]...)
+	d.buffer.Reset()
+	return compressed, nil
+}
+
+//decompress 解压一个消息，超过maxLength时返回util.BodyLenExceedLimit，避免解压炸弹
+func (d *websocketDeflate) decompress(data []byte, maxLength uint32) ([]byte, error) {
+	input := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail))
+	if d.reader == nil {
+		d.reader = flate.NewReaderDict(input, d.dict)
+	} else if err := d.reader.(flate.Resetter).Reset(input, d.dict); err != nil {
+		return nil, util.DecompressFail
+	}
+
+	output, err := ioutil.ReadAll(io.LimitReader(d.reader, int64(maxLength)+1))
+	if err != nil {
+		return nil, util.DecompressFail
+	}
+	if len(output) > int(maxLength) {
+		return nil, util.BodyLenExceedLimit
+	}
+
+	// 客户端保留上下文时，之后的消息可以引用之前32KB的数据
+	if !d.clientNoContextTakeover {
+		d.dict = append(d.dict, output...)
+		if len(d.dict) > deflateWindowSize {
+			d.dict = append([]byte{}, d.dict[len(d.dict)-deflateWindowSize:]...)
+		}
+	}
+	return output, nil
+}
+
+//maxInflateLength 解压后的最大长度，与MaxBodyLength相同
+func (c *websocketProtocol) maxInflateLength() uint32 {
+	if c.options.MaxBodyLength > 0 {
+		return c.options.MaxBodyLength
+	}
+	return defaultMaxInflateLength
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+//websocketTestFrame 客户端发送的帧，使用掩码
+func websocketTestFrame(final, rsv1 bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if final {
+		first |= 0x80
+	}
+	if rsv1 {
+		first |= 0x40
+	}
+
+	frame := []byte{first}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 65535:
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		panic("payload too large")
+	}
+
+	masks := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, masks...)
+	for i, b := range payload {
+		frame = append(frame, b^masks[i%4])
+	}
+	return frame
+}
+
+//newWebsocketTestConnect 已完成握手的连接，frames作为已接收的数据，读取完后返回EBADF
+func newWebsocketTestConnect(deflate *websocketDeflate, frames []byte, opts ...Option) *websocketProtocol {
+	options := parseOption(opts...)
+	base := newBaseConnect(1, -1, &net.TCPAddr{}, options)
+	c := newProtocol(base, common.WebsocketMode, nil).(*websocketProtocol)
+	c.isHandleShake = true
+	c.deflate = deflate
+	c.sniffData = frames
+	return c
+}
+
+//websocketTestDecode 解码所有消息，数据读取完时结束
+func websocketTestDecode(c *websocketProtocol) ([]string, error) {
+	messages := make([]string, 0)
+	for {
+		message, err := c.DecodePacket()
+		if err == syscall.EAGAIN {
+			continue
+		}
+		if err == unix.EBADF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+		if message != nil {
+			messages = append(messages, message.String())
+		}
+	}
+}
+
+//websocketTestCompress 使用保留上下文的压缩器压缩多个消息，模拟客户端
+func websocketTestCompress(t *testing.T, noContextTakeover bool, messages ...string) [][]byte {
+	t.Helper()
+	client := &websocketDeflate{level: flate.BestCompression, serverNoContextTakeover: noContextTakeover}
+	result := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		compressed, err := client.compress([]byte(message))
+		if err != nil {
+			t.Fatalf("compress：%v", err)
+		}
+		result = append(result, compressed)
+	}
+	return result
+}
+
+func TestWebsocketDeflateFrames(t *testing.T) {
+	text := strings.Repeat("hello websocket ", 8)
+	compressed := websocketTestCompress(t, true, text)[0]
+	large := websocketTestCompress(t, true, strings.Repeat("a", 2048))[0]
+	exact := websocketTestCompress(t, true, strings.Repeat("a", 1024))[0]
+
+	tests := []struct {
+		name    string
+		deflate bool
+		max     uint32
+		frames  [][]byte
+		want    []string
+		err     error
+	}{
+		{"compressed text", true, 0, [][]byte{websocketTestFrame(true, true, TEXTMODE, compressed)}, []string{text}, nil},
+		{"compressed binary", true, 0, [][]byte{websocketTestFrame(true, true, BINMODE, compressed)}, []string{text}, nil},
+		{"uncompressed with deflate", true, 0, [][]byte{websocketTestFrame(true, false, TEXTMODE, []byte("plain"))}, []string{"plain"}, nil},
+		{"compressed fragments", true, 0, [][]byte{
+			websocketTestFrame(false, true, TEXTMODE, compressed[:5]),
+			websocketTestFrame(true, false, CONTINUATION, compressed[5:]),
+		}, []string{text}, nil},
+		{"ping between fragments", true, 0, [][]byte{
+			websocketTestFrame(false, true, TEXTMODE, compressed[:5]),
+			websocketTestFrame(false, false, CONTINUATION, compressed[5:10]),
+			websocketTestFrame(true, false, CONTINUATION, compressed[10:]),
+		}, []string{text}, nil},
+		{"rsv1 on continuation", true, 0, [][]byte{
+			websocketTestFrame(false, true, TEXTMODE, compressed[:5]),
+			websocketTestFrame(true, true, CONTINUATION, compressed[5:]),
+		}, []string{}, util.WebsocketRsvFail},
+		{"rsv1 on uncompressed continuation", true, 0, [][]byte{
+			websocketTestFrame(false, false, TEXTMODE, []byte("a")),
+			websocketTestFrame(true, true, CONTINUATION, []byte("b")),
+		}, []string{}, util.WebsocketRsvFail},
+		{"rsv1 without deflate", false, 0, [][]byte{websocketTestFrame(true, true, TEXTMODE, compressed)}, []string{}, util.WebsocketRsvFail},
+		{"rsv1 on ping", true, 0, [][]byte{websocketTestFrame(true, true, PING, nil)}, []string{}, util.WebsocketRsvFail},
+		{"invalid compressed data", true, 0, [][]byte{websocketTestFrame(true, true, BINMODE, []byte{0xff, 0xff, 0xff})}, []string{}, util.DecompressFail},
+		{"decompression cap", true, 1024, [][]byte{websocketTestFrame(true, true, BINMODE, large)}, []string{}, util.BodyLenExceedLimit},
+		{"decompression cap exact", true, 1024, [][]byte{websocketTestFrame(true, true, BINMODE, exact)}, []string{strings.Repeat("a", 1024)}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deflate *websocketDeflate
+			if tt.deflate {
+				deflate = &websocketDeflate{level: flate.DefaultCompression, clientNoContextTakeover: true}
+			}
+			c := newWebsocketTestConnect(deflate, bytes.Join(tt.frames, nil), WithMaxBodyLength(tt.max))
+
+			messages, err := websocketTestDecode(c)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if len(messages) != len(tt.want) {
+				t.Fatalf("messages = %q, want %q", messages, tt.want)
+			}
+			for i := range messages {
+				if messages[i] != tt.want[i] {
+					t.Fatalf("messages = %q, want %q", messages, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebsocketDeflateContextTakeover(t *testing.T) {
+	text := strings.Repeat("context takeover ", 16)
+
+	// 客户端保留上下文时，第二个消息引用第一个消息的数据，压缩后更小，解压时需要保留之前的数据
+	takeover := websocketTestCompress(t, false, text, text)
+	if len(takeover[1]) >= len(takeover[0]) {
+		t.Fatalf("second message is not smaller：%d >= %d", len(takeover[1]), len(takeover[0]))
+	}
+
+	server := &websocketDeflate{}
+	for i, compressed := range takeover {
+		output, err := server.decompress(compressed, 1<<20)
+		if err != nil || string(output) != text {
+			t.Fatalf("message %d：%q %v", i, output, err)
+		}
+	}
+
+	// 协商了client_no_context_takeover时不保留之前的数据，引用之前数据的消息无法解压
+	server = &websocketDeflate{clientNoContextTakeover: true}
+	if _, err := server.decompress(takeover[0], 1<<20); err != nil {
+		t.Fatalf("first message：%v", err)
+	}
+	if output, err := server.decompress(takeover[1], 1<<20); err == nil && string(output) == text {
+		t.Fatalf("message referencing the previous context is decompressed without it")
+	}
+
+	// 客户端每个消息单独压缩
+	server = &websocketDeflate{clientNoContextTakeover: true}
+	for i, compressed := range websocketTestCompress(t, true, text, text) {
+		output, err := server.decompress(compressed, 1<<20)
+		if err != nil || string(output) != text {
+			t.Fatalf("no context takeover message %d：%q %v", i, output, err)
+		}
+	}
+
+	// 服务端每个消息单独压缩时，客户端不保留上下文也可以解压
+	sender := &websocketDeflate{level: flate.DefaultCompression, serverNoContextTakeover: true}
+	for i := 0; i < 2; i++ {
+		compressed, err := sender.compress([]byte(text))
+		if err != nil {
+			t.Fatalf("compress：%v", err)
+		}
+		output, err := (&websocketDeflate{clientNoContextTakeover: true}).decompress(compressed, 1<<20)
+		if err != nil || string(output) != text {
+			t.Fatalf("server no context takeover message %d：%q %v", i, output, err)
+		}
+	}
+}
+
+func TestWebsocketDeflateDecompressLimit(t *testing.T) {
+	compressed := websocketTestCompress(t, true, strings.Repeat("a", 4096))[0]
+
+	tests := []struct {
+		name string
+		max  uint32
+		err  error
+	}{
+		{"below", 4095, util.BodyLenExceedLimit},
+		{"exact", 4096, nil},
+		{"above", 4097, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, err := (&websocketDeflate{clientNoContextTakeover: true}).decompress(compressed, tt.max)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && len(output) != 4096 {
+				t.Fatalf("output length = %d", len(output))
+			}
+		})
+	}
+
+	// 默认限制
+	c := newWebsocketTestConnect(nil, nil)
+	if c.maxInflateLength() != defaultMaxInflateLength {
+		t.Fatalf("default max inflate length = %d", c.maxInflateLength())
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		params     DeflateParams
+		want       string // 空字符串表示不接受
+	}{
+		{"plain", []string{"permessage-deflate"}, DeflateParams{}, "permessage-deflate"},
+		{"other extension", []string{"x-webkit-deflate-frame"}, DeflateParams{}, ""},
+		{"server no context takeover", []string{"permessage-deflate; server_no_context_takeover"}, DeflateParams{}, "permessage-deflate; server_no_context_takeover"},
+		{"client no context takeover", []string{"permessage-deflate; client_no_context_takeover"}, DeflateParams{}, "permessage-deflate; client_no_context_takeover"},
+		{"server params", []string{"permessage-deflate"}, DeflateParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}, "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{"no context takeover value", []string{"permessage-deflate; server_no_context_takeover=1"}, DeflateParams{}, ""},
+		{"duplicate param", []string{"permessage-deflate; server_no_context_takeover; server_no_context_takeover"}, DeflateParams{}, ""},
+		{"unknown param", []string{"permessage-deflate; unknown"}, DeflateParams{}, ""},
+		{"server max window bits 15", []string{"permessage-deflate; server_max_window_bits=15"}, DeflateParams{}, "permessage-deflate"},
+		{"server max window bits smaller", []string{"permessage-deflate; server_max_window_bits=10"}, DeflateParams{}, ""},
+		{"client max window bits not required", []string{"permessage-deflate; client_max_window_bits"}, DeflateParams{}, "permessage-deflate"},
+		{"client max window bits not declared", []string{"permessage-deflate"}, DeflateParams{ClientMaxWindowBits: 10}, "permessage-deflate"},
+		{"client max window bits declared", []string{"permessage-deflate; client_max_window_bits"}, DeflateParams{ClientMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits=10"},
+		{"client max window bits smaller", []string{"permessage-deflate; client_max_window_bits=9"}, DeflateParams{ClientMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits=9"},
+		{"client max window bits larger", []string{"permessage-deflate; client_max_window_bits=12"}, DeflateParams{ClientMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits=10"},
+		{"client max window bits quoted", []string{`permessage-deflate; client_max_window_bits="12"`}, DeflateParams{ClientMaxWindowBits: 10}, "permessage-deflate; client_max_window_bits=10"},
+		{"client max window bits invalid", []string{"permessage-deflate; client_max_window_bits=16"}, DeflateParams{ClientMaxWindowBits: 10}, ""},
+		{"client max window bits leading zero", []string{"permessage-deflate; client_max_window_bits=09"}, DeflateParams{ClientMaxWindowBits: 10}, ""},
+		{"first acceptable offer", []string{"permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits"}, DeflateParams{ClientMaxWindowBits: 12}, "permessage-deflate; client_max_window_bits=12"},
+		{"multiple headers", []string{"permessage-deflate; unknown", "permessage-deflate"}, DeflateParams{}, "permessage-deflate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := parseOption(WithWebsocketCompression(flate.DefaultCompression, 0), WithWebsocketDeflateParams(tt.params))
+			deflate := negotiateDeflate(tt.extensions, options)
+
+			got := ""
+			if deflate != nil {
+				got = deflate.header()
+			}
+			if got != tt.want {
+				t.Fatalf("header = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// 未开启压缩时不协商
+	if negotiateDeflate([]string{"permessage-deflate"}, parseOption()) != nil {
+		t.Fatalf("negotiated without WithWebsocketCompression")
+	}
+}
+
+func TestCheckWebsocketCompression(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"disabled", nil, true},
+		{"default", []Option{WithWebsocketCompression(flate.DefaultCompression, 0)}, true},
+		{"huffman only", []Option{WithWebsocketCompression(flate.HuffmanOnly, 0)}, true},
+		{"level too small", []Option{WithWebsocketCompression(flate.HuffmanOnly-1, 0)}, false},
+		{"level too large", []Option{WithWebsocketCompression(flate.BestCompression+1, 0)}, false},
+		{"window bits", []Option{WithWebsocketCompression(flate.DefaultCompression, 0), WithWebsocketDeflateParams(DeflateParams{ClientMaxWindowBits: 8})}, true},
+		{"window bits too small", []Option{WithWebsocketCompression(flate.DefaultCompression, 0), WithWebsocketDeflateParams(DeflateParams{ClientMaxWindowBits: 7})}, false},
+		{"window bits too large", []Option{WithWebsocketCompression(flate.DefaultCompression, 0), WithWebsocketDeflateParams(DeflateParams{ClientMaxWindowBits: 16})}, false},
+		{"params without compression", []Option{WithWebsocketDeflateParams(DeflateParams{ClientMaxWindowBits: 16})}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseOption(tt.opts...).checkWebsocketCompression()
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"io"
 	"syscall"
 	"unicode/utf8"
 
@@ -9,6 +10,12 @@ import (
 	"github.com/ikilobyte/netman/util"
 )
 
+//envelopeFailMessage 信封解析失败的消息，Dispatch时交给ErrorHandler处理，不会匹配路由
+type envelopeFailMessage struct {
+	*util.Message
+	err error
+}
+
 //nextFrame 读取帧数据
 func (c *websocketProtocol) nextFrame() (iface.IMessage, error) {
 
@@ -67,6 +74,23 @@ func (c *websocketProtocol) nextFrame() (iface.IMessage, error) {
 				c.continueBuffer = bytes.NewBuffer([]byte{})
 			}
 
+			// 超出接收速率限制的消息在解压之前丢弃
+			if opcode == CONTINUATION || opcode == TEXTMODE || opcode == BINMODE {
+				if err := c.BaseConnect.Allow(); err != nil {
+					return nil, c.dropMessage(err)
+				}
+			}
+
+			// 已压缩的消息，所有分帧合并后再解压
+			if c.compressed && (opcode == CONTINUATION || opcode == TEXTMODE || opcode == BINMODE) {
+				c.compressed = false
+				data, err := c.deflate.decompress(c.packetBuffer.Bytes(), c.maxInflateLength())
+				if err != nil {
+					return nil, err
+				}
+				c.packetBuffer = bytes.NewBuffer(data)
+			}
+
 			// 文本模式必须是UTF-8编码的，需要判断一个完整的包，而不是分帧
 			if c.messageMode == TEXTMODE && !utf8.Valid(c.packetBuffer.Bytes()) {
 				return nil, util.WebsocketMustUtf8
@@ -88,6 +112,16 @@ func (c *websocketProtocol) nextFrame() (iface.IMessage, error) {
 			// 继续重置状态
 			c.msgID += 1
 			c.packetBuffer = bytes.NewBuffer([]byte{})
+
+			// 从信封中解析出路由使用的msgID，解析失败的消息交给ErrorHandler处理
+			if envelope := c.options.WebsocketEnvelope; envelope != nil && (message.Opcode == TEXTMODE || message.Opcode == BINMODE) {
+				msgID, data, err := envelope.Decode(message.Data)
+				if err != nil {
+					return &envelopeFailMessage{Message: message, err: err}, nil
+				}
+				message.MsgID = msgID
+				message.SetData(data)
+			}
 			return message, nil
 		} else {
 
@@ -101,3 +135,26 @@ func (c *websocketProtocol) nextFrame() (iface.IMessage, error) {
 
 	return nil, syscall.EAGAIN
 }
+
+//dropMessage 丢弃超出接收速率限制的消息，客户端保留压缩上下文时仍需要解压，否则之后的消息无法解压
+func (c *websocketProtocol) dropMessage(err error) error {
+	if c.compressed && !c.deflate.clientNoContextTakeover {
+		if _, err := c.deflate.decompress(c.packetBuffer.Bytes(), c.maxInflateLength()); err != nil {
+			return err
+		}
+	}
+
+	c.compressed = false
+	c.messageMode = 0
+	c.msgID += 1
+	c.packetBuffer = bytes.NewBuffer([]byte{})
+	if err == io.EOF {
+		return io.EOF
+	}
+	return nil
+}
+
+//Allow 速率限制在DecodePacket中检查
+func (c *websocketProtocol) Allow() error {
+	return nil
+}
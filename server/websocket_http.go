@@ -0,0 +1,541 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ikilobyte/netman/util"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	maxHTTPHeaderLength      = 16 * 1024 // 请求行和header的最大长度，chunked编码的trailer也使用这个长度
+	maxHTTPChunkLine         = 4 * 1024  // chunked编码中一行（长度、trailer）的最大长度
+	defaultMaxHTTPBodyLength = 16 << 20  // 未配置MaxBodyLength时请求体的最大长度
+)
+
+//httpChunkedBody 不完整的chunked请求体，收到新的数据时从offset继续解析，已解析的chunk不再重复解析
+type httpChunkedBody struct {
+	body   []byte
+	offset int // 已解析的长度，从请求体开始计算
+}
+
+//httpError 解析请求出错时回复的状态码，回复后关闭连接
+type httpError struct {
+	status int
+	reason string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%d %s", e.status, e.reason)
+}
+
+//readHTTP 握手之前按HTTP/1.1解析请求，websocket升级请求完成握手，其它请求交给HTTPHandler按顺序处理
+//支持keep-alive、pipeline、chunked编码的请求体
+func (c *websocketProtocol) readHTTP() error {
+
+	// 缓冲区最多保存一个最大长度的请求，达到时先处理已完整的请求再继续读取，避免一次可读事件中无限增长
+	limit := maxHTTPHeaderLength + int(c.maxHTTPBodyLength())
+	buffer := make([]byte, 4096)
+	eof := false
+	for {
+		var full bool
+		full, eof = c.fillHTTPBuffer(buffer, limit)
+
+		upgraded, err := c.serveHTTPBuffer()
+		if err != nil || upgraded {
+			return err
+		}
+
+		// 客户端要求关闭后收到的数据都丢弃
+		if c.httpClosing {
+			c.httpBuffer = nil
+		}
+		if !full || c.httpClosing {
+			break
+		}
+
+		// 处理完已完整的请求后仍然达到最大长度，请求过大（如：chunked编码中大量很小的chunk）
+		if len(c.httpBuffer) >= limit {
+			util.Logger.Infof("websocket connect fd[%d] id[%d] http request exceeds %d bytes", c.fd, c.id, limit)
+			_, _ = c.push(httpErrorResponse(http.StatusRequestEntityTooLarge))
+			return io.EOF
+		}
+	}
+
+	if !eof {
+		return nil
+	}
+
+	// 客户端已关闭写入，处理完已接收的请求后关闭连接，暂停读取避免一直收到可读事件
+	c.httpLocker.Lock()
+	running := c.httpRunning
+	c.httpEOF = running
+	c.httpLocker.Unlock()
+
+	if running {
+		c.httpClosing = true
+		_ = c.GetPoller().PauseRead(c.fd, c.id)
+		return nil
+	}
+	return io.EOF
+}
+
+//fillHTTPBuffer 读取当前可读的数据，TLS层中可能还有已解密未读取的数据，缓冲区达到limit时停止读取
+//返回缓冲区是否已满、客户端是否已关闭
+func (c *websocketProtocol) fillHTTPBuffer(buffer []byte, limit int) (full bool, eof bool) {
+	for len(c.httpBuffer) < limit {
+		n, err := c.BaseConnect.readData(buffer)
+		if n > 0 {
+			c.httpBuffer = append(c.httpBuffer, buffer[:n]...)
+		}
+		if err != nil {
+			return false, err == io.EOF || err == unix.EBADF || err == unix.EPIPE
+		}
+		if n == 0 {
+			return false, false
+		}
+	}
+	return true, false
+}
+
+//serveHTTPBuffer 处理缓冲区中所有完整的请求，返回是否已升级为websocket
+func (c *websocketProtocol) serveHTTPBuffer() (bool, error) {
+	for !c.httpClosing {
+		request, err := c.parseHTTPRequest()
+		if err != nil {
+			if e, ok := err.(*httpError); ok {
+				_, _ = c.push(httpErrorResponse(e.status))
+			}
+			util.Logger.Infof("websocket connect fd[%d] id[%d] parse http request error：%v", c.fd, c.id, err)
+			return false, io.EOF
+		}
+
+		// 数据不完整
+		if request == nil {
+			break
+		}
+
+		// websocket升级请求
+		if isWebsocketUpgrade(request) {
+			if c.httpInFlight() {
+				util.Logger.Infof("websocket connect fd[%d] id[%d] upgrade request after pipelined http requests", c.fd, c.id)
+				return false, io.EOF
+			}
+			if err := c.handleShake(request); err != nil {
+				return false, err
+			}
+			c.isHandleShake = true
+			// onopen
+			c.options.WebsocketHandler.Open(c)
+			return true, nil
+		}
+
+		// 没有配置HTTPHandler时只能升级为websocket
+		if c.options.HTTPHandler == nil {
+			util.Logger.Infof("websocket connect fd[%d] id[%d] %s %s is not an upgrade request", c.fd, c.id, request.Method, request.URL)
+			_, _ = c.push(httpErrorResponse(http.StatusUpgradeRequired, "Upgrade: websocket", "Sec-WebSocket-Version: 13"))
+			return false, io.EOF
+		}
+
+		// 客户端要求关闭时，不再处理之后的请求
+		if request.Close {
+			c.httpClosing = true
+		}
+		c.enqueueHTTP(request)
+	}
+	return false, nil
+}
+
+//parseHTTPRequest 从缓冲区中解析出一个完整的请求，数据不完整时返回nil
+func (c *websocketProtocol) parseHTTPRequest() (*http.Request, error) {
+
+	// 请求之间可以有空行
+	for bytes.HasPrefix(c.httpBuffer, []byte("\r\n")) {
+		c.httpBuffer = c.httpBuffer[2:]
+	}
+
+	index := bytes.Index(c.httpBuffer, []byte("\r\n\r\n"))
+	if index < 0 {
+		if len(c.httpBuffer) > maxHTTPHeaderLength {
+			return nil, &httpError{http.StatusRequestHeaderFieldsTooLarge, "header too large"}
+		}
+		return nil, nil
+	}
+
+	headLength := index + 4
+	if headLength > maxHTTPHeaderLength {
+		return nil, &httpError{http.StatusRequestHeaderFieldsTooLarge, "header too large"}
+	}
+
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(c.httpBuffer[:headLength])))
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, err.Error()}
+	}
+
+	// 请求体
+	var (
+		body   []byte
+		length int
+	)
+	if len(request.TransferEncoding) > 0 && request.TransferEncoding[0] == "chunked" {
+		var complete bool
+		body, length, complete, err = c.decodeChunked(c.httpBuffer[headLength:])
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			c.continueHTTP(request)
+			return nil, nil
+		}
+	} else if request.ContentLength > 0 {
+		if request.ContentLength > int64(c.maxHTTPBodyLength()) {
+			return nil, &httpError{http.StatusRequestEntityTooLarge, "body too large"}
+		}
+		length = int(request.ContentLength)
+		if len(c.httpBuffer)-headLength < length {
+			c.continueHTTP(request)
+			return nil, nil
+		}
+		body = c.httpBuffer[headLength : headLength+length : headLength+length]
+	}
+
+	c.httpBuffer = c.httpBuffer[headLength+length:]
+	c.httpContinued = false
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	request.RemoteAddr = c.GetAddress().String()
+	if c.GetTLSEnable() {
+		state := c.tlsLayer.ConnectionState()
+		request.TLS = &state
+	}
+	return request.WithContext(c.Context()), nil
+}
+
+//continueHTTP 请求体不完整，客户端在等待100 Continue时回复
+func (c *websocketProtocol) continueHTTP(request *http.Request) {
+	if c.httpContinued || !strings.EqualFold(request.Header.Get("Expect"), "100-continue") {
+		return
+	}
+	c.httpContinued = true
+	_, _ = c.push([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+}
+
+//decodeChunked 解析chunked编码的请求体，返回请求体、使用的字节数、是否完整，trailer会被忽略
+//不完整时保存已解析的chunk，下次从上次的位置继续解析
+func (c *websocketProtocol) decodeChunked(buf []byte) ([]byte, int, bool, error) {
+
+	if c.httpChunked == nil {
+		c.httpChunked = &httpChunkedBody{body: make([]byte, 0)}
+	}
+	state := c.httpChunked
+
+	body := state.body
+	offset := state.offset
+	for {
+		index := bytes.Index(buf[offset:], []byte("\r\n"))
+		if index < 0 {
+			if len(buf)-offset > maxHTTPChunkLine {
+				return nil, 0, false, &httpError{http.StatusBadRequest, "chunk line too long"}
+			}
+			return nil, 0, false, nil
+		}
+
+		// 长度后面可以有扩展，如：1a;name=value
+		line := string(buf[offset : offset+index])
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseUint(strings.TrimSpace(line), 16, 31)
+		if err != nil {
+			return nil, 0, false, &httpError{http.StatusBadRequest, "invalid chunk size"}
+		}
+		offset += index + 2
+
+		// 最后一个chunk，之后是trailer，以空行结束
+		if size == 0 {
+			trailer := offset
+			for {
+				index := bytes.Index(buf[offset:], []byte("\r\n"))
+				if index < 0 {
+					if len(buf)-offset > maxHTTPChunkLine {
+						return nil, 0, false, &httpError{http.StatusBadRequest, "trailer too long"}
+					}
+					return nil, 0, false, nil
+				}
+				offset += index + 2
+				if index == 0 {
+					c.httpChunked = nil
+					return body, offset, true, nil
+				}
+				if offset-trailer > maxHTTPHeaderLength {
+					return nil, 0, false, &httpError{http.StatusRequestHeaderFieldsTooLarge, "trailer too large"}
+				}
+			}
+		}
+
+		if uint64(len(body))+size > uint64(c.maxHTTPBodyLength()) {
+			return nil, 0, false, &httpError{http.StatusRequestEntityTooLarge, "body too large"}
+		}
+
+		end := offset + int(size)
+		if len(buf) < end+2 {
+			return nil, 0, false, nil
+		}
+		if buf[end] != '\r' || buf[end+1] != '\n' {
+			return nil, 0, false, &httpError{http.StatusBadRequest, "invalid chunk data"}
+		}
+
+		body = append(body, buf[offset:end]...)
+		offset = end + 2
+		state.body = body
+		state.offset = offset
+	}
+}
+
+//maxHTTPBodyLength 请求体的最大长度，与MaxBodyLength相同
+func (c *websocketProtocol) maxHTTPBodyLength() uint32 {
+	if c.options.MaxBodyLength > 0 {
+		return c.options.MaxBodyLength
+	}
+	return defaultMaxHTTPBodyLength
+}
+
+//enqueueHTTP 同一个连接的请求按顺序处理，响应的顺序与请求一致
+func (c *websocketProtocol) enqueueHTTP(request *http.Request) {
+	c.httpLocker.Lock()
+	defer c.httpLocker.Unlock()
+
+	c.httpQueue = append(c.httpQueue, request)
+	if !c.httpRunning {
+		c.httpRunning = true
+		go c.serveHTTP()
+	}
+}
+
+//httpInFlight 是否有未处理完的请求
+func (c *websocketProtocol) httpInFlight() bool {
+	c.httpLocker.Lock()
+	defer c.httpLocker.Unlock()
+	return c.httpRunning
+}
+
+//serveHTTP 依次处理队列中的请求，不需要保持连接时处理完关闭连接
+func (c *websocketProtocol) serveHTTP() {
+	for {
+		c.httpLocker.Lock()
+		if len(c.httpQueue) == 0 {
+			c.httpRunning = false
+			closing := c.httpEOF
+			c.httpLocker.Unlock()
+
+			// 客户端已关闭写入
+			if closing {
+				_ = c.Close()
+			}
+			return
+		}
+		request := c.httpQueue[0]
+		c.httpQueue[0] = nil
+		c.httpQueue = c.httpQueue[1:]
+		c.httpLocker.Unlock()
+
+		if !c.handleHTTP(request) {
+			c.httpLocker.Lock()
+			c.httpQueue = nil
+			c.httpRunning = false
+			c.httpLocker.Unlock()
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+//handleHTTP 执行HTTPHandler并发送响应，返回是否保持连接
+func (c *websocketProtocol) handleHTTP(request *http.Request) (keepAlive bool) {
+
+	response := &httpResponse{header: make(http.Header)}
+
+	// handler出现panic时回复500
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			util.Logger.
+				WithField("stack", string(debug.Stack())).
+				Errorf("http handler %s %s panic: %v", request.Method, request.URL, recovered)
+			_, _ = c.push(httpErrorResponse(http.StatusInternalServerError))
+			keepAlive = false
+		}
+	}()
+
+	c.options.HTTPHandler.ServeHTTP(response, request)
+
+	keepAlive = !request.Close && !strings.EqualFold(response.header.Get("Connection"), "close")
+	if _, err := c.push(response.bytes(request, keepAlive)); err != nil {
+		return false
+	}
+	return keepAlive
+}
+
+//httpResponse 缓存handler的响应，handler返回后一次性发送，不支持Flush、Hijack
+type httpResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *httpResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *httpResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *httpResponse) Write(bs []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(bs)
+}
+
+//bytes 生成完整的响应，使用Content-Length
+func (r *httpResponse) bytes(request *http.Request, keepAlive bool) []byte {
+	r.WriteHeader(http.StatusOK)
+
+	// 1xx、204、304没有响应体
+	hasBody := r.status >= 200 && r.status != http.StatusNoContent && r.status != http.StatusNotModified
+	if hasBody {
+		if r.header.Get("Content-Type") == "" && r.body.Len() > 0 {
+			r.header.Set("Content-Type", http.DetectContentType(r.body.Bytes()))
+		}
+		r.header.Set("Content-Length", strconv.Itoa(r.body.Len()))
+	} else {
+		r.header.Del("Content-Length")
+	}
+
+	if r.header.Get("Date") == "" {
+		r.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if keepAlive {
+		r.header.Del("Connection")
+	} else {
+		r.header.Set("Connection", "close")
+	}
+
+	buff := bytes.NewBuffer([]byte{})
+	buff.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", r.status, http.StatusText(r.status)))
+	_ = r.header.Write(buff)
+	buff.WriteString("\r\n")
+
+	// HEAD请求只有header
+	if hasBody && request.Method != http.MethodHead {
+		buff.Write(r.body.Bytes())
+	}
+	return buff.Bytes()
+}
+
+//httpErrorResponse 解析请求出错、handler出现panic时的响应，之后会关闭连接
+func httpErrorResponse(status int, headers ...string) []byte {
+	text := http.StatusText(status)
+	extra := ""
+	for _, header := range headers {
+		extra += header + "\r\n"
+	}
+	return []byte(fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n%sConnection: close\r\n\r\n%s",
+		status, text, len(text), extra, text,
+	))
+}
+
+//isWebsocketUpgrade 是否为websocket升级请求，方法、版本等在握手时校验
+func isWebsocketUpgrade(request *http.Request) bool {
+	return headerContainsToken(request.Header, "Connection", "upgrade") &&
+		headerContainsToken(request.Header, "Upgrade", "websocket")
+}
+
+//checkUpgrade 校验升级请求（RFC 6455 4.2.1），版本不支持时回复426，Origin不允许时回复403，其它错误回复400
+func (c *websocketProtocol) checkUpgrade(request *http.Request, key string) *httpError {
+	if request.Method != http.MethodGet || !request.ProtoAtLeast(1, 1) {
+		return &httpError{http.StatusBadRequest, "upgrade request must be GET and HTTP/1.1"}
+	}
+
+	if strings.TrimSpace(request.Header.Get("Sec-WebSocket-Version")) != "13" {
+		return &httpError{http.StatusUpgradeRequired, "unsupported Sec-WebSocket-Version"}
+	}
+
+	// key是base64编码的16个字节
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return &httpError{http.StatusBadRequest, "invalid Sec-WebSocket-Key"}
+	}
+
+	if origin := request.Header.Get("Origin"); !c.options.allowOrigin(origin) {
+		return &httpError{http.StatusForbidden, fmt.Sprintf("origin %s not allowed", origin)}
+	}
+
+	if c.options.RequireSubprotocol && c.options.selectSubprotocol(request.Header.Values("Sec-WebSocket-Protocol")) == "" {
+		return &httpError{http.StatusBadRequest, "no supported Sec-WebSocket-Protocol"}
+	}
+	return nil
+}
+
+//allowOrigin 是否允许这个Origin，未配置时不限制，没有Origin（非浏览器客户端）时允许
+//支持*（所有）、https://*.example.com（子域名）
+func (o *Options) allowOrigin(origin string) bool {
+	if len(o.WebsocketOrigins) == 0 || origin == "" {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	for _, pattern := range o.WebsocketOrigins {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+
+		// 子域名，*只匹配域名部分
+		if index := strings.Index(pattern, "*."); index >= 0 {
+			prefix, suffix := pattern[:index], pattern[index+1:]
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//selectSubprotocol 按客户端的顺序选择第一个服务端支持的子协议，都不支持时为空（不回复Sec-WebSocket-Protocol）
+func (o *Options) selectSubprotocol(values []string) string {
+	for _, value := range values {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			for _, supported := range o.WebsocketSubprotocols {
+				if protocol == supported {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+//headerContainsToken header中逗号分隔的值是否包含token，不区分大小写
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ikilobyte/netman/common"
+	"golang.org/x/sys/unix"
+)
+
+func TestAllowOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{"not configured", nil, "https://evil.com", true},
+		{"missing origin", []string{"https://example.com"}, "", true},
+		{"exact", []string{"https://example.com"}, "https://example.com", true},
+		{"exact other host", []string{"https://example.com"}, "https://evil.com", false},
+		{"exact other scheme", []string{"https://example.com"}, "http://example.com", false},
+		{"exact other port", []string{"https://example.com"}, "https://example.com:8443", false},
+		{"case insensitive host", []string{"https://example.com"}, "https://EXAMPLE.com", true},
+		{"case insensitive pattern", []string{"https://Example.COM"}, "https://example.com", true},
+		{"any", []string{"*"}, "https://evil.com", true},
+		{"wildcard subdomain", []string{"https://*.example.com"}, "https://a.example.com", true},
+		{"wildcard nested subdomain", []string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{"wildcard case insensitive", []string{"https://*.example.com"}, "https://A.Example.com", true},
+		{"wildcard root domain", []string{"https://*.example.com"}, "https://example.com", false},
+		{"wildcard suffix attack", []string{"https://*.example.com"}, "https://evilexample.com", false},
+		{"wildcard other domain", []string{"https://*.example.com"}, "https://a.example.com.evil.com", false},
+		{"wildcard path", []string{"https://*.example.com"}, "https://evil.com/.example.com", false},
+		{"wildcard port", []string{"https://*.example.com"}, "https://evil.com:1.example.com", false},
+		{"multiple", []string{"https://a.com", "https://*.example.com"}, "https://b.example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseOption(WithWebsocketOrigins(tt.origins...)).allowOrigin(tt.origin); got != tt.want {
+				t.Fatalf("allowOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectSubprotocol(t *testing.T) {
+	tests := []struct {
+		name      string
+		supported []string
+		values    []string
+		want      string
+	}{
+		{"not configured", nil, []string{"chat.v1"}, ""},
+		{"not offered", []string{"chat.v1"}, nil, ""},
+		{"single", []string{"chat.v1"}, []string{"chat.v1"}, "chat.v1"},
+		{"client order", []string{"chat.v1", "chat.v2"}, []string{"chat.v2, chat.v1"}, "chat.v2"},
+		{"first supported", []string{"chat.v1"}, []string{"mqtt, chat.v1"}, "chat.v1"},
+		{"multiple headers", []string{"chat.v1"}, []string{"mqtt", "chat.v1"}, "chat.v1"},
+		{"spaces", []string{"chat.v1"}, []string{" mqtt ,  chat.v1 "}, "chat.v1"},
+		{"no overlap", []string{"chat.v1"}, []string{"mqtt, chat.v2"}, ""},
+		{"case sensitive", []string{"chat.v1"}, []string{"Chat.V1"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseOption(WithWebsocketSubprotocols(tt.supported...)).selectSubprotocol(tt.values); got != tt.want {
+				t.Fatalf("selectSubprotocol(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		method  string
+		headers map[string]string
+		status  int // 0表示校验通过
+	}{
+		{"ok", nil, http.MethodGet, nil, 0},
+		{"post", nil, http.MethodPost, nil, http.StatusBadRequest},
+		{"version", nil, http.MethodGet, map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"origin allowed", []Option{WithWebsocketOrigins("https://example.com")}, http.MethodGet, map[string]string{"Origin": "https://Example.com"}, 0},
+		{"origin wildcard", []Option{WithWebsocketOrigins("https://*.example.com")}, http.MethodGet, map[string]string{"Origin": "https://a.example.com"}, 0},
+		{"origin missing", []Option{WithWebsocketOrigins("https://example.com")}, http.MethodGet, nil, 0},
+		{"origin not allowed", []Option{WithWebsocketOrigins("https://example.com")}, http.MethodGet, map[string]string{"Origin": "https://evil.com"}, http.StatusForbidden},
+		{"subprotocol no overlap", []Option{WithWebsocketSubprotocols("chat.v1")}, http.MethodGet, map[string]string{"Sec-WebSocket-Protocol": "mqtt"}, 0},
+		{"required subprotocol", []Option{WithWebsocketSubprotocols("chat.v1"), WithRequireSubprotocol()}, http.MethodGet, map[string]string{"Sec-WebSocket-Protocol": "mqtt, chat.v1"}, 0},
+		{"required subprotocol no overlap", []Option{WithWebsocketSubprotocols("chat.v1"), WithRequireSubprotocol()}, http.MethodGet, map[string]string{"Sec-WebSocket-Protocol": "mqtt, chat.v2"}, http.StatusBadRequest},
+		{"required subprotocol not offered", []Option{WithWebsocketSubprotocols("chat.v1"), WithRequireSubprotocol()}, http.MethodGet, nil, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, "/ws", nil)
+			if err != nil {
+				t.Fatalf("new request：%v", err)
+			}
+			request.Header.Set("Sec-WebSocket-Version", "13")
+			for name, value := range tt.headers {
+				request.Header.Set(name, value)
+			}
+
+			c := newWebsocketTestConnect(nil, nil, tt.opts...)
+			status := 0
+			if err := c.checkUpgrade(request, key); err != nil {
+				status = err.status
+			}
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+//newHTTPTestConnect 使用socketpair的未握手连接，返回连接和对端的fd，对端用于发送请求、读取响应
+func newHTTPTestConnect(t *testing.T, opts ...Option) (*websocketProtocol, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair：%v", err)
+	}
+	t.Cleanup(func() {
+		_ = unix.Close(fds[0])
+		_ = unix.Close(fds[1])
+	})
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		t.Fatalf("set nonblock：%v", err)
+	}
+
+	// 连接没有poller，响应需要一次写入发送缓冲区
+	if err := unix.SetsockoptInt(fds[0], unix.SOL_SOCKET, unix.SO_SNDBUF, 1<<20); err != nil {
+		t.Fatalf("set sndbuf：%v", err)
+	}
+	timeout := unix.NsecToTimeval(int64(2 * time.Second))
+	if err := unix.SetsockoptTimeval(fds[1], unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		t.Fatalf("set timeout：%v", err)
+	}
+
+	base := newBaseConnect(1, fds[0], &net.TCPAddr{}, parseOption(opts...))
+	return newProtocol(base, common.WebsocketMode, nil).(*websocketProtocol), fds[1]
+}
+
+//httpTestSend 对端发送数据
+func httpTestSend(t *testing.T, fd int, data string) {
+	t.Helper()
+	for len(data) > 0 {
+		n, err := unix.Write(fd, []byte(data))
+		if err != nil {
+			t.Fatalf("write：%v", err)
+		}
+		data = data[n:]
+	}
+}
+
+//httpTestPeer 对端fd的读取
+type httpTestPeer int
+
+func (fd httpTestPeer) Read(p []byte) (int, error) {
+	n, err := unix.Read(int(fd), p)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+//httpTestResponses 对端读取count个响应，返回状态码和响应体
+func httpTestResponses(t *testing.T, fd int, count int) ([]int, []string) {
+	t.Helper()
+	reader := bufio.NewReader(httpTestPeer(fd))
+
+	statuses := make([]int, 0, count)
+	bodies := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("response %d：%v", i, err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		statuses = append(statuses, response.StatusCode)
+		bodies = append(bodies, string(body))
+	}
+	return statuses, bodies
+}
+
+//httpTestPathHandler 响应体为请求的路径和请求体
+var httpTestPathHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	_, _ = w.Write(append([]byte(r.URL.Path), body...))
+})
+
+func TestReadHTTPPipelining(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []string
+		bodies   []string
+	}{
+		{"get", []string{"GET /a HTTP/1.1\r\nHost: x\r\n\r\n"}, []string{"/a"}},
+		{"pipelined", []string{
+			"GET /a HTTP/1.1\r\nHost: x\r\n\r\n",
+			"POST /b HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc",
+			"POST /c HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nde\r\n1;ext=1\r\nf\r\n0\r\nTrailer: t\r\n\r\n",
+			"\r\nGET /d HTTP/1.1\r\nhost: x\r\n\r\n",
+		}, []string{"/a", "/babc", "/cdef", "/d"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, peer := newHTTPTestConnect(t, WithHTTPHandler(httpTestPathHandler))
+			httpTestSend(t, peer, strings.Join(tt.requests, ""))
+			if err := c.readHTTP(); err != nil {
+				t.Fatalf("readHTTP：%v", err)
+			}
+
+			// 响应的顺序与请求一致
+			statuses, bodies := httpTestResponses(t, peer, len(tt.bodies))
+			for i := range bodies {
+				if statuses[i] != http.StatusOK || bodies[i] != tt.bodies[i] {
+					t.Fatalf("response %d = %d %q, want %q", i, statuses[i], bodies[i], tt.bodies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseHTTPChunkedResume(t *testing.T) {
+	request := "POST /c HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n" + "4\r\ndefg\r\n" + "0\r\n\r\n" +
+		"GET /next HTTP/1.1\r\nHost: x\r\n\r\n"
+
+	// 每次收到size个字节，已解析的chunk保存在httpChunked中，不会重复解析
+	for _, size := range []int{1, 2, 7, 16, len(request)} {
+		c, _ := newHTTPTestConnect(t)
+		requests := make([]*http.Request, 0)
+		parsed := 0
+		for offset := 0; offset < len(request); offset += size {
+			end := offset + size
+			if end > len(request) {
+				end = len(request)
+			}
+			c.httpBuffer = append(c.httpBuffer, request[offset:end]...)
+
+			for {
+				r, err := c.parseHTTPRequest()
+				if err != nil {
+					t.Fatalf("size %d：%v", size, err)
+				}
+				if r == nil {
+					break
+				}
+				requests = append(requests, r)
+			}
+
+			if c.httpChunked != nil {
+				if c.httpChunked.offset < parsed {
+					t.Fatalf("size %d：chunk offset went back from %d to %d", size, parsed, c.httpChunked.offset)
+				}
+				parsed = c.httpChunked.offset
+			}
+		}
+
+		if len(requests) != 2 || requests[1].URL.Path != "/next" {
+			t.Fatalf("size %d：requests = %d", size, len(requests))
+		}
+		if body, _ := ioutil.ReadAll(requests[0].Body); string(body) != "abcdefg" {
+			t.Fatalf("size %d：body = %q", size, body)
+		}
+		if c.httpChunked != nil || len(c.httpBuffer) != 0 {
+			t.Fatalf("size %d：state is not reset", size)
+		}
+	}
+}
+
+func TestReadHTTPLimit(t *testing.T) {
+	const maxBody = 16
+	limit := maxHTTPHeaderLength + maxBody
+	chunked := "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	// 长度前面补0，一个字节的chunk占用约4KB，请求体没有超过限制，但是整个请求超过了缓冲区的最大长度
+	padded := strings.Repeat("0", maxHTTPChunkLine-16) + "1\r\nx\r\n"
+
+	tests := []struct {
+		name   string
+		data   string
+		status int
+	}{
+		{"content length too large", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 17\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"chunked body too large", chunked + "11\r\n" + strings.Repeat("x", 17) + "\r\n0\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"header too large", "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", maxHTTPHeaderLength) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"chunk overhead exceeds buffer", chunked + strings.Repeat(padded, limit/len(padded)+2), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, peer := newHTTPTestConnect(t, WithHTTPHandler(httpTestPathHandler), WithMaxBodyLength(maxBody))
+			httpTestSend(t, peer, tt.data)
+			if err := c.readHTTP(); err != io.EOF {
+				t.Fatalf("readHTTP = %v, want EOF", err)
+			}
+			if len(c.httpBuffer) > limit+4096 {
+				t.Fatalf("buffer grew to %d bytes", len(c.httpBuffer))
+			}
+			if statuses, _ := httpTestResponses(t, peer, 1); statuses[0] != tt.status {
+				t.Fatalf("status = %d, want %d", statuses[0], tt.status)
+			}
+		})
+	}
+
+	// 多个请求的总长度超过缓冲区的最大长度时，处理完已完整的请求后继续读取
+	c, peer := newHTTPTestConnect(t, WithHTTPHandler(httpTestPathHandler), WithMaxBodyLength(maxBody))
+	count := limit/len("GET /r HTTP/1.1\r\nHost: x\r\n\r\n") + 100
+	httpTestSend(t, peer, strings.Repeat("GET /r HTTP/1.1\r\nHost: x\r\n\r\n", count))
+	if err := c.readHTTP(); err != nil {
+		t.Fatalf("readHTTP：%v", err)
+	}
+	statuses, _ := httpTestResponses(t, peer, count)
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Fatalf("response %d status = %d", i, status)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package util
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//BodyStream 流式路由的包体，事件循环写入，路由读取，未读取的数据超过limit时暂停读取连接
+type BodyStream struct {
+	locker   sync.Mutex
+	cond     *sync.Cond
+	chunks   [][]byte // 未读取的数据
+	current  []byte   // Read未读取完的一块数据
+	buffered int      // 未读取的字节数
+	limit    int      // 未读取的字节数达到这个值时暂停读取连接
+	length   int      // 包体总长度
+	err      error    // 写入结束后返回的错误，数据完整时为io.EOF
+	closed   bool     // 已调用Close，之后写入的数据直接丢弃
+	paused   bool     // 是否已暂停读取连接
+	pause    func()   // 暂停读取连接
+	resume   func()   // 恢复读取连接
+}
+
+//NewBodyStream pause和resume在持有锁时调用，不能再调用BodyStream的方法
+func NewBodyStream(length, limit int, pause, resume func()) *BodyStream {
+	s := &BodyStream{
+		chunks: make([][]byte, 0),
+		limit:  limit,
+		length: length,
+		pause:  pause,
+		resume: resume,
+	}
+	s.cond = sync.NewCond(&s.locker)
+	return s
+}
+
+//BytesBody 已完整接收的包体，UDP或者IStreamDecoder解码的消息交给流式路由时使用
+func BytesBody(data []byte) *BodyStream {
+	s := NewBodyStream(len(data), 0, nil, nil)
+	if len(data) > 0 {
+		s.chunks = append(s.chunks, data)
+		s.buffered = len(data)
+	}
+	s.err = io.EOF
+	return s
+}
+
+//Write 写入一块数据，Close之后写入的数据直接丢弃
+func (s *BodyStream) Write(chunk []byte) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.closed || s.err != nil {
+		return
+	}
+
+	s.chunks = append(s.chunks, chunk)
+	s.buffered += len(chunk)
+	s.cond.Broadcast()
+}
+
+//Full 未读取的数据达到限制时暂停读取连接，返回true
+//暂停后连接可能因为其它原因恢复了读事件（如：发送完数据），所以每次都需要暂停
+func (s *BodyStream) Full() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.closed || s.limit <= 0 || s.buffered < s.limit {
+		return false
+	}
+
+	s.paused = true
+	if s.pause != nil {
+		s.pause()
+	}
+	return true
+}
+
+//Finish 写入结束，err为nil表示数据完整
+func (s *BodyStream) Finish(err error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.err != nil {
+		return
+	}
+
+	if err == nil {
+		err = io.EOF
+	}
+	s.err = err
+	s.cond.Broadcast()
+}
+
+//Next 按接收的顺序读取一块数据，没有数据时等待
+func (s *BodyStream) Next() ([]byte, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for len(s.chunks) == 0 && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		return nil, io.ErrClosedPipe
+	}
+
+	if len(s.chunks) == 0 {
+		return nil, s.err
+	}
+
+	chunk := s.chunks[0]
+	s.chunks[0] = nil
+	s.chunks = s.chunks[1:]
+	s.buffered -= len(chunk)
+
+	// 低于限制后恢复读取
+	if s.paused && s.buffered < s.limit {
+		s.paused = false
+		if s.resume != nil {
+			s.resume()
+		}
+	}
+
+	return chunk, nil
+}
+
+//Read 实现io.Reader
+func (s *BodyStream) Read(p []byte) (int, error) {
+	if len(s.current) == 0 {
+		chunk, err := s.Next()
+		if err != nil {
+			return 0, err
+		}
+		s.current = chunk
+	}
+
+	n := copy(p, s.current)
+	s.current = s.current[n:]
+	return n, nil
+}
+
+//Close 丢弃未读取的数据，连接会继续读取直到包体结束，路由执行完后会自动调用
+func (s *BodyStream) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	s.chunks = nil
+	s.buffered = 0
+	if s.paused {
+		s.paused = false
+		if s.resume != nil {
+			s.resume()
+		}
+	}
+	s.cond.Broadcast()
+	return nil
+}
+
+//Len 包体总长度
+func (s *BodyStream) Len() int {
+	return s.length
+}
+
+//StreamMessage 流式路由的消息，Bytes为空，包体通过Body读取
+type StreamMessage struct {
+	iface.IMessage
+	body *BodyStream
+}
+
+func NewStreamMessage(message iface.IMessage, body *BodyStream) *StreamMessage {
+	return &StreamMessage{
+		IMessage: message,
+		body:     body,
+	}
+}
+
+//Body 包体数据流
+func (m *StreamMessage) Body() *BodyStream {
+	return m.body
+}
+
+//Close 丢弃未读取的数据，消息没有交给流式路由处理时（如：限流、未认证）调用
+func (m *StreamMessage) Close() error {
+	return m.body.Close()
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestBodyStreamBackpressure(t *testing.T) {
+	type step struct {
+		op      string // write、full、next、close
+		n       int    // write写入的字节数
+		full    bool   // full的返回值
+		paused  int    // 执行后暂停读取的次数
+		resumed int    // 执行后恢复读取的次数
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		steps []step
+	}{
+		{"under limit", 4, []step{
+			{op: "write", n: 3},
+			{op: "full"},
+			{op: "next"},
+		}},
+		{"pause at limit", 4, []step{
+			{op: "write", n: 2},
+			{op: "write", n: 2},
+			{op: "full", full: true, paused: 1},
+			{op: "next", paused: 1, resumed: 1},
+			{op: "full", paused: 1, resumed: 1},
+		}},
+		{"pause on every full", 4, []step{
+			{op: "write", n: 4},
+			{op: "full", full: true, paused: 1},
+			{op: "full", full: true, paused: 2},
+			{op: "next", paused: 2, resumed: 1},
+		}},
+		{"resume below limit", 4, []step{
+			{op: "write", n: 4},
+			{op: "write", n: 4},
+			{op: "full", full: true, paused: 1},
+			{op: "next", paused: 1},
+			{op: "next", paused: 1, resumed: 1},
+		}},
+		{"not paused", 4, []step{
+			{op: "write", n: 8},
+			{op: "next"},
+		}},
+		{"close resumes", 4, []step{
+			{op: "write", n: 4},
+			{op: "full", full: true, paused: 1},
+			{op: "close", paused: 1, resumed: 1},
+			{op: "write", n: 4, paused: 1, resumed: 1},
+			{op: "full", paused: 1, resumed: 1},
+		}},
+		{"no limit", 0, []step{
+			{op: "write", n: 100},
+			{op: "full"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paused, resumed := 0, 0
+			s := NewBodyStream(100, tt.limit, func() { paused++ }, func() { resumed++ })
+
+			for i, step := range tt.steps {
+				switch step.op {
+				case "write":
+					s.Write(make([]byte, step.n))
+				case "full":
+					if full := s.Full(); full != step.full {
+						t.Fatalf("step %d full = %v, want %v", i, full, step.full)
+					}
+				case "next":
+					if _, err := s.Next(); err != nil {
+						t.Fatalf("step %d next：%v", i, err)
+					}
+				case "close":
+					_ = s.Close()
+				}
+				if paused != step.paused || resumed != step.resumed {
+					t.Fatalf("step %d %s paused %d resumed %d, want %d %d", i, step.op, paused, resumed, step.paused, step.resumed)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyStreamRead(t *testing.T) {
+	errBroken := errors.New("broken")
+
+	tests := []struct {
+		name   string
+		chunks []string
+		finish error
+		want   string
+		err    error
+	}{
+		{"complete", []string{"ab", "", "cde"}, nil, "abcde", nil},
+		{"empty", nil, nil, "", nil},
+		{"broken", []string{"ab"}, errBroken, "ab", errBroken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewBodyStream(5, 0, nil, nil)
+
+			// 路由在写入之前开始读取，没有数据时等待
+			done := make(chan struct{})
+			var data []byte
+			var err error
+			go func() {
+				data, err = ioutil.ReadAll(s)
+				close(done)
+			}()
+
+			for _, chunk := range tt.chunks {
+				s.Write([]byte(chunk))
+			}
+			s.Finish(tt.finish)
+			<-done
+
+			if string(data) != tt.want || err != tt.err {
+				t.Fatalf("read %q %v, want %q %v", data, err, tt.want, tt.err)
+			}
+		})
+	}
+
+	// 已完整接收的包体
+	if data, err := ioutil.ReadAll(BytesBody([]byte("abc"))); err != nil || string(data) != "abc" {
+		t.Fatalf("bytes body %q %v", data, err)
+	}
+
+	// Close之后不能再读取，分块读取时保留未读取完的部分
+	s := NewBodyStream(6, 0, nil, nil)
+	s.Write([]byte("abcdef"))
+	buffer := make([]byte, 4)
+	if n, _ := s.Read(buffer); !bytes.Equal(buffer[:n], []byte("abcd")) {
+		t.Fatalf("read %q", buffer[:n])
+	}
+	if n, _ := s.Read(buffer); !bytes.Equal(buffer[:n], []byte("ef")) {
+		t.Fatalf("read %q", buffer[:n])
+	}
+	_ = s.Close()
+	if _, err := s.Next(); err != io.ErrClosedPipe {
+		t.Fatalf("next after close err = %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+//JSONCodec json编解码
+type JSONCodec struct{}
+
+func NewJSONCodec() *JSONCodec {
+	return &JSONCodec{}
+}
+
+func (c *JSONCodec) Name() string {
+	return "json"
+}
+
+func (c *JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+//GobCodec gob编解码，只适用于两端都是go的场景
+type GobCodec struct{}
+
+func NewGobCodec() *GobCodec {
+	return &GobCodec{}
+}
+
+func (c *GobCodec) Name() string {
+	return "gob"
+}
+
+func (c *GobCodec) Marshal(v interface{}) ([]byte, error) {
+	buff := bytes.NewBuffer([]byte{})
+	if err := gob.NewEncoder(buff).Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (c *GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+//gogoMessage protoc-gen-gogofast等gogo生成器生成的结构体都实现了这两个方法
+type gogoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+//GogoProtoCodec gogo protobuf编解码，结构体需要实现Marshal、Unmarshal方法，框架本身不依赖protobuf库
+//google.golang.org/protobuf生成的结构体没有这两个方法，需要自行实现iface.ICodec，使用proto.Marshal、proto.Unmarshal
+type GogoProtoCodec struct{}
+
+func NewGogoProtoCodec() *GogoProtoCodec {
+	return &GogoProtoCodec{}
+}
+
+func (c *GogoProtoCodec) Name() string {
+	return "gogoproto"
+}
+
+func (c *GogoProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(gogoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T not a gogo protobuf message", v)
+	}
+	return message.Marshal()
+}
+
+func (c *GogoProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(gogoMessage)
+	if !ok {
+		return fmt.Errorf("%T not a gogo protobuf message", v)
+	}
+	return message.Unmarshal(data)
+}
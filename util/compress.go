@@ -0,0 +1,286 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+const (
+	compressFlagRaw        uint8 = iota // 未压缩
+	compressFlagCompressed              // 已压缩
+)
+
+//defaultMaxDecompressLength 未配置MaxBodyLength时解压后的最大长度
+const defaultMaxDecompressLength = 16 << 20
+
+//FlateCompressor deflate压缩
+type FlateCompressor struct {
+	level int
+}
+
+//NewFlateCompressor level取值范围：flate.HuffmanOnly ~ flate.BestCompression
+func NewFlateCompressor(level int) *FlateCompressor {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		log.Panicf("invalid flate compression level %d", level)
+	}
+	return &FlateCompressor{level: level}
+}
+
+func (c *FlateCompressor) Name() string {
+	return "flate"
+}
+
+func (c *FlateCompressor) Compress(data []byte) ([]byte, error) {
+	buff := bytes.NewBuffer([]byte{})
+	writer, err := flate.NewWriter(buff, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (c *FlateCompressor) Decompress(data []byte, maxLength uint32) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return readLimit(reader, maxLength)
+}
+
+//GzipCompressor gzip压缩
+type GzipCompressor struct {
+	level int
+}
+
+//NewGzipCompressor level取值范围：gzip.HuffmanOnly ~ gzip.BestCompression
+func NewGzipCompressor(level int) *GzipCompressor {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		log.Panicf("invalid gzip compression level %d", level)
+	}
+	return &GzipCompressor{level: level}
+}
+
+func (c *GzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *GzipCompressor) Compress(data []byte) ([]byte, error) {
+	buff := bytes.NewBuffer([]byte{})
+	writer, err := gzip.NewWriterLevel(buff, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (c *GzipCompressor) Decompress(data []byte, maxLength uint32) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readLimit(reader, maxLength)
+}
+
+//readLimit 最多读取maxLength个字节，超过时返回BodyLenExceedLimit，避免解压炸弹
+func readLimit(reader io.Reader, maxLength uint32) ([]byte, error) {
+	if maxLength == 0 {
+		return ioutil.ReadAll(reader)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxLength)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > int(maxLength) {
+		return nil, BodyLenExceedLimit
+	}
+	return data, nil
+}
+
+//CompressPacker 压缩装饰器，包体超过阈值时压缩后交给被装饰的packer封包，解码时在路由之前自动解压
+//封包格式：被装饰的packer的包头 + flag(1字节，0：未压缩，1：已压缩) + data，标记在包体中，被装饰的packer不需要修改包头
+//被装饰的packer看到的包体比data多1个字节，它的MaxBodyLength会加1
+//MaxBodyLength限制的是解压后的长度，未配置时最大16MB，避免解压炸弹
+type CompressPacker struct {
+	packer        iface.IPacker     // 被装饰的packer
+	compressor    iface.ICompressor // 压缩算法，默认：flate
+	threshold     int               // 包体超过这个长度才压缩，默认：1024
+	maxBodyLength uint32            // 解压后的最大长度
+}
+
+type CompressOption = func(p *CompressPacker)
+
+//WithCompressor 压缩算法，默认：flate.DefaultCompression
+func WithCompressor(compressor iface.ICompressor) CompressOption {
+	return func(p *CompressPacker) {
+		p.compressor = compressor
+	}
+}
+
+//WithCompressThreshold 包体超过这个长度才压缩，默认：1024
+func WithCompressThreshold(threshold int) CompressOption {
+	return func(p *CompressPacker) {
+		p.threshold = threshold
+	}
+}
+
+//compressStreamPacker 被装饰的packer实现了IStreamDecoder
+type compressStreamPacker struct {
+	*CompressPacker
+	decoder iface.IStreamDecoder
+}
+
+//Decode 由被装饰的packer解码，解压在UnPackBody中处理
+func (p *compressStreamPacker) Decode(buf []byte) (int, []iface.IMessage, error) {
+	return p.decoder.Decode(buf)
+}
+
+//ResetDecode 被装饰的packer保存了解码状态时重置，如：DelimiterPacker
+func (p *compressStreamPacker) ResetDecode() {
+	if resetter, ok := p.decoder.(interface{ ResetDecode() }); ok {
+		resetter.ResetDecode()
+	}
+}
+
+//NewCompressPacker 装饰packer，被装饰的packer实现了IStreamDecoder时，返回值也实现了IStreamDecoder
+func NewCompressPacker(packer iface.IPacker, opts ...CompressOption) iface.IPacker {
+	p := &CompressPacker{
+		packer:     packer,
+		compressor: NewFlateCompressor(flate.DefaultCompression),
+		threshold:  1024,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if decoder, ok := packer.(iface.IStreamDecoder); ok {
+		return &compressStreamPacker{
+			CompressPacker: p,
+			decoder:        decoder,
+		}
+	}
+	return p
+}
+
+//Clone 被装饰的packer实现了IPackerCloner时，每个连接使用Clone出来的packer
+func (p *CompressPacker) Clone() iface.IPacker {
+	packer := p.packer
+	if cloner, ok := packer.(iface.IPackerCloner); ok {
+		packer = cloner.Clone()
+	}
+
+	clone := NewCompressPacker(packer, WithCompressor(p.compressor), WithCompressThreshold(p.threshold))
+	if p.maxBodyLength > 0 {
+		clone.SetMaxBodyLength(p.maxBodyLength)
+	}
+	return clone
+}
+
+//SetMaxBodyLength 解压后的最大长度，被装饰的packer多出1个字节的标记
+func (p *CompressPacker) SetMaxBodyLength(maxBodyLength uint32) {
+	p.maxBodyLength = maxBodyLength
+	if maxBodyLength > 0 {
+		p.packer.SetMaxBodyLength(maxBodyLength + 1)
+	}
+}
+
+//GetHeaderLength 获取头部长度
+func (p *CompressPacker) GetHeaderLength() uint32 {
+	return p.packer.GetHeaderLength()
+}
+
+//UnPack 解包
+func (p *CompressPacker) UnPack(bs []byte) (iface.IMessage, error) {
+	return p.packer.UnPack(bs)
+}
+
+//Pack 超过阈值且压缩后变小时才使用压缩后的数据
+func (p *CompressPacker) Pack(msgID uint32, data []byte) ([]byte, error) {
+
+	flag := compressFlagRaw
+	payload := data
+	if len(data) >= p.threshold {
+		compressed, err := p.compressor.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			flag = compressFlagCompressed
+			payload = compressed
+		}
+	}
+
+	body := make([]byte, 0, len(payload)+1)
+	body = append(body, flag)
+	body = append(body, payload...)
+	return p.packer.Pack(msgID, body)
+}
+
+//Stamp 被装饰的packer有发送序号时设置，如：SequencePacker
+func (p *CompressPacker) Stamp(dataPack []byte) {
+	if stamper, ok := p.packer.(iface.IPacketStamper); ok {
+		stamper.Stamp(dataPack)
+	}
+}
+
+//UnPackBody 根据第一个字节的标记解压
+func (p *CompressPacker) UnPackBody(message iface.IMessage) error {
+
+	// 被装饰的packer也有包体处理（如：校验），先执行
+	if unpacker, ok := p.packer.(iface.IBodyUnpacker); ok {
+		if err := unpacker.UnPackBody(message); err != nil {
+			return err
+		}
+	}
+
+	body := message.Bytes()
+	if len(body) == 0 {
+		return nil
+	}
+
+	switch body[0] {
+	case compressFlagRaw:
+		message.SetData(body[1:])
+	case compressFlagCompressed:
+		data, err := p.compressor.Decompress(body[1:], p.maxDecompressLength())
+		if err == BodyLenExceedLimit {
+			Logger.Errorln(BodyLenExceedLimit)
+			return err
+		}
+		if err != nil {
+			Logger.Errorf("%s decompress error %v", p.compressor.Name(), err)
+			return DecompressFail
+		}
+		message.SetData(data)
+	default:
+		Logger.Errorf("unknown compress flag %d", body[0])
+		return DecompressFail
+	}
+	return nil
+}
+
+//maxDecompressLength 解压后的最大长度，与MaxBodyLength相同
+func (p *CompressPacker) maxDecompressLength() uint32 {
+	if p.maxBodyLength > 0 {
+		return p.maxBodyLength
+	}
+	return defaultMaxDecompressLength
+}
@@ -0,0 +1,142 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//compressRoundTrip 封包后按连接的流程解包：包头、包体、UnPackBody，返回解包后的消息和压缩标记
+func compressRoundTrip(t *testing.T, p iface.IPacker, msgID uint32, data []byte) (iface.IMessage, uint8) {
+	t.Helper()
+	dataPack, err := p.Pack(msgID, data)
+	if err != nil {
+		t.Fatalf("pack：%v", err)
+	}
+	if stamper, ok := p.(iface.IPacketStamper); ok {
+		stamper.Stamp(dataPack)
+	}
+
+	var message iface.IMessage
+	if decoder, ok := p.(iface.IStreamDecoder); ok {
+		consumed, messages, err := decoder.Decode(dataPack)
+		if err != nil || consumed != len(dataPack) || len(messages) != 1 {
+			t.Fatalf("decode %d %d：%v", consumed, len(messages), err)
+		}
+		message = messages[0]
+	} else {
+		header := p.GetHeaderLength()
+		if message, err = p.UnPack(dataPack[:header]); err != nil {
+			t.Fatalf("unpack：%v", err)
+		}
+		message.SetData(dataPack[header:])
+	}
+
+	flag := message.Bytes()[0]
+	if err := p.(iface.IBodyUnpacker).UnPackBody(message); err != nil {
+		t.Fatalf("unpack body：%v", err)
+	}
+	return message, flag
+}
+
+func TestCompressPacker(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	repeated := bytes.Repeat([]byte("netman "), 1024)
+
+	tests := []struct {
+		name   string
+		packer iface.IPacker
+		data   []byte
+		flag   uint8
+	}{
+		{"empty", NewCompressPacker(NewDataPacker()), nil, compressFlagRaw},
+		{"under threshold", NewCompressPacker(NewDataPacker()), repeated[:1023], compressFlagRaw},
+		{"flate", NewCompressPacker(NewDataPacker()), repeated, compressFlagCompressed},
+		{"gzip", NewCompressPacker(NewDataPacker(), WithCompressor(NewGzipCompressor(gzip.BestSpeed))), repeated, compressFlagCompressed},
+		{"incompressible", NewCompressPacker(NewDataPacker()), random, compressFlagRaw},
+		{"threshold", NewCompressPacker(NewDataPacker(), WithCompressThreshold(256)), repeated[:512], compressFlagCompressed},
+		{"sequence", NewCompressPacker(NewSequencePacker()), repeated, compressFlagCompressed},
+		{"stream decoder", NewCompressPacker(NewVarintPacker()), repeated, compressFlagCompressed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, flag := compressRoundTrip(t, tt.packer, 7, tt.data)
+			if flag != tt.flag {
+				t.Fatalf("flag = %d, want %d", flag, tt.flag)
+			}
+			if message.ID() != 7 || !bytes.Equal(message.Bytes(), tt.data) || message.Len() != len(tt.data) {
+				t.Fatalf("message = %d %d bytes", message.ID(), message.Len())
+			}
+		})
+	}
+}
+
+func TestCompressPackerUnPackBody(t *testing.T) {
+	compressed, _ := NewFlateCompressor(flate.BestSpeed).Compress(make([]byte, 1000))
+
+	tests := []struct {
+		name string
+		max  uint32
+		body []byte
+		err  error
+	}{
+		{"raw", 0, []byte{compressFlagRaw, 'a'}, nil},
+		{"compressed", 0, append([]byte{compressFlagCompressed}, compressed...), nil},
+		{"max length", 1000, append([]byte{compressFlagCompressed}, compressed...), nil},
+		{"exceeds max length", 999, append([]byte{compressFlagCompressed}, compressed...), BodyLenExceedLimit},
+		{"corrupted", 0, []byte{compressFlagCompressed, 0xff, 0xff}, DecompressFail},
+		{"unknown flag", 0, []byte{2, 'a'}, DecompressFail},
+		{"empty", 0, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewCompressPacker(NewDataPacker())
+			p.SetMaxBodyLength(tt.max)
+			message := &Message{}
+			message.SetData(tt.body)
+			if err := p.(iface.IBodyUnpacker).UnPackBody(message); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// 被装饰的packer的包体多1个字节的标记
+	inner := NewDataPacker()
+	NewCompressPacker(inner).SetMaxBodyLength(100)
+	dataPack, _ := inner.Pack(1, make([]byte, 101))
+	if _, err := inner.UnPack(dataPack[:inner.GetHeaderLength()]); err != nil {
+		t.Fatalf("inner max body length：%v", err)
+	}
+}
+
+func TestCompressorLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		create  func()
+		invalid bool
+	}{
+		{"flate", func() { NewFlateCompressor(flate.BestCompression) }, false},
+		{"flate huffman only", func() { NewFlateCompressor(flate.HuffmanOnly) }, false},
+		{"flate invalid", func() { NewFlateCompressor(10) }, true},
+		{"gzip", func() { NewGzipCompressor(gzip.DefaultCompression) }, false},
+		{"gzip invalid", func() { NewGzipCompressor(-3) }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if err := recover(); (err != nil) != tt.invalid {
+					t.Fatalf("panic = %v", err)
+				}
+			}()
+			tt.create()
+		})
+	}
+}
@@ -1,22 +1,40 @@
 package util
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/ikilobyte/netman/iface"
 )
 
+type contextKey int
+
+const (
+	connectKey contextKey = iota // 连接
+	messageKey                   // 消息
+	requestKey                   // 请求
+)
+
 type Context struct {
-	storage *sync.Map
-	request iface.IRequest
+	context.Context // 默认为连接的上下文，连接断开或者服务停止时取消
+	storage         *sync.Map
+	request         iface.IRequest
 }
 
 //NewContext .
 func NewContext(request iface.IRequest) iface.IContext {
-	return &Context{
+	c := &Context{
+		Context: request.GetConnect().Context(),
 		storage: new(sync.Map),
 		request: request,
 	}
+
+	// request.Context()返回的就是这个上下文
+	if r, ok := request.(*Request); ok {
+		r.ctx = c
+	}
+	return c
 }
 
 func (c *Context) GetRequest() iface.IRequest {
@@ -43,3 +61,56 @@ func (c *Context) Get(key interface{}) interface{} {
 	}
 	return value
 }
+
+//Value 实现context.Context，可以获取连接、消息以及Set保存的数据，派生的context也能获取到
+func (c *Context) Value(key interface{}) interface{} {
+	switch key {
+	case connectKey:
+		return c.GetConnect()
+	case messageKey:
+		return c.GetMessage()
+	case requestKey:
+		return c.request
+	}
+
+	if value, ok := c.storage.Load(key); ok {
+		return value
+	}
+	return c.Context.Value(key)
+}
+
+//WithDeadline 返回带截止时间的上下文，与当前上下文共享Set保存的数据，不会修改当前上下文，处理完成后需要调用返回的cancel
+func (c *Context) WithDeadline(deadline time.Time) (iface.IContext, context.CancelFunc) {
+	ctx, cancel := context.WithDeadline(c.Context, deadline)
+	derived := &Context{
+		Context: ctx,
+		storage: c.storage,
+		request: c.request,
+	}
+
+	// 派生的上下文使用单独的request，request.Context()返回派生的上下文
+	if r, ok := c.request.(*Request); ok {
+		request := *r
+		request.ctx = derived
+		derived.request = &request
+	}
+	return derived, cancel
+}
+
+//ConnectFromContext 从上下文中获取连接
+func ConnectFromContext(ctx context.Context) (iface.IConnect, bool) {
+	connect, ok := ctx.Value(connectKey).(iface.IConnect)
+	return connect, ok
+}
+
+//MessageFromContext 从上下文中获取消息
+func MessageFromContext(ctx context.Context) (iface.IMessage, bool) {
+	message, ok := ctx.Value(messageKey).(iface.IMessage)
+	return message, ok
+}
+
+//RequestFromContext 从上下文中获取请求
+func RequestFromContext(ctx context.Context) (iface.IRequest, bool) {
+	request, ok := ctx.Value(requestKey).(iface.IRequest)
+	return request, ok
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//contextTestConnect 只实现上下文使用的方法
+type contextTestConnect struct {
+	iface.IConnect
+	ctx context.Context
+}
+
+func (c *contextTestConnect) Context() context.Context     { return c.ctx }
+func (c *contextTestConnect) SetLastMessageTime(time.Time) {}
+
+func TestContext(t *testing.T) {
+	connCtx, cancel := context.WithCancel(context.Background())
+	connect := &contextTestConnect{ctx: connCtx}
+	message := &Message{MsgID: 1}
+	request := NewRequest(connect, message, nil)
+	ctx := NewContext(request)
+	ctx.Set("user", "a")
+
+	// 可以从上下文中获取连接、消息、请求和Set保存的数据
+	if got, ok := ConnectFromContext(ctx); !ok || got != connect {
+		t.Fatalf("connect = %v", got)
+	}
+	if got, ok := MessageFromContext(ctx); !ok || got != message {
+		t.Fatalf("message = %v", got)
+	}
+	if got, ok := RequestFromContext(ctx); !ok || got != request {
+		t.Fatalf("request = %v", got)
+	}
+	if request.Context() != ctx || RequestContext(request) != ctx {
+		t.Fatal("request context is not the message context")
+	}
+
+	// 派生的上下文与原来的上下文共享数据，request.Context()返回派生的上下文
+	derived, cancelDerived := ctx.(*Context).WithDeadline(time.Now().Add(time.Hour))
+	derived.Set("role", "admin")
+	if derived.Get("user") != "a" || ctx.Get("role") != "admin" {
+		t.Fatal("storage is not shared")
+	}
+	if got, _ := RequestFromContext(derived); got.(*Request).Context() != derived {
+		t.Fatal("derived request context is not the derived context")
+	}
+	if request.Context() != ctx {
+		t.Fatal("request context is changed by WithDeadline")
+	}
+	if _, ok := context.WithValue(derived, contextKey(100), "v").Value("user").(string); !ok {
+		t.Fatal("value is not found in child context")
+	}
+
+	// 派生的上下文取消不影响原来的上下文，连接断开时都会取消
+	cancelDerived()
+	if derived.Err() != context.Canceled || ctx.Err() != nil {
+		t.Fatalf("err = %v %v after canceling derived context", derived.Err(), ctx.Err())
+	}
+	derived, cancelDerived = ctx.(*Context).WithDeadline(time.Now().Add(time.Hour))
+	defer cancelDerived()
+	cancel()
+	if ctx.Err() != context.Canceled || derived.Err() != context.Canceled {
+		t.Fatalf("err = %v %v after connection closed", ctx.Err(), derived.Err())
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	ctx := NewContext(NewRequest(&contextTestConnect{ctx: context.Background()}, &Message{}, nil))
+	derived, cancel := ctx.(*Context).WithDeadline(time.Now().Add(10 * time.Millisecond))
+	defer cancel()
+
+	select {
+	case <-derived.Done():
+	case <-time.After(time.Second):
+		t.Fatal("derived context is not canceled after deadline")
+	}
+	if derived.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		t.Fatalf("err = %v %v", derived.Err(), ctx.Err())
+	}
+}
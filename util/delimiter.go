@@ -0,0 +1,219 @@
+package util
+
+import (
+	"bytes"
+	"log"
+	"strings"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//defaultMaxLineLength NewLinePacker默认的一行最大长度，对端一直不发送换行时不会无限缓存
+const defaultMaxLineLength = 64 << 10
+
+//RouteKeyFunc 根据一行数据选择路由，返回msgID
+type RouteKeyFunc = func(line []byte) uint32
+
+//DelimiterPacker 分隔符分包，适用于文本协议，实现了IStreamDecoder
+//默认所有消息的msgID都是0，可以通过WithRouteKey根据内容选择路由
+//每个连接使用Clone出来的packer，保存已查找过的位置，数据不完整时下次从这个位置继续查找
+type DelimiterPacker struct {
+	maxBodyLength uint32
+	delimiter     []byte       // 分隔符
+	keepDelimiter bool         // 消息中是否保留分隔符
+	lineMode      bool         // 按行分包，兼容\n和\r\n
+	routeKey      RouteKeyFunc // 选择路由
+	scanned       int          // 未解码的数据中已查找过的长度
+}
+
+type DelimiterOption = func(p *DelimiterPacker)
+
+//WithDelimiter 分隔符，默认：\n
+func WithDelimiter(delimiter []byte) DelimiterOption {
+	return func(p *DelimiterPacker) {
+		p.delimiter = delimiter
+	}
+}
+
+//WithMaxLineLength 一行（不含分隔符）的最大长度，超过时断开连接，默认：0（不限制），NewLinePacker默认：64KB
+func WithMaxLineLength(length uint32) DelimiterOption {
+	return func(p *DelimiterPacker) {
+		p.maxBodyLength = length
+	}
+}
+
+//WithKeepDelimiter 消息中保留分隔符
+func WithKeepDelimiter() DelimiterOption {
+	return func(p *DelimiterPacker) {
+		p.keepDelimiter = true
+	}
+}
+
+//WithRouteKey 根据一行数据选择路由，如：util.NewCommandKey().Bind("ping", 1).MsgID
+func WithRouteKey(routeKey RouteKeyFunc) DelimiterOption {
+	return func(p *DelimiterPacker) {
+		p.routeKey = routeKey
+	}
+}
+
+//NewDelimiterPacker 分隔符分包，配置有误时会panic
+func NewDelimiterPacker(opts ...DelimiterOption) *DelimiterPacker {
+	p := &DelimiterPacker{
+		delimiter: []byte("\n"),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if len(p.delimiter) == 0 {
+		log.Panicln("delimiter must not be empty")
+	}
+	return p
+}
+
+//NewLinePacker 按行分包，兼容\n和\r\n，发送时使用\r\n结尾，适用于telnet等，一行默认最大64KB
+func NewLinePacker(opts ...DelimiterOption) *DelimiterPacker {
+	p := NewDelimiterPacker(append([]DelimiterOption{WithMaxLineLength(defaultMaxLineLength)}, opts...)...)
+	p.delimiter = []byte("\n")
+	p.lineMode = true
+	return p
+}
+
+//Clone 每个连接单独保存查找的位置
+func (p *DelimiterPacker) Clone() iface.IPacker {
+	clone := *p
+	clone.scanned = 0
+	return &clone
+}
+
+//ResetDecode 丢弃未解码的数据时（如：UDP数据报中不完整的部分）重置查找的位置
+func (p *DelimiterPacker) ResetDecode() {
+	p.scanned = 0
+}
+
+//SetMaxBodyLength 一行（不含分隔符）的最大长度
+func (p *DelimiterPacker) SetMaxBodyLength(maxBodyLength uint32) {
+	p.maxBodyLength = maxBodyLength
+}
+
+//GetHeaderLength 没有包头，使用Decode解码，不会调用这个方法
+func (p *DelimiterPacker) GetHeaderLength() uint32 {
+	return 0
+}
+
+//UnPack 没有包头，使用Decode解码，不会调用这个方法
+func (p *DelimiterPacker) UnPack([]byte) (iface.IMessage, error) {
+	return nil, HeadBytesLengthFail
+}
+
+//Pack 在数据后面加上分隔符，已经以分隔符结尾时不再添加，msgID不会发送
+func (p *DelimiterPacker) Pack(msgID uint32, data []byte) ([]byte, error) {
+	delimiter := p.delimiter
+	if p.lineMode {
+		delimiter = []byte("\r\n")
+		if bytes.HasSuffix(data, []byte("\r")) {
+			delimiter = []byte("\n")
+		}
+	}
+
+	buff := make([]byte, 0, len(data)+len(delimiter))
+	buff = append(buff, data...)
+	if !bytes.HasSuffix(data, p.delimiter) {
+		buff = append(buff, delimiter...)
+	}
+	return buff, nil
+}
+
+//Decode 解码出所有完整的行，buf以上次未解码的数据开头，已查找过的部分不再重复查找
+func (p *DelimiterPacker) Decode(buf []byte) (int, []iface.IMessage, error) {
+
+	consumed := 0
+	messages := make([]iface.IMessage, 0)
+
+	// 分隔符可能一部分在上次的数据中
+	start := p.scanned - len(p.delimiter) + 1
+	if start < 0 || p.scanned > len(buf) {
+		start = 0
+	}
+	p.scanned = 0
+
+	for consumed < len(buf) {
+		remain := buf[consumed:]
+		index := bytes.Index(remain[start:], p.delimiter)
+
+		// 数据不完整，超过最大长度时不再等待
+		if index < 0 {
+			if p.maxBodyLength > 0 && len(remain) > int(p.maxBodyLength)+len(p.delimiter) {
+				return consumed, messages, BodyLenExceedLimit
+			}
+			p.scanned = len(remain)
+			break
+		}
+
+		index += start
+		start = 0
+		end := index + len(p.delimiter)
+		line := remain[:index]
+		if p.lineMode {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+		}
+
+		if p.maxBodyLength > 0 && len(line) > int(p.maxBodyLength) {
+			return consumed, messages, BodyLenExceedLimit
+		}
+
+		message := &Message{}
+		if p.routeKey != nil {
+			message.MsgID = p.routeKey(line)
+		}
+
+		if p.keepDelimiter {
+			message.SetData(remain[:end:end])
+		} else {
+			message.SetData(line[:len(line):len(line)])
+		}
+
+		messages = append(messages, message)
+		consumed += end
+	}
+
+	return consumed, messages, nil
+}
+
+//CommandKey 命令风格的路由，第一个单词（空白分隔）选择路由，不区分大小写，如：SET key value
+type CommandKey struct {
+	commands  map[string]uint32 // command => msgID
+	unmatched uint32            // 未绑定的命令使用的msgID
+}
+
+func NewCommandKey() *CommandKey {
+	return &CommandKey{
+		commands: make(map[string]uint32),
+	}
+}
+
+//Bind 绑定命令和msgID，需要在server启动前绑定
+func (k *CommandKey) Bind(command string, msgID uint32) *CommandKey {
+	k.commands[strings.ToLower(command)] = msgID
+	return k
+}
+
+//Unmatched 未绑定的命令使用的msgID，默认：0，可以配合NotFound路由使用
+func (k *CommandKey) Unmatched(msgID uint32) *CommandKey {
+	k.unmatched = msgID
+	return k
+}
+
+//MsgID 根据第一个单词获取msgID，可以作为WithRouteKey的参数
+func (k *CommandKey) MsgID(line []byte) uint32 {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return k.unmatched
+	}
+
+	if msgID, ok := k.commands[strings.ToLower(string(fields[0]))]; ok {
+		return msgID
+	}
+	return k.unmatched
+}
@@ -0,0 +1,147 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func decodeAll(t *testing.T, p *DelimiterPacker, chunks ...string) ([]string, []uint32, error) {
+	t.Helper()
+
+	var buf []byte
+	lines := make([]string, 0)
+	msgIDs := make([]uint32, 0)
+	for _, chunk := range chunks {
+		buf = append(buf, chunk...)
+		consumed, messages, err := p.Decode(buf)
+		if err != nil {
+			return lines, msgIDs, err
+		}
+		for _, message := range messages {
+			lines = append(lines, message.String())
+			msgIDs = append(msgIDs, message.ID())
+		}
+		buf = append([]byte(nil), buf[consumed:]...)
+	}
+	return lines, msgIDs, nil
+}
+
+func TestDelimiterPackerDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		packer *DelimiterPacker
+		chunks []string
+		want   []string
+		err    error
+	}{
+		{"line lf", NewLinePacker(), []string{"ping\nset a 1\n"}, []string{"ping", "set a 1"}, nil},
+		{"line crlf", NewLinePacker(), []string{"ping\r\nset a 1\r\n"}, []string{"ping", "set a 1"}, nil},
+		{"line mixed", NewLinePacker(), []string{"a\r\nb\nc"}, []string{"a", "b"}, nil},
+		{"line empty", NewLinePacker(), []string{"\r\n\n"}, []string{"", ""}, nil},
+		{"line split", NewLinePacker(), []string{"pi", "ng\r", "\nnext", "\n"}, []string{"ping", "next"}, nil},
+		{"line keep delimiter", NewLinePacker(WithKeepDelimiter()), []string{"a\r\nb\n"}, []string{"a\r\n", "b\n"}, nil},
+		{"delimiter strip", NewDelimiterPacker(WithDelimiter([]byte("\x00"))), []string{"a\x00b\x00"}, []string{"a", "b"}, nil},
+		{"delimiter keep", NewDelimiterPacker(WithDelimiter([]byte("\x00")), WithKeepDelimiter()), []string{"a\x00b\x00"}, []string{"a\x00", "b\x00"}, nil},
+		{"delimiter cr not stripped", NewDelimiterPacker(), []string{"a\r\n"}, []string{"a\r"}, nil},
+		{"multi byte delimiter split", NewDelimiterPacker(WithDelimiter([]byte("||"))), []string{"ab|", "|cd|", "|"}, []string{"ab", "cd"}, nil},
+		{"multi byte delimiter resume", NewDelimiterPacker(WithDelimiter([]byte("END"))), []string{"abcE", "N", "Dx"}, []string{"abc"}, nil},
+		{"max length line", NewLinePacker(WithMaxLineLength(4)), []string{"abcd\r\n"}, []string{"abcd"}, nil},
+		{"max length exceeded", NewLinePacker(WithMaxLineLength(4)), []string{"abcde\n"}, []string{}, BodyLenExceedLimit},
+		{"max length without delimiter", NewLinePacker(WithMaxLineLength(4)), []string{"abc", "def"}, []string{}, BodyLenExceedLimit},
+		{"default line length", NewLinePacker(), []string{string(bytes.Repeat([]byte("a"), defaultMaxLineLength+2))}, []string{}, BodyLenExceedLimit},
+		{"unlimited line length", NewLinePacker(WithMaxLineLength(0)), []string{string(bytes.Repeat([]byte("a"), defaultMaxLineLength+2))}, []string{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, _, err := decodeAll(t, tt.packer.Clone().(*DelimiterPacker), tt.chunks...)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if len(lines) != len(tt.want) {
+				t.Fatalf("lines = %q, want %q", lines, tt.want)
+			}
+			for i := range lines {
+				if lines[i] != tt.want[i] {
+					t.Fatalf("lines = %q, want %q", lines, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDelimiterPackerResetDecode(t *testing.T) {
+	p := NewLinePacker()
+
+	// 不完整的数据被丢弃后，新的数据需要从头查找
+	if consumed, _, _ := p.Decode([]byte("abcdef")); consumed != 0 {
+		t.Fatalf("consumed = %d, want 0", consumed)
+	}
+	p.ResetDecode()
+
+	consumed, messages, err := p.Decode([]byte("a\nbcdefgh"))
+	if err != nil || consumed != 2 || len(messages) != 1 || messages[0].String() != "a" {
+		t.Fatalf("consumed = %d, messages = %v, err = %v", consumed, messages, err)
+	}
+}
+
+func TestDelimiterPackerPack(t *testing.T) {
+	tests := []struct {
+		name   string
+		packer *DelimiterPacker
+		data   string
+		want   string
+	}{
+		{"line", NewLinePacker(), "pong", "pong\r\n"},
+		{"line ends with crlf", NewLinePacker(), "pong\r\n", "pong\r\n"},
+		{"line ends with lf", NewLinePacker(), "pong\n", "pong\n"},
+		{"line ends with cr", NewLinePacker(), "pong\r", "pong\r\n"},
+		{"line empty", NewLinePacker(), "", "\r\n"},
+		{"delimiter", NewDelimiterPacker(WithDelimiter([]byte("\x00"))), "a", "a\x00"},
+		{"delimiter ends with delimiter", NewDelimiterPacker(WithDelimiter([]byte("\x00"))), "a\x00", "a\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.packer.Pack(1, []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("Pack = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	keys := NewCommandKey().Bind("PING", 1).Bind("set", 2).Unmatched(99)
+	p := NewLinePacker(WithRouteKey(keys.MsgID))
+
+	tests := []struct {
+		line  string
+		msgID uint32
+	}{
+		{"PING\r\n", 1},
+		{"ping\n", 1},
+		{"PiNg extra args\n", 1},
+		{"SET a 1\n", 2},
+		{"  set   a 1\n", 2},
+		{"get a\n", 99},
+		{"\n", 99},
+		{"   \n", 99},
+		{"pingpong\n", 99},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			_, msgIDs, err := decodeAll(t, p.Clone().(*DelimiterPacker), tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgIDs) != 1 || msgIDs[0] != tt.msgID {
+				t.Fatalf("msgIDs = %v, want %d", msgIDs, tt.msgID)
+			}
+		})
+	}
+}
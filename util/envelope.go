@@ -0,0 +1,135 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//JSONEnvelope json格式的信封：{"event": 1, "data": {...}}
+//event可以是数字（即msgID），也可以是通过Bind绑定过的字符串
+type JSONEnvelope struct {
+	events map[string]uint32 // event => msgID
+	names  map[uint32]string // msgID => event
+}
+
+type jsonEnvelope struct {
+	Event json.RawMessage `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+func NewJSONEnvelope() *JSONEnvelope {
+	return &JSONEnvelope{
+		events: make(map[string]uint32),
+		names:  make(map[uint32]string),
+	}
+}
+
+//Bind 绑定字符串event和msgID，需要在server启动前绑定
+func (e *JSONEnvelope) Bind(event string, msgID uint32) *JSONEnvelope {
+	e.events[event] = msgID
+	e.names[msgID] = event
+	return e
+}
+
+//Decode 解析出msgID，data为原始的json
+func (e *JSONEnvelope) Decode(payload []byte) (uint32, []byte, error) {
+
+	envelope := jsonEnvelope{}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", EnvelopeFail, err)
+	}
+
+	if len(envelope.Event) <= 0 {
+		return 0, nil, fmt.Errorf("%w: event is empty", EnvelopeFail)
+	}
+
+	// 字符串类型的event
+	var event string
+	if err := json.Unmarshal(envelope.Event, &event); err == nil {
+		msgID, ok := e.events[event]
+		if !ok {
+			return 0, nil, fmt.Errorf("%w: %s", EnvelopeEventNotFound, event)
+		}
+		return msgID, envelope.Data, nil
+	}
+
+	// 数字类型的event
+	msgID, err := strconv.ParseUint(string(envelope.Event), 10, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: event %s", EnvelopeFail, envelope.Event)
+	}
+
+	return uint32(msgID), envelope.Data, nil
+}
+
+//Encode 绑定过的msgID使用字符串event，data不是合法的json时作为字符串处理
+func (e *JSONEnvelope) Encode(msgID uint32, data []byte) ([]byte, error) {
+
+	envelope := jsonEnvelope{
+		Event: json.RawMessage(strconv.FormatUint(uint64(msgID), 10)),
+		Data:  data,
+	}
+
+	if name, ok := e.names[msgID]; ok {
+		event, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Event = event
+	}
+
+	if len(data) > 0 && !json.Valid(data) {
+		bs, err := json.Marshal(string(data))
+		if err != nil {
+			return nil, err
+		}
+		envelope.Data = bs
+	}
+
+	return json.Marshal(envelope)
+}
+
+func (e *JSONEnvelope) IsBinary() bool {
+	return false
+}
+
+//PackerEnvelope 使用IPacker的格式作为信封，如：DataPacker的 data长度(4字节)msgID(4字节)data
+type PackerEnvelope struct {
+	packer iface.IPacker
+}
+
+func NewPackerEnvelope(packer iface.IPacker) *PackerEnvelope {
+	return &PackerEnvelope{
+		packer: packer,
+	}
+}
+
+func (e *PackerEnvelope) Decode(payload []byte) (uint32, []byte, error) {
+
+	headLen := int(e.packer.GetHeaderLength())
+	if len(payload) < headLen {
+		return 0, nil, fmt.Errorf("%w: %v", EnvelopeFail, HeadBytesLengthFail)
+	}
+
+	message, err := e.packer.UnPack(payload[:headLen])
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", EnvelopeFail, err)
+	}
+
+	if len(payload)-headLen != message.Len() {
+		return 0, nil, fmt.Errorf("%w: not a complete data packet", EnvelopeFail)
+	}
+
+	return message.ID(), payload[headLen:], nil
+}
+
+func (e *PackerEnvelope) Encode(msgID uint32, data []byte) ([]byte, error) {
+	return e.packer.Pack(msgID, data)
+}
+
+func (e *PackerEnvelope) IsBinary() bool {
+	return true
+}
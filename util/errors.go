@@ -4,6 +4,7 @@ import "errors"
 
 var HeadBytesLengthFail = errors.New("head bytes fail")
 var RouterNotFound = errors.New("router Not Found")
+var RouterConflict = errors.New("router conflict")
 var BodyLenExceedLimit = errors.New("body length exceed limit")
 var TLSHandshakeUnFinish = errors.New("tls handshake un finish")
 var WebsocketOpcodeFail = errors.New("websocket opcode fail")
@@ -12,3 +13,17 @@ var WebsocketPingPayloadOversize = errors.New("websocket ping payload oversize")
 var WebsocketCtrlMessageMustNotFragmented = errors.New("websocket control message MUST NOT be fragmented")
 var WebsocketMustUtf8 = errors.New("websocket text message must utf-8")
 var WebsocketProtocolError = errors.New("websocket protocol error")
+var CodecDecodeFail = errors.New("codec decode fail")
+var CodecEncodeFail = errors.New("codec encode fail")
+var EnvelopeFail = errors.New("envelope fail")
+var EnvelopeEventNotFound = errors.New("envelope event not found")
+var WebsocketEnvelopeNotSet = errors.New("websocket envelope not set")
+var RateLimitExceeded = errors.New("rate limit exceeded")
+var AuthRequired = errors.New("authentication required")
+var DecompressFail = errors.New("decompress fail")
+var ChecksumFail = errors.New("checksum fail")
+var SequenceFail = errors.New("sequence fail")
+var MessageDropped = errors.New("message dropped")
+var MqttProtocolError = errors.New("mqtt protocol error")
+var MqttTopicInvalid = errors.New("mqtt topic invalid")
+var ProxyHeaderFail = errors.New("proxy protocol header fail")
@@ -0,0 +1,224 @@
+package util
+
+import (
+	"encoding/binary"
+	"log"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//LengthFieldPacker 可配置的长度字段封包方式，用于对接已有的设备、服务
+//包头中长度字段、msgID字段的位置和大小都可以配置，包头中其它字节封包时填充0
+//包体长度 = 长度字段的值 + lengthAdjustment - (lengthIncludesHeader ? 包头长度 : 0)
+type LengthFieldPacker struct {
+	maxBodyLength        uint32
+	lengthOffset         int              // 长度字段的偏移
+	lengthSize           int              // 长度字段的字节数：1、2、4、8
+	msgIDOffset          int              // msgID字段的偏移
+	msgIDSize            int              // msgID字段的字节数：0（没有msgID）、1、2、4
+	defaultMsgID         uint32           // 没有msgID字段时，解包出来的msgID
+	headerLength         int              // 包头长度，默认为长度字段和msgID字段结束位置的最大值
+	lengthIncludesHeader bool             // 长度字段的值是否包含包头
+	lengthAdjustment     int              // 长度字段的修正值
+	byteOrder            binary.ByteOrder // 字节序，默认：小端
+}
+
+type LengthFieldOption = func(p *LengthFieldPacker)
+
+//WithLengthField 长度字段的偏移和字节数，字节数只能是1、2、4、8，默认：0、4
+func WithLengthField(offset, size int) LengthFieldOption {
+	return func(p *LengthFieldPacker) {
+		p.lengthOffset = offset
+		p.lengthSize = size
+	}
+}
+
+//WithMsgIDField msgID字段的偏移和字节数，字节数只能是1、2、4，默认：4、4
+func WithMsgIDField(offset, size int) LengthFieldOption {
+	return func(p *LengthFieldPacker) {
+		p.msgIDOffset = offset
+		p.msgIDSize = size
+	}
+}
+
+//WithoutMsgID 包头中没有msgID字段，解包出来的msgID都是defaultMsgID，封包时忽略msgID
+func WithoutMsgID(defaultMsgID uint32) LengthFieldOption {
+	return func(p *LengthFieldPacker) {
+		p.msgIDSize = 0
+		p.defaultMsgID = defaultMsgID
+	}
+}
+
+//WithHeaderLength 包头长度，包头中有其它字段时使用，不能小于长度字段和msgID字段结束的位置
+func WithHeaderLength(length int) LengthFieldOption {
+	return func(p *LengthFieldPacker) {
+		p.headerLength = length
+	}
+}
+
+//WithLengthIncludesHeader 长度字段的值包含包头的长度
+func WithLengthIncludesHeader() LengthFieldOption {
+	return func(p *LengthFieldPacker) {
+		p.lengthIncludesHeader = true
+	}
+}
+
+//WithLengthAdjustment 长度字段的修正值，如：长度字段的值包含了包尾2个字节的校验码时，使用-2
+func WithLengthAdjustment(adjustment int) LengthFieldOption {
+	return func(p *LengthFieldPacker) {
+		p.lengthAdjustment = adjustment
+	}
+}
+
+//WithByteOrder 字节序，默认：binary.LittleEndian
+func WithByteOrder(order binary.ByteOrder) LengthFieldOption {
+	return func(p *LengthFieldPacker) {
+		p.byteOrder = order
+	}
+}
+
+//NewLengthFieldPacker 默认与DataPacker的格式相同：data长度(4字节)msgID(4字节)data，配置有误时会panic
+func NewLengthFieldPacker(opts ...LengthFieldOption) *LengthFieldPacker {
+	p := &LengthFieldPacker{
+		lengthOffset: 0,
+		lengthSize:   4,
+		msgIDOffset:  4,
+		msgIDSize:    4,
+		byteOrder:    binary.LittleEndian,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	switch p.lengthSize {
+	case 1, 2, 4, 8:
+	default:
+		log.Panicf("length field size must be 1, 2, 4 or 8, got %d", p.lengthSize)
+	}
+
+	switch p.msgIDSize {
+	case 0, 1, 2, 4:
+	default:
+		log.Panicf("msgID field size must be 0, 1, 2 or 4, got %d", p.msgIDSize)
+	}
+
+	if p.lengthOffset < 0 || p.msgIDOffset < 0 {
+		log.Panicln("length field and msgID field offset must not be negative")
+	}
+
+	// 长度字段和msgID字段不能重叠，否则封包时会互相覆盖
+	if p.msgIDSize > 0 && p.msgIDOffset < p.lengthOffset+p.lengthSize && p.lengthOffset < p.msgIDOffset+p.msgIDSize {
+		log.Panicln("length field and msgID field must not overlap")
+	}
+
+	// 包头长度
+	end := p.lengthOffset + p.lengthSize
+	if p.msgIDSize > 0 && p.msgIDOffset+p.msgIDSize > end {
+		end = p.msgIDOffset + p.msgIDSize
+	}
+	if p.headerLength == 0 {
+		p.headerLength = end
+	}
+	if p.headerLength < end {
+		log.Panicf("header length %d is less than the end of length field and msgID field %d", p.headerLength, end)
+	}
+
+	return p
+}
+
+//SetMaxBodyLength .
+func (p *LengthFieldPacker) SetMaxBodyLength(maxBodyLength uint32) {
+	p.maxBodyLength = maxBodyLength
+}
+
+//GetHeaderLength 获取头部长度
+func (p *LengthFieldPacker) GetHeaderLength() uint32 {
+	return uint32(p.headerLength)
+}
+
+//Pack 封包
+func (p *LengthFieldPacker) Pack(msgID uint32, data []byte) ([]byte, error) {
+
+	length := len(data) - p.lengthAdjustment
+	if p.lengthIncludesHeader {
+		length += p.headerLength
+	}
+
+	if length < 0 || (p.lengthSize < 8 && uint64(length) >= 1<<(8*uint(p.lengthSize))) {
+		return nil, BodyLenExceedLimit
+	}
+
+	buff := make([]byte, p.headerLength+len(data))
+	p.putUint(buff[p.lengthOffset:], p.lengthSize, uint64(length))
+	if p.msgIDSize > 0 {
+		p.putUint(buff[p.msgIDOffset:], p.msgIDSize, uint64(msgID))
+	}
+	copy(buff[p.headerLength:], data)
+
+	return buff, nil
+}
+
+//UnPack 解包数据（传到这里的只有包头），后续的data部分由连接读取
+func (p *LengthFieldPacker) UnPack(bs []byte) (iface.IMessage, error) {
+
+	if len(bs) < p.headerLength {
+		return nil, HeadBytesLengthFail
+	}
+
+	length := int64(p.uint(bs[p.lengthOffset:], p.lengthSize)) + int64(p.lengthAdjustment)
+	if p.lengthIncludesHeader {
+		length -= int64(p.headerLength)
+	}
+
+	// 长度字段有误
+	if length < 0 || length > int64(^uint32(0)) {
+		return nil, HeadBytesLengthFail
+	}
+
+	dataLen := uint32(length)
+
+	// 判断长度是否超过限制
+	if p.maxBodyLength > 0 && dataLen > p.maxBodyLength {
+		Logger.Errorln(BodyLenExceedLimit)
+		return nil, BodyLenExceedLimit
+	}
+
+	msgID := p.defaultMsgID
+	if p.msgIDSize > 0 {
+		msgID = uint32(p.uint(bs[p.msgIDOffset:], p.msgIDSize))
+	}
+
+	return &Message{
+		MsgID:   msgID,
+		DataLen: dataLen,
+	}, nil
+}
+
+//uint 按照配置的字节序读取size个字节
+func (p *LengthFieldPacker) uint(bs []byte, size int) uint64 {
+	switch size {
+	case 1:
+		return uint64(bs[0])
+	case 2:
+		return uint64(p.byteOrder.Uint16(bs))
+	case 4:
+		return uint64(p.byteOrder.Uint32(bs))
+	default:
+		return p.byteOrder.Uint64(bs)
+	}
+}
+
+//putUint 按照配置的字节序写入size个字节
+func (p *LengthFieldPacker) putUint(bs []byte, size int, value uint64) {
+	switch size {
+	case 1:
+		bs[0] = uint8(value)
+	case 2:
+		p.byteOrder.PutUint16(bs, uint16(value))
+	case 4:
+		p.byteOrder.PutUint32(bs, uint32(value))
+	default:
+		p.byteOrder.PutUint64(bs, value)
+	}
+}
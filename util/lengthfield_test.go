@@ -0,0 +1,126 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestNewLengthFieldPacker(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []LengthFieldOption
+		header uint32 // 包头长度，0表示配置有误
+	}{
+		{"default", nil, 8},
+		{"msgID before length", []LengthFieldOption{WithMsgIDField(0, 2), WithLengthField(2, 2)}, 4},
+		{"header length", []LengthFieldOption{WithHeaderLength(12)}, 12},
+		{"without msgID", []LengthFieldOption{WithoutMsgID(1), WithLengthField(2, 2)}, 4},
+		{"without msgID at length offset", []LengthFieldOption{WithLengthField(0, 8), WithoutMsgID(1)}, 8},
+		{"invalid length size", []LengthFieldOption{WithLengthField(0, 3)}, 0},
+		{"invalid msgID size", []LengthFieldOption{WithMsgIDField(4, 8)}, 0},
+		{"negative offset", []LengthFieldOption{WithLengthField(-1, 4)}, 0},
+		{"header too short", []LengthFieldOption{WithHeaderLength(6)}, 0},
+		{"overlapping fields", []LengthFieldOption{WithMsgIDField(2, 4)}, 0},
+		{"msgID inside length", []LengthFieldOption{WithLengthField(0, 8), WithMsgIDField(4, 1)}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if err := recover(); (err != nil) != (tt.header == 0) {
+					t.Fatalf("panic = %v", err)
+				}
+			}()
+
+			if header := NewLengthFieldPacker(tt.opts...).GetHeaderLength(); header != tt.header {
+				t.Fatalf("header length = %d, want %d", header, tt.header)
+			}
+		})
+	}
+}
+
+func TestLengthFieldPackerPack(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []LengthFieldOption
+		msgID  uint32
+		data   string
+		header []byte
+	}{
+		{"default", nil, 7, "abc", []byte{3, 0, 0, 0, 7, 0, 0, 0}},
+		{"big endian", []LengthFieldOption{WithMsgIDField(0, 1), WithLengthField(1, 2), WithByteOrder(binary.BigEndian)}, 7, "abc", []byte{7, 0, 3}},
+		{"padding", []LengthFieldOption{WithLengthField(2, 1), WithMsgIDField(4, 2), WithHeaderLength(8)}, 0x102, "abc", []byte{0, 0, 3, 0, 2, 1, 0, 0}},
+		{"without msgID", []LengthFieldOption{WithLengthField(0, 2), WithoutMsgID(9)}, 7, "abc", []byte{3, 0}},
+		{"includes header", []LengthFieldOption{WithLengthField(0, 2), WithMsgIDField(2, 2), WithLengthIncludesHeader()}, 7, "abc", []byte{7, 0, 7, 0}},
+		{"adjustment", []LengthFieldOption{WithLengthField(0, 2), WithMsgIDField(2, 2), WithLengthAdjustment(-2)}, 7, "abc", []byte{5, 0, 7, 0}},
+		{"length 8 bytes", []LengthFieldOption{WithLengthField(0, 8), WithMsgIDField(8, 4)}, 7, "", []byte{0, 0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewLengthFieldPacker(tt.opts...)
+			dataPack, err := p.Pack(tt.msgID, []byte(tt.data))
+			if err != nil {
+				t.Fatalf("pack：%v", err)
+			}
+			if !bytes.Equal(dataPack[:p.GetHeaderLength()], tt.header) || string(dataPack[p.GetHeaderLength():]) != tt.data {
+				t.Fatalf("pack = %v, want header %v", dataPack, tt.header)
+			}
+
+			// 解包后与封包时一致，没有msgID字段时为defaultMsgID
+			message, err := p.UnPack(dataPack[:p.GetHeaderLength()])
+			if err != nil {
+				t.Fatalf("unpack：%v", err)
+			}
+			msgID := tt.msgID
+			if p.msgIDSize == 0 {
+				msgID = p.defaultMsgID
+			}
+			if message.ID() != msgID || message.Len() != len(tt.data) {
+				t.Fatalf("unpack = %d %d, want %d %d", message.ID(), message.Len(), msgID, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestLengthFieldPackerLimit(t *testing.T) {
+	short := []LengthFieldOption{WithLengthField(0, 1), WithMsgIDField(1, 1)}
+	includes := append(short, WithLengthIncludesHeader())
+
+	tests := []struct {
+		name   string
+		opts   []LengthFieldOption
+		max    uint32
+		data   int    // 封包的数据长度，小于0时不封包
+		header []byte // 解包的包头
+		err    error
+	}{
+		{"pack max length", short, 0, 255, nil, nil},
+		{"pack too long", short, 0, 256, nil, BodyLenExceedLimit},
+		{"pack negative length", []LengthFieldOption{WithLengthAdjustment(4)}, 0, 3, nil, BodyLenExceedLimit},
+		{"pack includes header too long", includes, 0, 254, nil, BodyLenExceedLimit},
+		{"unpack short header", nil, 0, -1, []byte{1, 0, 0, 0}, HeadBytesLengthFail},
+		{"unpack less than header", includes, 0, -1, []byte{1, 0}, HeadBytesLengthFail},
+		{"unpack exceeds uint32", []LengthFieldOption{WithLengthField(0, 8), WithMsgIDField(8, 4)}, 0, -1, []byte{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, HeadBytesLengthFail},
+		{"unpack max body length", short, 16, -1, []byte{17, 0}, BodyLenExceedLimit},
+		{"unpack under max body length", short, 16, -1, []byte{16, 0}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewLengthFieldPacker(tt.opts...)
+			p.SetMaxBodyLength(tt.max)
+
+			var err error
+			if tt.data >= 0 {
+				_, err = p.Pack(1, make([]byte, tt.data))
+			} else {
+				_, err = p.UnPack(tt.header)
+			}
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -7,12 +7,19 @@ type Message struct {
 	Data        []byte // 消息
 	IsWebSocket bool   // 是否为websocket协议
 	Opcode      uint8  // 操作码
+	SeqID       uint32 // 序列号，SequencePacker才有
+	checksum    uint32 // 包头中的校验码
 }
 
 func (m *Message) ID() uint32 {
 	return m.MsgID
 }
 
+//Seq 序列号，可以判断是否有丢失、重复的消息，不支持序列号的packer为0
+func (m *Message) Seq() uint32 {
+	return m.SeqID
+}
+
 func (m *Message) String() string {
 	return string(m.Data)
 }
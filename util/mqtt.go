@@ -0,0 +1,459 @@
+package util
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+// MQTT 3.1.1 控制报文类型，解码出的消息msgID为报文类型
+const (
+	MqttConnect     byte = 1
+	MqttConnack     byte = 2
+	MqttPublish     byte = 3
+	MqttPuback      byte = 4
+	MqttPubrec      byte = 5
+	MqttPubrel      byte = 6
+	MqttPubcomp     byte = 7
+	MqttSubscribe   byte = 8
+	MqttSuback      byte = 9
+	MqttUnsubscribe byte = 10
+	MqttUnsuback    byte = 11
+	MqttPingreq     byte = 12
+	MqttPingresp    byte = 13
+	MqttDisconnect  byte = 14
+)
+
+// CONNACK返回码
+const (
+	MqttAccepted              byte = 0
+	MqttUnacceptableProtocol  byte = 1
+	MqttIdentifierRejected    byte = 2
+	MqttServerUnavailable     byte = 3
+	MqttBadUsernameOrPassword byte = 4
+	MqttNotAuthorized         byte = 5
+)
+
+//mqttMaxRemainingLength 剩余长度最多4个字节
+const mqttMaxRemainingLength = 268435455
+
+//MqttPacket MQTT模式解码出的报文，Data为完整的报文，Remaining为可变头和载荷
+type MqttPacket struct {
+	*Message
+	Type      byte
+	Flags     byte // 固定头的低4位
+	Remaining []byte
+}
+
+//MqttConnectInfo CONNECT报文
+type MqttConnectInfo struct {
+	ProtocolName  string
+	ProtocolLevel byte // 3.1.1为4，3.1为3
+	CleanSession  bool
+	KeepAlive     uint16 // 秒，0表示不检测
+	ClientID      string
+	Will          *MqttMessage // 遗嘱消息，连接异常断开时发布
+	Username      string
+	Password      []byte
+	HasUsername   bool
+	HasPassword   bool
+}
+
+//MqttMessage PUBLISH报文，发布钩子中可以修改Topic、Payload
+type MqttMessage struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	PacketID uint16 // QoS大于0时才有
+}
+
+//MqttSubscription SUBSCRIBE报文中的一个订阅
+type MqttSubscription struct {
+	Filter string
+	QoS    byte
+}
+
+//MqttPacker MQTT 3.1.1报文，实现了IStreamDecoder，发送时数据原样写出，报文通过Encode、MqttConnackPacket等生成
+type MqttPacker struct {
+	maxBodyLength uint32
+}
+
+func NewMqttPacker() *MqttPacker {
+	return &MqttPacker{}
+}
+
+//SetMaxBodyLength 剩余长度的最大值
+func (p *MqttPacker) SetMaxBodyLength(maxBodyLength uint32) {
+	p.maxBodyLength = maxBodyLength
+}
+
+//GetHeaderLength 使用Decode解码，不会调用这个方法
+func (p *MqttPacker) GetHeaderLength() uint32 {
+	return 0
+}
+
+//UnPack 使用Decode解码，不会调用这个方法
+func (p *MqttPacker) UnPack([]byte) (iface.IMessage, error) {
+	return nil, HeadBytesLengthFail
+}
+
+//Pack 数据已经是MQTT报文，原样发送
+func (p *MqttPacker) Pack(msgID uint32, data []byte) ([]byte, error) {
+	return data, nil
+}
+
+//Decode 解码出所有完整的报文，固定头有误时返回HeadBytesLengthFail
+func (p *MqttPacker) Decode(buf []byte) (int, []iface.IMessage, error) {
+
+	consumed := 0
+	messages := make([]iface.IMessage, 0)
+
+	for consumed < len(buf) {
+		remain := buf[consumed:]
+
+		packetType, flags := remain[0]>>4, remain[0]&0x0f
+		if !mqttValidFlags(packetType, flags) {
+			return consumed, messages, HeadBytesLengthFail
+		}
+
+		// 剩余长度，每个字节的最高位表示后面还有字节，最多4个字节，第4个字节之后还有字节时不再等待
+		length, multiplier, offset := 0, 1, 1
+		for {
+			if offset > 4 {
+				return consumed, messages, HeadBytesLengthFail
+			}
+			if offset >= len(remain) {
+				return consumed, messages, nil
+			}
+			b := remain[offset]
+			offset++
+			length += int(b&0x7f) * multiplier
+			multiplier *= 128
+			if b&0x80 == 0 {
+				break
+			}
+		}
+
+		if length > mqttMaxRemainingLength || (p.maxBodyLength > 0 && length > int(p.maxBodyLength)) {
+			return consumed, messages, BodyLenExceedLimit
+		}
+
+		// 数据不完整
+		if len(remain)-offset < length {
+			break
+		}
+
+		end := offset + length
+		packet := &MqttPacket{
+			Message:   &Message{MsgID: uint32(packetType)},
+			Type:      packetType,
+			Flags:     flags,
+			Remaining: remain[offset:end:end],
+		}
+		packet.SetData(remain[:end:end])
+		messages = append(messages, packet)
+		consumed += end
+	}
+
+	return consumed, messages, nil
+}
+
+//mqttValidFlags 固定头的标志位，PUBLISH之外的报文是固定值
+func mqttValidFlags(packetType, flags byte) bool {
+	switch packetType {
+	case MqttPublish:
+		return flags&0x06 != 0x06 // QoS不能为3
+	case MqttPubrel, MqttSubscribe, MqttUnsubscribe:
+		return flags == 0x02
+	case 0, 15:
+		return false
+	default:
+		return flags == 0
+	}
+}
+
+//ParseMqttConnect 解析CONNECT报文
+func ParseMqttConnect(packet *MqttPacket) (*MqttConnectInfo, error) {
+	r := &mqttReader{buf: packet.Remaining}
+
+	info := &MqttConnectInfo{}
+	info.ProtocolName = r.readString()
+	info.ProtocolLevel = r.readByte()
+	flags := r.readByte()
+	info.KeepAlive = r.readUint16()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// 保留位必须为0，没有遗嘱时遗嘱的QoS和Retain必须为0，3.1.1中有密码时必须有用户名
+	if flags&0x01 != 0 || (flags&0x04 == 0 && flags&0x38 != 0) || (flags>>3)&0x03 == 3 {
+		return nil, MqttProtocolError
+	}
+
+	info.CleanSession = flags&0x02 != 0
+	info.HasUsername = flags&0x80 != 0
+	info.HasPassword = flags&0x40 != 0
+	if info.HasPassword && !info.HasUsername && info.ProtocolLevel >= 4 {
+		return nil, MqttProtocolError
+	}
+
+	info.ClientID = r.readString()
+	if flags&0x04 != 0 {
+		info.Will = &MqttMessage{
+			Topic:   r.readString(),
+			Payload: r.readBinary(),
+			QoS:     (flags >> 3) & 0x03,
+			Retain:  flags&0x20 != 0,
+		}
+	}
+	if info.HasUsername {
+		info.Username = r.readString()
+	}
+	if info.HasPassword {
+		info.Password = r.readBinary()
+	}
+
+	if r.err != nil || len(r.buf) > 0 {
+		return nil, MqttProtocolError
+	}
+
+	if info.Will != nil && !ValidMqttTopic(info.Will.Topic) {
+		return nil, MqttTopicInvalid
+	}
+	return info, nil
+}
+
+//ParseMqttPublish 解析PUBLISH报文，Payload引用报文中的数据
+func ParseMqttPublish(packet *MqttPacket) (*MqttMessage, error) {
+	r := &mqttReader{buf: packet.Remaining}
+
+	message := &MqttMessage{
+		QoS:    (packet.Flags >> 1) & 0x03,
+		Retain: packet.Flags&0x01 != 0,
+		Dup:    packet.Flags&0x08 != 0,
+	}
+	if message.QoS == 0 && message.Dup {
+		return nil, MqttProtocolError
+	}
+
+	message.Topic = r.readString()
+	if message.QoS > 0 {
+		message.PacketID = r.readUint16()
+		if r.err == nil && message.PacketID == 0 {
+			return nil, MqttProtocolError
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if !ValidMqttTopic(message.Topic) {
+		return nil, MqttTopicInvalid
+	}
+
+	message.Payload = r.buf
+	return message, nil
+}
+
+//ParseMqttSubscribe 解析SUBSCRIBE报文，至少有一个订阅
+func ParseMqttSubscribe(packet *MqttPacket) (uint16, []MqttSubscription, error) {
+	r := &mqttReader{buf: packet.Remaining}
+
+	packetID := r.readUint16()
+	subscriptions := make([]MqttSubscription, 0)
+	for r.err == nil && len(r.buf) > 0 {
+		filter := r.readString()
+		qos := r.readByte()
+		if qos > 2 {
+			return 0, nil, MqttProtocolError
+		}
+		subscriptions = append(subscriptions, MqttSubscription{Filter: filter, QoS: qos})
+	}
+
+	if r.err != nil || packetID == 0 || len(subscriptions) == 0 {
+		return 0, nil, MqttProtocolError
+	}
+	return packetID, subscriptions, nil
+}
+
+//ParseMqttUnsubscribe 解析UNSUBSCRIBE报文，至少有一个主题过滤器
+func ParseMqttUnsubscribe(packet *MqttPacket) (uint16, []string, error) {
+	r := &mqttReader{buf: packet.Remaining}
+
+	packetID := r.readUint16()
+	filters := make([]string, 0)
+	for r.err == nil && len(r.buf) > 0 {
+		filters = append(filters, r.readString())
+	}
+
+	if r.err != nil || packetID == 0 || len(filters) == 0 {
+		return 0, nil, MqttProtocolError
+	}
+	return packetID, filters, nil
+}
+
+//ParseMqttPacketID 解析只有报文标识符的报文，如：PUBACK
+func ParseMqttPacketID(packet *MqttPacket) (uint16, error) {
+	if len(packet.Remaining) != 2 {
+		return 0, MqttProtocolError
+	}
+	return binary.BigEndian.Uint16(packet.Remaining), nil
+}
+
+//Encode 生成PUBLISH报文
+func (m *MqttMessage) Encode() []byte {
+	flags := m.QoS << 1
+	if m.Retain {
+		flags |= 0x01
+	}
+	if m.Dup {
+		flags |= 0x08
+	}
+
+	length := 2 + len(m.Topic) + len(m.Payload)
+	if m.QoS > 0 {
+		length += 2
+	}
+
+	buff := mqttFixedHeader(MqttPublish<<4|flags, length)
+	buff = appendMqttString(buff, m.Topic)
+	if m.QoS > 0 {
+		buff = append(buff, byte(m.PacketID>>8), byte(m.PacketID))
+	}
+	return append(buff, m.Payload...)
+}
+
+//MqttConnackPacket 生成CONNACK报文
+func MqttConnackPacket(sessionPresent bool, code byte) []byte {
+	var flags byte
+	if sessionPresent {
+		flags = 0x01
+	}
+	return append(mqttFixedHeader(MqttConnack<<4, 2), flags, code)
+}
+
+//MqttSubackPacket 生成SUBACK报文，codes为每个订阅授予的QoS，失败时为0x80
+func MqttSubackPacket(packetID uint16, codes []byte) []byte {
+	buff := mqttFixedHeader(MqttSuback<<4, 2+len(codes))
+	buff = append(buff, byte(packetID>>8), byte(packetID))
+	return append(buff, codes...)
+}
+
+//MqttAckPacket 生成只有报文标识符的报文，如：PUBACK、UNSUBACK
+func MqttAckPacket(packetType byte, packetID uint16) []byte {
+	flags := byte(0)
+	if packetType == MqttPubrel {
+		flags = 0x02
+	}
+	return append(mqttFixedHeader(packetType<<4|flags, 2), byte(packetID>>8), byte(packetID))
+}
+
+//MqttPingrespPacket 生成PINGRESP报文
+func MqttPingrespPacket() []byte {
+	return mqttFixedHeader(MqttPingresp<<4, 0)
+}
+
+//mqttFixedHeader 固定头，剩余长度使用变长编码
+func mqttFixedHeader(first byte, length int) []byte {
+	buff := make([]byte, 0, 5+length)
+	buff = append(buff, first)
+	return appendUvarint(buff, uint64(length))
+}
+
+//appendMqttString 2字节长度 + UTF-8字符串
+func appendMqttString(buff []byte, s string) []byte {
+	buff = append(buff, byte(len(s)>>8), byte(len(s)))
+	return append(buff, s...)
+}
+
+//ValidMqttTopic 发布的主题名，不能为空，不能包含通配符
+func ValidMqttTopic(topic string) bool {
+	return topic != "" && len(topic) <= 65535 && !strings.ContainsAny(topic, "+#")
+}
+
+//ValidMqttTopicFilter 订阅的主题过滤器，+必须占据一整个层级，#必须是最后一个层级
+func ValidMqttTopicFilter(filter string) bool {
+	if filter == "" || len(filter) > 65535 {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) != 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+//MqttTopicMatch 主题名是否匹配主题过滤器，通配符不匹配以$开头的主题（如：$SYS）
+func MqttTopicMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+	for i, level := range filters {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topics) || (level != "+" && level != topics[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
+
+//mqttReader 读取可变头和载荷，数据不足时记录错误，之后的读取都返回零值
+type mqttReader struct {
+	buf []byte
+	err error
+}
+
+func (r *mqttReader) readByte() byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.err = MqttProtocolError
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *mqttReader) readUint16() uint16 {
+	if r.err != nil || len(r.buf) < 2 {
+		r.err = MqttProtocolError
+		return 0
+	}
+	n := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return n
+}
+
+//readBinary 2字节长度 + 数据
+func (r *mqttReader) readBinary() []byte {
+	length := int(r.readUint16())
+	if r.err != nil || len(r.buf) < length {
+		r.err = MqttProtocolError
+		return nil
+	}
+	data := r.buf[:length:length]
+	r.buf = r.buf[length:]
+	return data
+}
+
+//readString UTF-8字符串，不能包含U+0000
+func (r *mqttReader) readString() string {
+	data := r.readBinary()
+	if r.err == nil && (!utf8.Valid(data) || strings.ContainsRune(string(data), 0)) {
+		r.err = MqttProtocolError
+	}
+	return string(data)
+}
@@ -0,0 +1,198 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestMqttPackerDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      uint32
+		buf      []byte
+		consumed int
+		types    []byte
+		err      error
+	}{
+		{"pingreq", 0, []byte{0xc0, 0x00}, 2, []byte{MqttPingreq}, nil},
+		{"publish", 0, []byte{0x31, 0x04, 0x00, 0x01, 'a', 'x'}, 6, []byte{MqttPublish}, nil},
+		{"multiple with partial", 0, []byte{0xc0, 0x00, 0xe0, 0x00, 0xc0}, 4, []byte{MqttPingreq, MqttDisconnect}, nil},
+		{"partial fixed header", 0, []byte{0x30}, 0, []byte{}, nil},
+		{"partial remaining length", 0, []byte{0x30, 0x80}, 0, []byte{}, nil},
+		{"partial body", 0, []byte{0x30, 0x05, 0x00, 0x01}, 0, []byte{}, nil},
+		{"two byte remaining length", 0, append([]byte{0x30, 0x80, 0x01}, make([]byte, 128)...), 131, []byte{MqttPublish}, nil},
+		{"max remaining length", 0, []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, 0, []byte{}, nil},
+		{"fourth byte continues", 0, []byte{0x30, 0xff, 0xff, 0xff, 0xff}, 0, []byte{}, HeadBytesLengthFail},
+		{"fifth length byte", 0, []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, 0, []byte{}, HeadBytesLengthFail},
+		{"max body length", 2, []byte{0x30, 0x03}, 0, []byte{}, BodyLenExceedLimit},
+		{"error after complete packet", 0, []byte{0xc0, 0x00, 0xc1, 0x00}, 2, []byte{MqttPingreq}, HeadBytesLengthFail},
+		{"reserved type 0", 0, []byte{0x00, 0x00}, 0, []byte{}, HeadBytesLengthFail},
+		{"reserved type 15", 0, []byte{0xf0, 0x00}, 0, []byte{}, HeadBytesLengthFail},
+		{"pingreq flags", 0, []byte{0xc1, 0x00}, 0, []byte{}, HeadBytesLengthFail},
+		{"subscribe flags", 0, []byte{0x80, 0x00}, 0, []byte{}, HeadBytesLengthFail},
+		{"subscribe reserved flags", 0, []byte{0x82, 0x00}, 2, []byte{MqttSubscribe}, nil},
+		{"unsubscribe flags", 0, []byte{0xa0, 0x00}, 0, []byte{}, HeadBytesLengthFail},
+		{"pubrel flags", 0, []byte{0x62, 0x02, 0x00, 0x01}, 4, []byte{MqttPubrel}, nil},
+		{"publish qos 3", 0, []byte{0x36, 0x00}, 0, []byte{}, HeadBytesLengthFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewMqttPacker()
+			p.SetMaxBodyLength(tt.max)
+			consumed, messages, err := p.Decode(tt.buf)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if consumed != tt.consumed {
+				t.Fatalf("consumed = %d, want %d", consumed, tt.consumed)
+			}
+			if len(messages) != len(tt.types) {
+				t.Fatalf("messages = %d, want %d", len(messages), len(tt.types))
+			}
+			for i, message := range messages {
+				packet := message.(*MqttPacket)
+				if packet.Type != tt.types[i] || message.ID() != uint32(tt.types[i]) {
+					t.Fatalf("packet[%d] type = %d, want %d", i, packet.Type, tt.types[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMqttReaderReadString(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want string
+		ok   bool
+	}{
+		{"ascii", []byte{0x00, 0x03, 'a', '/', 'b'}, "a/b", true},
+		{"empty", []byte{0x00, 0x00}, "", true},
+		{"utf8", []byte{0x00, 0x06, 0xe4, 0xb8, 0xad, 0xe6, 0x96, 0x87}, "中文", true},
+		{"null character", []byte{0x00, 0x03, 'a', 0x00, 'b'}, "", false},
+		{"invalid utf8", []byte{0x00, 0x02, 0xc3, 0x28}, "", false},
+		{"surrogate", []byte{0x00, 0x03, 0xed, 0xa0, 0x80}, "", false},
+		{"truncated data", []byte{0x00, 0x05, 'a'}, "", false},
+		{"truncated length", []byte{0x00}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &mqttReader{buf: tt.buf}
+			s := r.readString()
+			if (r.err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", r.err, tt.ok)
+			}
+			if tt.ok && s != tt.want {
+				t.Fatalf("string = %q, want %q", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidMqttTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"a/b", true},
+		{"/", true},
+		{"$SYS/info", true},
+		{"", false},
+		{"a/+", false},
+		{"a/#", false},
+		{"a+b", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidMqttTopic(tt.topic); got != tt.want {
+			t.Errorf("ValidMqttTopic(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidMqttTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"a/b", true},
+		{"#", true},
+		{"+", true},
+		{"a/#", true},
+		{"+/b/+", true},
+		{"/+", true},
+		{"", false},
+		{"a/#/b", false},
+		{"a#", false},
+		{"a/b#", false},
+		{"a+/b", false},
+		{"a/+b", false},
+		{"##", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidMqttTopicFilter(tt.filter); got != tt.want {
+			t.Errorf("ValidMqttTopicFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestMqttTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/+", "/b", true},
+		{"#", "$SYS/info", false},
+		{"+/info", "$SYS/info", false},
+		{"$SYS/#", "$SYS/info", true},
+	}
+
+	for _, tt := range tests {
+		if got := MqttTopicMatch(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("MqttTopicMatch(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestParseMqttConnect(t *testing.T) {
+	header := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04}
+	connect := func(flags byte, payload ...byte) *MqttPacket {
+		remaining := append(append([]byte{}, header...), flags, 0x00, 0x3c)
+		return &MqttPacket{Type: MqttConnect, Remaining: append(remaining, payload...)}
+	}
+
+	tests := []struct {
+		name   string
+		packet *MqttPacket
+		err    error
+	}{
+		{"clean session", connect(0x02, 0x00, 0x01, 'c'), nil},
+		{"will", connect(0x0e, 0x00, 0x01, 'c', 0x00, 0x01, 'w', 0x00, 0x01, 'x'), nil},
+		{"reserved flag", connect(0x03, 0x00, 0x01, 'c'), MqttProtocolError},
+		{"will qos without will", connect(0x0a, 0x00, 0x01, 'c'), MqttProtocolError},
+		{"will qos 3", connect(0x1e, 0x00, 0x01, 'c', 0x00, 0x01, 'w', 0x00, 0x00), MqttProtocolError},
+		{"password without username", connect(0x42, 0x00, 0x01, 'c', 0x00, 0x00), MqttProtocolError},
+		{"will topic wildcard", connect(0x06, 0x00, 0x01, 'c', 0x00, 0x01, '#', 0x00, 0x00), MqttTopicInvalid},
+		{"trailing data", connect(0x02, 0x00, 0x01, 'c', 0x00), MqttProtocolError},
+		{"invalid client id", connect(0x02, 0x00, 0x01, 0x00), MqttProtocolError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseMqttConnect(tt.packet); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+// PROXY协议v2的TLV类型
+const (
+	ProxyTLVAlpn      byte = 0x01
+	ProxyTLVAuthority byte = 0x02 // 客户端请求的域名（SNI）
+	ProxyTLVCRC32C    byte = 0x03 // 整个包头的crc32c校验码，解析时会校验
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05 // 负载均衡生成的连接ID
+	ProxyTLVSSL       byte = 0x20 // 客户端与负载均衡之间的TLS信息
+	ProxyTLVNetNS     byte = 0x30
+)
+
+const (
+	proxyV1MaxLength = 107 // v1包头（包括\r\n）的最大长度
+	proxyV2MinLength = 16  // v2固定部分的长度
+)
+
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+//ProxyHeader PROXY协议头，负载均衡转发连接时在最前面发送客户端的真实地址
+type ProxyHeader struct {
+	Version     int      // 1或2
+	Local       bool     // v2的LOCAL命令、v1的UNKNOWN，不是代理的连接（如：负载均衡的健康检查），使用连接的原始地址
+	Source      net.Addr // 客户端地址，Local时为nil
+	Destination net.Addr // 客户端连接的地址（负载均衡），Local时为nil
+	TLVs        []ProxyTLV
+}
+
+//ProxyTLV v2包头中的扩展信息
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+//TLV 获取指定类型的扩展信息
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+//GetProxyHeader 获取连接的PROXY协议头，未开启PROXY协议或者还未接收时返回nil
+func GetProxyHeader(connect iface.IConnect) *ProxyHeader {
+	if c, ok := connect.(interface{ GetProxyHeader() *ProxyHeader }); ok {
+		return c.GetProxyHeader()
+	}
+	return nil
+}
+
+//ParseProxyHeader 解析buf开头的PROXY协议头，返回包头的长度，数据不完整时返回0（此时buf中的数据都属于包头）
+func ParseProxyHeader(buf []byte) (*ProxyHeader, int, error) {
+
+	if bytes.HasPrefix(buf, proxyV1Signature) {
+		return parseProxyV1(buf)
+	}
+	if bytes.HasPrefix(buf, proxyV2Signature) {
+		return parseProxyV2(buf)
+	}
+
+	// 签名不完整
+	if bytes.HasPrefix(proxyV1Signature, buf) || bytes.HasPrefix(proxyV2Signature, buf) {
+		return nil, 0, nil
+	}
+	return nil, 0, ProxyHeaderFail
+}
+
+//parseProxyV1 文本格式：PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseProxyV1(buf []byte) (*ProxyHeader, int, error) {
+	index := bytes.Index(buf, []byte("\r\n"))
+	if index < 0 {
+		if len(buf) >= proxyV1MaxLength {
+			return nil, 0, ProxyHeaderFail
+		}
+		return nil, 0, nil
+	}
+	if index+2 > proxyV1MaxLength {
+		return nil, 0, ProxyHeaderFail
+	}
+
+	header := &ProxyHeader{Version: 1}
+	fields := strings.Split(string(buf[:index]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Local = true
+		return header, index + 2, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, ProxyHeaderFail
+	}
+
+	source, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, 0, err
+	}
+	destination, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	header.Source, header.Destination = source, destination
+	return header, index + 2, nil
+}
+
+//parseProxyV1Addr 地址类型需要和协议一致
+func parseProxyV1Addr(protocol, ip, port string) (net.Addr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (protocol == "TCP4") != (addr.To4() != nil && !strings.Contains(ip, ":")) {
+		return nil, ProxyHeaderFail
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, ProxyHeaderFail
+	}
+	return &net.TCPAddr{IP: addr, Port: int(n)}, nil
+}
+
+//parseProxyV2 二进制格式：签名(12字节)版本和命令(1字节)地址族和协议(1字节)长度(2字节)地址TLV
+func parseProxyV2(buf []byte) (*ProxyHeader, int, error) {
+	if len(buf) < proxyV2MinLength {
+		return nil, 0, nil
+	}
+
+	if buf[12]>>4 != 2 || buf[12]&0x0f > 1 {
+		return nil, 0, ProxyHeaderFail
+	}
+
+	total := proxyV2MinLength + int(binary.BigEndian.Uint16(buf[14:]))
+	if len(buf) < total {
+		return nil, 0, nil
+	}
+
+	header := &ProxyHeader{Version: 2, Local: buf[12]&0x0f == 0}
+	family, protocol := buf[13]>>4, buf[13]&0x0f
+	payload := buf[proxyV2MinLength:total]
+
+	// 地址部分的长度
+	var size int
+	switch family {
+	case 1:
+		size = 12
+	case 2:
+		size = 36
+	case 3:
+		size = 216
+	}
+	if len(payload) < size {
+		return nil, 0, ProxyHeaderFail
+	}
+
+	if !header.Local {
+		switch {
+		case family == 1 && protocol == 1:
+			header.Source = &net.TCPAddr{IP: net.IP(append([]byte{}, payload[0:4]...)), Port: int(binary.BigEndian.Uint16(payload[8:]))}
+			header.Destination = &net.TCPAddr{IP: net.IP(append([]byte{}, payload[4:8]...)), Port: int(binary.BigEndian.Uint16(payload[10:]))}
+		case family == 2 && protocol == 1:
+			header.Source = &net.TCPAddr{IP: net.IP(append([]byte{}, payload[0:16]...)), Port: int(binary.BigEndian.Uint16(payload[32:]))}
+			header.Destination = &net.TCPAddr{IP: net.IP(append([]byte{}, payload[16:32]...)), Port: int(binary.BigEndian.Uint16(payload[34:]))}
+		case family == 3 && protocol == 1:
+			header.Source = &net.UnixAddr{Name: string(bytes.TrimRight(payload[0:108], "\x00")), Net: "unix"}
+			header.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: "unix"}
+		default:
+			// 未知的地址族、UDP，使用连接的原始地址
+			header.Local = true
+		}
+	}
+
+	// TLV，未知的地址族时忽略之后的数据
+	crcOffset := -1
+	offset := proxyV2MinLength + size
+	for size > 0 && offset < total {
+		if total-offset < 3 {
+			return nil, 0, ProxyHeaderFail
+		}
+		typ, length := buf[offset], int(binary.BigEndian.Uint16(buf[offset+1:]))
+		if total-offset-3 < length {
+			return nil, 0, ProxyHeaderFail
+		}
+		if typ == ProxyTLVCRC32C {
+			if length != 4 {
+				return nil, 0, ProxyHeaderFail
+			}
+			crcOffset = offset + 3
+		}
+		header.TLVs = append(header.TLVs, ProxyTLV{Type: typ, Value: append([]byte{}, buf[offset+3:offset+3+length]...)})
+		offset += 3 + length
+	}
+
+	// 校验码，计算时校验码部分为0
+	if crcOffset > 0 {
+		data := append([]byte{}, buf[:total]...)
+		copy(data[crcOffset:crcOffset+4], []byte{0, 0, 0, 0})
+		if crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)) != binary.BigEndian.Uint32(buf[crcOffset:]) {
+			return nil, 0, ProxyHeaderFail
+		}
+	}
+
+	return header, total, nil
+}
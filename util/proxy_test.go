@@ -0,0 +1,167 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+)
+
+//proxyV2 生成v2包头，command：0为LOCAL，1为PROXY
+func proxyV2(command, familyProtocol byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	buf := append([]byte{}, proxyV2Signature...)
+	buf = append(buf, 0x20|command, familyProtocol, byte(len(body)>>8), byte(len(body)))
+	return append(buf, body...)
+}
+
+func proxyTLV(typ byte, value []byte) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+//proxyWithCRC 在包头最后加上CRC32C的TLV，crc不为0时使用指定的值
+func proxyWithCRC(buf []byte, crc uint32) []byte {
+	buf = append(buf, proxyTLV(ProxyTLVCRC32C, make([]byte, 4))...)
+	binary.BigEndian.PutUint16(buf[14:], uint16(len(buf)-proxyV2MinLength))
+	if crc == 0 {
+		crc = crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli))
+	}
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], crc)
+	return buf
+}
+
+var (
+	proxyTCP4 = []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+	proxyTCP6 = append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	proxyUnix = func() []byte {
+		payload := make([]byte, 216)
+		copy(payload, "/tmp/source.sock")
+		copy(payload[108:], "/tmp/destination.sock")
+		return payload
+	}()
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		buf         []byte
+		length      int
+		local       bool
+		source      string
+		destination string
+		err         error
+	}{
+		// v1
+		{"v1 tcp4", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\nGET"), 43, false, "192.168.0.1:56324", "10.0.0.1:443", nil},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), 46, false, "[2001:db8::1]:56324", "[2001:db8::2]:443", nil},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), 15, true, "", "", nil},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"), 59, true, "", "", nil},
+		{"v1 incomplete", []byte("PROXY TCP4 192.168.0.1"), 0, false, "", "", nil},
+		{"v1 max length without crlf", []byte("PROXY " + strings.Repeat("a", proxyV1MaxLength-7)), 0, false, "", "", nil},
+		{"v1 too long without crlf", []byte("PROXY " + strings.Repeat("a", proxyV1MaxLength-6)), 0, false, "", "", ProxyHeaderFail},
+		{"v1 too long", []byte("PROXY " + strings.Repeat("a", proxyV1MaxLength) + "\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 tcp4 with ipv6", []byte("PROXY TCP4 2001:db8::1 10.0.0.1 56324 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 tcp4 with mapped ipv6", []byte("PROXY TCP4 ::ffff:192.168.0.1 10.0.0.1 56324 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 tcp6 with ipv4", []byte("PROXY TCP6 192.168.0.1 2001:db8::2 56324 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 leading zero port", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 056324 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 zero port", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 0 443\r\n"), 39, false, "192.168.0.1:0", "10.0.0.1:443", nil},
+		{"v1 port overflow", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 65536 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 invalid ip", []byte("PROXY TCP4 192.168.0 10.0.0.1 56324 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 missing field", []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 double space", []byte("PROXY TCP4  192.168.0.1 10.0.0.1 56324 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 udp", []byte("PROXY UDP4 192.168.0.1 10.0.0.1 56324 443\r\n"), 0, false, "", "", ProxyHeaderFail},
+
+		// 签名
+		{"empty", []byte{}, 0, false, "", "", nil},
+		{"v1 partial signature", []byte("PROX"), 0, false, "", "", nil},
+		{"v2 partial signature", proxyV2Signature[:7], 0, false, "", "", nil},
+		{"invalid signature", []byte("GET / HTTP/1.1\r\n"), 0, false, "", "", ProxyHeaderFail},
+		{"v1 signature case", []byte("proxy TCP4"), 0, false, "", "", ProxyHeaderFail},
+
+		// v2
+		{"v2 local", proxyV2(0, 0x00), 16, true, "", "", nil},
+		{"v2 local with address", proxyV2(0, 0x11, proxyTCP4), 28, true, "", "", nil},
+		{"v2 tcp4", proxyV2(1, 0x11, proxyTCP4), 28, false, "192.168.0.1:56324", "10.0.0.1:443", nil},
+		{"v2 tcp6", proxyV2(1, 0x21, proxyTCP6), 52, false, "[2001:db8::1]:56324", "[2001:db8::2]:443", nil},
+		{"v2 unix", proxyV2(1, 0x31, proxyUnix), 232, false, "/tmp/source.sock", "/tmp/destination.sock", nil},
+		{"v2 udp4", proxyV2(1, 0x12, proxyTCP4), 28, true, "", "", nil},
+		{"v2 unspec", proxyV2(1, 0x00), 16, true, "", "", nil},
+		{"v2 trailing data", append(proxyV2(1, 0x11, proxyTCP4), 0x16, 0x03), 28, false, "192.168.0.1:56324", "10.0.0.1:443", nil},
+		{"v2 incomplete fixed part", proxyV2(1, 0x11, proxyTCP4)[:15], 0, false, "", "", nil},
+		{"v2 incomplete address", proxyV2(1, 0x11, proxyTCP4)[:20], 0, false, "", "", nil},
+		{"v2 invalid version", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0x00, 0x00), 0, false, "", "", ProxyHeaderFail},
+		{"v2 invalid command", proxyV2(2, 0x11, proxyTCP4), 0, false, "", "", ProxyHeaderFail},
+		{"v2 short address", proxyV2(1, 0x11, proxyTCP4[:8]), 0, false, "", "", ProxyHeaderFail},
+		{"v2 short tcp6 address", proxyV2(1, 0x21, proxyTCP4), 0, false, "", "", ProxyHeaderFail},
+
+		// TLV
+		{"v2 tlv", proxyV2(1, 0x11, proxyTCP4, proxyTLV(ProxyTLVAuthority, []byte("example.com"))), 42, false, "192.168.0.1:56324", "10.0.0.1:443", nil},
+		{"v2 truncated tlv header", proxyV2(1, 0x11, proxyTCP4, []byte{ProxyTLVAuthority, 0x00}), 0, false, "", "", ProxyHeaderFail},
+		{"v2 truncated tlv value", proxyV2(1, 0x11, proxyTCP4, []byte{ProxyTLVAuthority, 0x00, 0x05, 'a'}), 0, false, "", "", ProxyHeaderFail},
+		{"v2 crc32c", proxyWithCRC(proxyV2(1, 0x11, proxyTCP4), 0), 35, false, "192.168.0.1:56324", "10.0.0.1:443", nil},
+		{"v2 crc32c mismatch", proxyWithCRC(proxyV2(1, 0x11, proxyTCP4), 1), 0, false, "", "", ProxyHeaderFail},
+		{"v2 crc32c length", proxyV2(1, 0x11, proxyTCP4, proxyTLV(ProxyTLVCRC32C, []byte{0, 0, 0})), 0, false, "", "", ProxyHeaderFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, length, err := ParseProxyHeader(tt.buf)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if length != tt.length {
+				t.Fatalf("length = %d, want %d", length, tt.length)
+			}
+			if length == 0 {
+				if header != nil {
+					t.Fatalf("header = %+v, want nil", header)
+				}
+				return
+			}
+
+			if header.Local != tt.local {
+				t.Fatalf("local = %v, want %v", header.Local, tt.local)
+			}
+			if tt.local {
+				if header.Source != nil || header.Destination != nil {
+					t.Fatalf("local header has addresses %v %v", header.Source, header.Destination)
+				}
+				return
+			}
+			if header.Source.String() != tt.source || header.Destination.String() != tt.destination {
+				t.Fatalf("addresses = %v %v, want %s %s", header.Source, header.Destination, tt.source, tt.destination)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderTLV(t *testing.T) {
+	buf := proxyWithCRC(proxyV2(1, 0x11, proxyTCP4, proxyTLV(ProxyTLVAuthority, []byte("example.com")), proxyTLV(ProxyTLVUniqueID, []byte{1, 2})), 0)
+	header, length, err := ParseProxyHeader(buf)
+	if err != nil || length != len(buf) {
+		t.Fatalf("length = %d, err = %v", length, err)
+	}
+	if header.Version != 2 || len(header.TLVs) != 3 {
+		t.Fatalf("header = %+v", header)
+	}
+
+	if value, ok := header.TLV(ProxyTLVAuthority); !ok || string(value) != "example.com" {
+		t.Fatalf("authority = %q %v", value, ok)
+	}
+	if value, ok := header.TLV(ProxyTLVUniqueID); !ok || !bytes.Equal(value, []byte{1, 2}) {
+		t.Fatalf("unique id = %v %v", value, ok)
+	}
+	if _, ok := header.TLV(ProxyTLVAlpn); ok {
+		t.Fatalf("alpn should not exist")
+	}
+
+	// TLV的值是复制的，不引用读取的数据
+	for i := range buf {
+		buf[i] = 0
+	}
+	if value, _ := header.TLV(ProxyTLVAuthority); string(value) != "example.com" {
+		t.Fatalf("authority references the buffer")
+	}
+}
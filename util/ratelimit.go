@@ -0,0 +1,97 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+//TokenBucket 令牌桶，每秒生成rate个令牌，最多保存burst个令牌
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	locker sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+//Allow 获取一个令牌，没有可用的令牌时返回false
+func (b *TokenBucket) Allow() bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+//idle 令牌已满，且超过idle时间未使用
+func (b *TokenBucket) idle(now time.Time, idle time.Duration) bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return now.Sub(b.last) >= idle && b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+//RateLimiter 按key区分的令牌桶，长时间未使用的令牌桶会被清理
+type RateLimiter struct {
+	rate    float64
+	burst   int
+	buckets map[string]*TokenBucket
+	cleaned time.Time
+	locker  sync.Mutex
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*TokenBucket),
+		cleaned: time.Now(),
+	}
+}
+
+//Allow key对应的令牌桶是否有可用的令牌
+func (l *RateLimiter) Allow(key string) bool {
+	l.locker.Lock()
+
+	now := time.Now()
+	if now.Sub(l.cleaned) >= time.Minute {
+		l.clean(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	l.locker.Unlock()
+
+	return bucket.Allow()
+}
+
+//clean 清理已满且一分钟未使用的令牌桶，令牌桶已满时删除和保留的效果是一样的
+func (l *RateLimiter) clean(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.idle(now, time.Minute) {
+			delete(l.buckets, key)
+		}
+	}
+	l.cleaned = now
+}
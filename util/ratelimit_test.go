@@ -0,0 +1,78 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		elapsed time.Duration // 第一轮用完令牌后经过的时间
+		first   int           // 第一轮允许的消息数量
+		second  int           // 经过elapsed后允许的消息数量
+	}{
+		{"burst", 1, 3, 0, 3, 0},
+		{"refill", 10, 5, 200 * time.Millisecond, 5, 2},
+		{"refill partial", 1, 5, 1500 * time.Millisecond, 5, 1},
+		{"refill up to burst", 100, 2, time.Minute, 2, 2},
+		{"zero burst", 100, 0, time.Second, 0, 0},
+	}
+
+	// 连续获取令牌，直到失败
+	allowed := func(b *TokenBucket) int {
+		n := 0
+		for n < 1000 && b.Allow() {
+			n++
+		}
+		return n
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewTokenBucket(tt.rate, tt.burst)
+			if got := allowed(b); got != tt.first {
+				t.Fatalf("first allowed %d, want %d", got, tt.first)
+			}
+
+			// 修改上次获取的时间，模拟经过了elapsed
+			b.last = b.last.Add(-tt.elapsed)
+			if got := allowed(b); got != tt.second {
+				t.Fatalf("allowed %d after %v, want %d", got, tt.elapsed, tt.second)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1, 2)
+
+	// 每个key单独计算
+	for _, key := range []string{"a", "b"} {
+		for i := 0; i < 2; i++ {
+			if !l.Allow(key) {
+				t.Fatalf("key %s message %d is limited", key, i)
+			}
+		}
+		if l.Allow(key) {
+			t.Fatalf("key %s exceeds burst", key)
+		}
+	}
+
+	// 一分钟后清理已满的令牌桶，未满的保留
+	now := time.Now()
+	l.buckets["a"].last = now.Add(-time.Minute)
+	l.buckets["b"].last = now
+	l.clean(now)
+	if _, ok := l.buckets["a"]; ok {
+		t.Fatal("idle bucket is not cleaned")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Fatal("bucket in use is cleaned")
+	}
+	if l.Allow("b") {
+		t.Fatal("bucket b is refilled after clean")
+	}
+}
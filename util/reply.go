@@ -0,0 +1,110 @@
+package util
+
+import "encoding/binary"
+
+//Reply 路由的返回值，会依次经过中间件，中间件可以读取、修改或者直接返回一个Reply，最终由框架回复给客户端
+type Reply struct {
+	MsgID   uint32      // 回复的消息ID
+	Payload interface{} // 回复的内容，[]byte和string原样发送，其它类型使用配置的codec编码，nil表示不回复
+	Err     error       // 不为nil时回复标准错误包
+}
+
+//NewReply .
+func NewReply(msgID uint32, payload interface{}) *Reply {
+	return &Reply{
+		MsgID:   msgID,
+		Payload: payload,
+	}
+}
+
+//Error 带错误码的错误，code会写入标准错误包
+type Error struct {
+	Code    int
+	Message string
+}
+
+//NewError .
+func NewError(code int, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+//ErrorPacket 标准错误包的内容，使用配置的codec编码
+//实现了gogo protobuf的Marshal、Unmarshal，使用GogoProtoCodec时对应的定义：
+//message ErrorPacket { uint32 msg_id = 1; int64 code = 2; string error = 3; }
+type ErrorPacket struct {
+	MsgID uint32 `json:"msg_id"` // 出错的消息ID
+	Code  int    `json:"code"`   // 错误码，不是*Error类型的错误为0
+	Error string `json:"error"`  // 错误信息
+}
+
+//Marshal protobuf编码，值为0的字段不写入
+func (p *ErrorPacket) Marshal() ([]byte, error) {
+	buff := make([]byte, 0, len(p.Error)+32)
+	if p.MsgID != 0 {
+		buff = appendUvarint(append(buff, 1<<3|0), uint64(p.MsgID))
+	}
+	if p.Code != 0 {
+		buff = appendUvarint(append(buff, 2<<3|0), uint64(int64(p.Code)))
+	}
+	if p.Error != "" {
+		buff = appendUvarint(append(buff, 3<<3|2), uint64(len(p.Error)))
+		buff = append(buff, p.Error...)
+	}
+	return buff, nil
+}
+
+//Unmarshal protobuf解码，忽略未知的字段
+func (p *ErrorPacket) Unmarshal(data []byte) error {
+	*p = ErrorPacket{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return CodecDecodeFail
+		}
+		data = data[n:]
+
+		// 字段的值，varint类型为value，长度类型为bytes
+		var value uint64
+		var bytes []byte
+		switch key & 0x7 {
+		case 0:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return CodecDecodeFail
+			}
+		case 1:
+			n = 8
+		case 5:
+			n = 4
+		case 2:
+			length, m := binary.Uvarint(data)
+			if m <= 0 || length > uint64(len(data)-m) {
+				return CodecDecodeFail
+			}
+			n = m + int(length)
+			bytes = data[m:n]
+		default:
+			return CodecDecodeFail
+		}
+		if n > len(data) {
+			return CodecDecodeFail
+		}
+		data = data[n:]
+
+		switch key {
+		case 1<<3 | 0:
+			p.MsgID = uint32(value)
+		case 2<<3 | 0:
+			p.Code = int(int64(value))
+		case 3<<3 | 2:
+			p.Error = string(bytes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+func TestErrorPacketMarshal(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet ErrorPacket
+		want   []byte
+	}{
+		{"empty", ErrorPacket{}, []byte{}},
+		{"all fields", ErrorPacket{MsgID: 1, Code: 400, Error: "x"}, []byte{0x08, 0x01, 0x10, 0x90, 0x03, 0x1a, 0x01, 'x'}},
+		{"negative code", ErrorPacket{Code: -1}, []byte{0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"max msgID", ErrorPacket{MsgID: 0xffffffff}, []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := tt.packet.Marshal()
+			if err != nil || !bytes.Equal(bs, tt.want) {
+				t.Fatalf("Marshal = %x %v, want %x", bs, err, tt.want)
+			}
+
+			var packet ErrorPacket
+			if err := packet.Unmarshal(bs); err != nil || packet != tt.packet {
+				t.Fatalf("Unmarshal = %+v %v, want %+v", packet, err, tt.packet)
+			}
+		})
+	}
+}
+
+func TestErrorPacketUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want ErrorPacket
+		err  error
+	}{
+		{"unknown varint", []byte{0x20, 0x05, 0x08, 0x02}, ErrorPacket{MsgID: 2}, nil},
+		{"unknown fixed64", []byte{0x21, 1, 2, 3, 4, 5, 6, 7, 8, 0x08, 0x02}, ErrorPacket{MsgID: 2}, nil},
+		{"unknown fixed32", []byte{0x25, 1, 2, 3, 4, 0x08, 0x02}, ErrorPacket{MsgID: 2}, nil},
+		{"unknown bytes", []byte{0x22, 0x02, 'a', 'b', 0x1a, 0x01, 'x'}, ErrorPacket{Error: "x"}, nil},
+		{"utf8 error", append([]byte{0x1a, 0x06}, "限流"...), ErrorPacket{Error: "限流"}, nil},
+		{"last field wins", []byte{0x08, 0x01, 0x08, 0x02}, ErrorPacket{MsgID: 2}, nil},
+		{"truncated key", []byte{0x80}, ErrorPacket{}, CodecDecodeFail},
+		{"truncated varint", []byte{0x08, 0x80}, ErrorPacket{}, CodecDecodeFail},
+		{"truncated bytes", []byte{0x1a, 0x05, 'x'}, ErrorPacket{}, CodecDecodeFail},
+		{"truncated fixed32", []byte{0x25, 1, 2}, ErrorPacket{}, CodecDecodeFail},
+		{"huge length", []byte{0x1a, 0xff, 0xff, 0xff, 0xff, 0x0f}, ErrorPacket{}, CodecDecodeFail},
+		{"invalid wire type", []byte{0x0b}, ErrorPacket{}, CodecDecodeFail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := ErrorPacket{MsgID: 9, Code: 9, Error: "old"}
+			err := packet.Unmarshal(tt.data)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err == nil && packet != tt.want {
+				t.Fatalf("packet = %+v, want %+v", packet, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorPacketCodecs(t *testing.T) {
+	packet := &ErrorPacket{MsgID: 1, Code: 429, Error: RateLimitExceeded.Error()}
+
+	// 所有内置的codec都可以编解码标准错误包
+	for _, codec := range []iface.ICodec{NewJSONCodec(), NewGobCodec(), NewGogoProtoCodec()} {
+		bs, err := codec.Marshal(packet)
+		if err != nil {
+			t.Fatalf("%s marshal：%v", codec.Name(), err)
+		}
+		var decoded ErrorPacket
+		if err := codec.Unmarshal(bs, &decoded); err != nil || decoded != *packet {
+			t.Fatalf("%s unmarshal = %+v %v", codec.Name(), decoded, err)
+		}
+	}
+
+	// json使用tag中的字段名，不受Marshal方法影响
+	bs, _ := json.Marshal(packet)
+	if !strings.Contains(string(bs), `"msg_id":1`) {
+		t.Fatalf("json = %s", bs)
+	}
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"time"
 
 	"github.com/ikilobyte/netman/iface"
@@ -10,6 +11,7 @@ type Request struct {
 	message    iface.IMessage
 	connect    iface.IConnect
 	connectMgr iface.IConnectManager
+	ctx        context.Context // NewContext时设置
 }
 
 func NewRequest(connect iface.IConnect, message iface.IMessage, connectMgr iface.IConnectManager) *Request {
@@ -35,3 +37,19 @@ func (r *Request) GetMessage() iface.IMessage {
 func (r *Request) GetConnects() []iface.IConnect {
 	return r.connectMgr.GetConnects()
 }
+
+//Context 消息的上下文，连接断开、服务停止或者路由执行超时时取消
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return r.connect.Context()
+	}
+	return r.ctx
+}
+
+//RequestContext 消息的上下文，request未实现iface.IRequestContext时使用连接的上下文
+func RequestContext(request iface.IRequest) context.Context {
+	if r, ok := request.(iface.IRequestContext); ok {
+		return r.Context()
+	}
+	return request.GetConnect().Context()
+}
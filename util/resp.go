@@ -0,0 +1,394 @@
+package util
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+const (
+	respMaxInlineLength = 64 * 1024   // inline命令的最大长度
+	respMaxArgs         = 1024 * 1024 // 一个命令的最大参数数量
+	respMaxPrealloc     = 1024        // 参数列表最多预分配的数量，数量由客户端声明，不可信
+	respMaxBulkLength   = 512 << 20   // 未配置MaxBodyLength时一个参数的最大长度，与Redis的proto-max-bulk-len相同
+)
+
+//RespCommand RESP模式解码出的命令，Args[0]为命令名，Data为命令的原始数据
+type RespCommand struct {
+	*Message
+	Args [][]byte
+}
+
+//RespArgs 获取命令的参数，Args[0]为命令名，不是RESP命令时返回nil
+func RespArgs(message iface.IMessage) [][]byte {
+	if command, ok := message.(*RespCommand); ok {
+		return command.Args
+	}
+	return nil
+}
+
+//respCommands 命令名 => msgID，多个连接的packer共享
+type respCommands struct {
+	locker   sync.Mutex
+	commands atomic.Value // map[string]uint32 每次绑定都会生成新的map，解码时无需加锁
+}
+
+//bind 绑定命令，已绑定时返回原来的msgID，msgID从1开始分配
+func (c *respCommands) bind(name string) uint32 {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	name = strings.ToLower(name)
+	commands := c.load()
+	if msgID, ok := commands[name]; ok {
+		return msgID
+	}
+
+	msgID := uint32(len(commands) + 1)
+	replaced := make(map[string]uint32, len(commands)+1)
+	for k, v := range commands {
+		replaced[k] = v
+	}
+	replaced[name] = msgID
+	c.commands.Store(replaced)
+	return msgID
+}
+
+//load 当前绑定的命令
+func (c *respCommands) load() map[string]uint32 {
+	commands, _ := c.commands.Load().(map[string]uint32)
+	return commands
+}
+
+//RespPacker Redis协议（RESP2/RESP3），支持inline和multi-bulk命令，根据命令名选择路由，实现了IStreamDecoder
+//未绑定的命令msgID为0，发送时数据原样写出，使用RespWriter生成回复，每个连接使用Clone出来的packer保存协议版本
+type RespPacker struct {
+	maxBodyLength uint32
+	commands      *respCommands
+	version       int32 // 协议版本，HELLO命令切换
+}
+
+func NewRespPacker() *RespPacker {
+	return &RespPacker{
+		commands: new(respCommands),
+		version:  2,
+	}
+}
+
+//Clone 共享命令绑定，协议版本从RESP2开始
+func (p *RespPacker) Clone() iface.IPacker {
+	return &RespPacker{
+		maxBodyLength: p.maxBodyLength,
+		commands:      p.commands,
+		version:       2,
+	}
+}
+
+//Bind 绑定命令名，返回分配的msgID，命令名不区分大小写
+func (p *RespPacker) Bind(name string) uint32 {
+	return p.commands.bind(name)
+}
+
+//Version 当前连接的协议版本：2或3
+func (p *RespPacker) Version() int {
+	return int(atomic.LoadInt32(&p.version))
+}
+
+//SetVersion 切换协议版本，HELLO命令使用
+func (p *RespPacker) SetVersion(version int) {
+	atomic.StoreInt32(&p.version, int32(version))
+}
+
+//SetMaxBodyLength 一个参数的最大长度，默认：512MB
+func (p *RespPacker) SetMaxBodyLength(maxBodyLength uint32) {
+	p.maxBodyLength = maxBodyLength
+}
+
+//GetHeaderLength 使用Decode解码，不会调用这个方法
+func (p *RespPacker) GetHeaderLength() uint32 {
+	return 0
+}
+
+//UnPack 使用Decode解码，不会调用这个方法
+func (p *RespPacker) UnPack([]byte) (iface.IMessage, error) {
+	return nil, HeadBytesLengthFail
+}
+
+//Pack 数据已经是RESP格式，原样发送
+func (p *RespPacker) Pack(msgID uint32, data []byte) ([]byte, error) {
+	return data, nil
+}
+
+//Decode 解码出所有完整的命令，格式有误时返回HeadBytesLengthFail
+func (p *RespPacker) Decode(buf []byte) (int, []iface.IMessage, error) {
+
+	consumed := 0
+	messages := make([]iface.IMessage, 0)
+
+	for consumed < len(buf) {
+		remain := buf[consumed:]
+
+		var (
+			list [][]byte
+			n    int
+			err  error
+		)
+		if remain[0] == '*' {
+			list, n, err = p.decodeMultiBulk(remain)
+		} else {
+			list, n, err = p.decodeInline(remain)
+		}
+
+		if err != nil {
+			return consumed, messages, err
+		}
+
+		// 数据不完整
+		if n == 0 {
+			break
+		}
+
+		frame := remain[:n:n]
+		consumed += n
+
+		// 空命令直接忽略
+		if len(list) == 0 {
+			continue
+		}
+
+		command := &RespCommand{
+			Message: &Message{MsgID: p.commands.load()[strings.ToLower(string(list[0]))]},
+			Args:    list,
+		}
+		command.SetData(frame)
+		messages = append(messages, command)
+	}
+
+	return consumed, messages, nil
+}
+
+//decodeInline 一行空白分隔的命令，如：PING
+func (p *RespPacker) decodeInline(buf []byte) ([][]byte, int, error) {
+	index := bytes.IndexByte(buf, '\n')
+	if index < 0 {
+		if len(buf) > respMaxInlineLength {
+			return nil, 0, BodyLenExceedLimit
+		}
+		return nil, 0, nil
+	}
+
+	line := bytes.TrimSuffix(buf[:index], []byte("\r"))
+	fields := bytes.Fields(line)
+	for i, field := range fields {
+		fields[i] = field[:len(field):len(field)]
+	}
+	return fields, index + 1, nil
+}
+
+//decodeMultiBulk 由bulk string组成的数组，如：*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n
+func (p *RespPacker) decodeMultiBulk(buf []byte) ([][]byte, int, error) {
+
+	count, offset, err := p.decodeLength(buf, '*', respMaxArgs)
+	if err != nil || offset == 0 {
+		return nil, 0, err
+	}
+
+	maxLength := int64(respMaxBulkLength)
+	if p.maxBodyLength > 0 {
+		maxLength = int64(p.maxBodyLength)
+	}
+
+	args := make([][]byte, 0, respPrealloc(count))
+	for i := 0; i < count; i++ {
+		length, n, err := p.decodeLength(buf[offset:], '$', maxLength)
+		if err != nil || n == 0 {
+			return nil, 0, err
+		}
+		offset += n
+
+		// 数据和结尾的\r\n不完整
+		if len(buf)-offset < length+2 {
+			return nil, 0, nil
+		}
+
+		end := offset + length
+		if buf[end] != '\r' || buf[end+1] != '\n' {
+			return nil, 0, HeadBytesLengthFail
+		}
+		args = append(args, buf[offset:end:end])
+		offset = end + 2
+	}
+
+	return args, offset, nil
+}
+
+//respPrealloc 参数列表预分配的数量，最多respMaxPrealloc个，超过时由append扩容
+func respPrealloc(count int) int {
+	if count > respMaxPrealloc {
+		return respMaxPrealloc
+	}
+	return count
+}
+
+//decodeLength 读取一行长度，如：*3\r\n、$5\r\n，数据不完整时返回0
+func (p *RespPacker) decodeLength(buf []byte, prefix byte, max int64) (int, int, error) {
+	index := bytes.Index(buf, []byte("\r\n"))
+	if index < 0 {
+		if len(buf) > 32 {
+			return 0, 0, HeadBytesLengthFail
+		}
+		return 0, 0, nil
+	}
+
+	if buf[0] != prefix {
+		return 0, 0, HeadBytesLengthFail
+	}
+
+	length, err := strconv.ParseInt(string(buf[1:index]), 10, 64)
+	if err != nil || length < 0 {
+		return 0, 0, HeadBytesLengthFail
+	}
+	if length > max {
+		return 0, 0, BodyLenExceedLimit
+	}
+	return int(length), index + 2, nil
+}
+
+//RespWriter 生成RESP格式的回复，根据连接的协议版本编码，RESP2不支持的类型会转换为兼容的格式
+//数组、map需要先写入长度，再依次写入元素
+type RespWriter struct {
+	connect iface.IConnect
+	version int
+	buff    []byte
+}
+
+//NewRespWriter connect为nil时只生成数据，不能Flush
+func NewRespWriter(connect iface.IConnect) *RespWriter {
+	w := &RespWriter{
+		connect: connect,
+		version: 2,
+	}
+	if connect != nil {
+		if packer, ok := connect.GetPacker().(*RespPacker); ok {
+			w.version = packer.Version()
+		}
+	}
+	return w
+}
+
+//SimpleString 如：+OK
+func (w *RespWriter) SimpleString(s string) *RespWriter {
+	return w.line('+', s)
+}
+
+//Error 如：-ERR unknown command，message的第一个单词为错误类型
+func (w *RespWriter) Error(message string) *RespWriter {
+	return w.line('-', message)
+}
+
+//Integer 如：:1
+func (w *RespWriter) Integer(n int64) *RespWriter {
+	return w.line(':', strconv.FormatInt(n, 10))
+}
+
+//Bulk 二进制安全的字符串
+func (w *RespWriter) Bulk(data []byte) *RespWriter {
+	w.line('$', strconv.Itoa(len(data)))
+	w.buff = append(w.buff, data...)
+	w.buff = append(w.buff, '\r', '\n')
+	return w
+}
+
+//BulkString .
+func (w *RespWriter) BulkString(s string) *RespWriter {
+	return w.Bulk([]byte(s))
+}
+
+//Null RESP2为$-1，RESP3为_
+func (w *RespWriter) Null() *RespWriter {
+	if w.version >= 3 {
+		return w.line('_', "")
+	}
+	return w.line('$', "-1")
+}
+
+//Array 数组的长度，之后需要写入n个元素
+func (w *RespWriter) Array(n int) *RespWriter {
+	return w.line('*', strconv.Itoa(n))
+}
+
+//NullArray RESP2为*-1，RESP3为_
+func (w *RespWriter) NullArray() *RespWriter {
+	if w.version >= 3 {
+		return w.line('_', "")
+	}
+	return w.line('*', "-1")
+}
+
+//Map map的长度，之后需要依次写入n对key、value，RESP2为2n个元素的数组
+func (w *RespWriter) Map(n int) *RespWriter {
+	if w.version >= 3 {
+		return w.line('%', strconv.Itoa(n))
+	}
+	return w.Array(n * 2)
+}
+
+//Double RESP2为bulk string
+func (w *RespWriter) Double(f float64) *RespWriter {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if math.IsInf(f, 1) {
+		s = "inf"
+	} else if math.IsInf(f, -1) {
+		s = "-inf"
+	}
+
+	if w.version >= 3 {
+		return w.line(',', s)
+	}
+	return w.BulkString(s)
+}
+
+//Boolean RESP2为整数1、0
+func (w *RespWriter) Boolean(b bool) *RespWriter {
+	if w.version >= 3 {
+		if b {
+			return w.line('#', "t")
+		}
+		return w.line('#', "f")
+	}
+	if b {
+		return w.Integer(1)
+	}
+	return w.Integer(0)
+}
+
+//Bytes 已写入的数据
+func (w *RespWriter) Bytes() []byte {
+	return w.buff
+}
+
+//Flush 发送已写入的数据，发送后清空
+func (w *RespWriter) Flush() error {
+	if len(w.buff) == 0 {
+		return nil
+	}
+	_, err := w.connect.Send(0, w.buff)
+	w.buff = nil
+	return err
+}
+
+//line 类型前缀 + 内容 + \r\n，简单字符串、错误中的\r\n会被替换为空格
+func (w *RespWriter) line(prefix byte, s string) *RespWriter {
+	if prefix == '+' || prefix == '-' {
+		s = strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	}
+	w.buff = append(w.buff, prefix)
+	w.buff = append(w.buff, s...)
+	w.buff = append(w.buff, '\r', '\n')
+	return w
+}
@@ -0,0 +1,186 @@
+package util
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func respDecode(t *testing.T, p *RespPacker, chunks ...string) ([][]string, []uint32, error) {
+	t.Helper()
+
+	var buf []byte
+	commands := make([][]string, 0)
+	msgIDs := make([]uint32, 0)
+	for _, chunk := range chunks {
+		buf = append(buf, chunk...)
+		consumed, messages, err := p.Decode(buf)
+		if err != nil {
+			return commands, msgIDs, err
+		}
+		for _, message := range messages {
+			args := make([]string, 0)
+			for _, arg := range RespArgs(message) {
+				args = append(args, string(arg))
+			}
+			commands = append(commands, args)
+			msgIDs = append(msgIDs, message.ID())
+		}
+		buf = append([]byte(nil), buf[consumed:]...)
+	}
+	return commands, msgIDs, nil
+}
+
+func sameCommands(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if a[i][j] != b[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestRespPackerDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    uint32
+		chunks []string
+		want   [][]string
+		err    error
+	}{
+		{"inline", 0, []string{"PING\r\n"}, [][]string{{"PING"}}, nil},
+		{"inline lf", 0, []string{"set a  1\n"}, [][]string{{"set", "a", "1"}}, nil},
+		{"inline empty ignored", 0, []string{"\r\n\nPING\r\n"}, [][]string{{"PING"}}, nil},
+		{"multi bulk", 0, []string{"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"}, [][]string{{"GET", "key"}}, nil},
+		{"multi bulk binary", 0, []string{"*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n"}, [][]string{{"ECHO", "a\r\nb"}}, nil},
+		{"multi bulk empty arg", 0, []string{"*2\r\n$4\r\nECHO\r\n$0\r\n\r\n"}, [][]string{{"ECHO", ""}}, nil},
+		{"empty array ignored", 0, []string{"*0\r\nPING\r\n"}, [][]string{{"PING"}}, nil},
+		{"pipeline", 0, []string{"PING\r\n*1\r\n$4\r\nPING\r\nPING\r\n"}, [][]string{{"PING"}, {"PING"}, {"PING"}}, nil},
+		{"incomplete", 0, []string{"*2\r\n$3\r\nGET\r\n$3\r\nke"}, [][]string{}, nil},
+		{"large count incomplete", 0, []string{"*1000000\r\n$1\r\na\r\n"}, [][]string{}, nil},
+		{"missing crlf after bulk", 0, []string{"*1\r\n$3\r\nGETx\r\n"}, [][]string{}, HeadBytesLengthFail},
+		{"negative count", 0, []string{"*-1\r\n"}, [][]string{}, HeadBytesLengthFail},
+		{"negative bulk length", 0, []string{"*1\r\n$-1\r\n"}, [][]string{}, HeadBytesLengthFail},
+		{"non numeric count", 0, []string{"*a\r\n"}, [][]string{}, HeadBytesLengthFail},
+		{"non numeric bulk length", 0, []string{"*1\r\n$3a\r\nGET\r\n"}, [][]string{}, HeadBytesLengthFail},
+		{"wrong bulk prefix", 0, []string{"*1\r\n+GET\r\n"}, [][]string{}, HeadBytesLengthFail},
+		{"length line too long", 0, []string{"*1\r\n$" + string(make([]byte, 40))}, [][]string{}, HeadBytesLengthFail},
+		{"too many args", 0, []string{"*" + strconv.Itoa(respMaxArgs+1) + "\r\n"}, [][]string{}, BodyLenExceedLimit},
+		{"default bulk length", 0, []string{"*1\r\n$" + strconv.Itoa(respMaxBulkLength+1) + "\r\n"}, [][]string{}, BodyLenExceedLimit},
+		{"max body length", 3, []string{"*1\r\n$4\r\nPING\r\n"}, [][]string{}, BodyLenExceedLimit},
+		{"inline too long", 0, []string{string(make([]byte, respMaxInlineLength+1))}, [][]string{}, BodyLenExceedLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewRespPacker()
+			p.SetMaxBodyLength(tt.max)
+			commands, _, err := respDecode(t, p, tt.chunks...)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if !sameCommands(commands, tt.want) {
+				t.Fatalf("commands = %q, want %q", commands, tt.want)
+			}
+		})
+	}
+}
+
+func TestRespPackerDecodeSplit(t *testing.T) {
+	frames := []string{
+		"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n",
+		"SET key value\r\n",
+		"*1\r\n$4\r\nPING\r\nPING\r\n*2\r\n$4\r\nECHO\r\n$0\r\n\r\n",
+	}
+
+	// 在每一个字节处拆分，结果都与一次性解码相同
+	for _, frame := range frames {
+		want, _, err := respDecode(t, NewRespPacker(), frame)
+		if err != nil {
+			t.Fatalf("%q: err = %v", frame, err)
+		}
+		for i := 1; i < len(frame); i++ {
+			commands, _, err := respDecode(t, NewRespPacker(), frame[:i], frame[i:])
+			if err != nil {
+				t.Fatalf("%q split at %d: err = %v", frame, i, err)
+			}
+			if !sameCommands(commands, want) {
+				t.Fatalf("%q split at %d: commands = %q, want %q", frame, i, commands, want)
+			}
+		}
+	}
+}
+
+func TestRespPackerBind(t *testing.T) {
+	p := NewRespPacker()
+	get := p.Bind("GET")
+	if p.Bind("get") != get {
+		t.Fatalf("bind is not case-insensitive")
+	}
+
+	// Clone共享命令绑定，之后绑定的命令也生效
+	clone := p.Clone().(*RespPacker)
+	set := p.Bind("set")
+	_, msgIDs, err := respDecode(t, clone, "get a\r\n*2\r\n$3\r\nSeT\r\n$1\r\na\r\nunknown\r\n")
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	want := []uint32{get, set, 0}
+	if len(msgIDs) != len(want) {
+		t.Fatalf("msgIDs = %v, want %v", msgIDs, want)
+	}
+	for i := range want {
+		if msgIDs[i] != want[i] {
+			t.Fatalf("msgIDs = %v, want %v", msgIDs, want)
+		}
+	}
+}
+
+func TestRespWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *RespWriter)
+		resp2 string
+		resp3 string
+	}{
+		{"simple string", func(w *RespWriter) { w.SimpleString("OK") }, "+OK\r\n", "+OK\r\n"},
+		{"error newline", func(w *RespWriter) { w.Error("ERR a\r\nb") }, "-ERR a  b\r\n", "-ERR a  b\r\n"},
+		{"integer", func(w *RespWriter) { w.Integer(-5) }, ":-5\r\n", ":-5\r\n"},
+		{"bulk", func(w *RespWriter) { w.BulkString("a\r\nb") }, "$4\r\na\r\nb\r\n", "$4\r\na\r\nb\r\n"},
+		{"null", func(w *RespWriter) { w.Null() }, "$-1\r\n", "_\r\n"},
+		{"null array", func(w *RespWriter) { w.NullArray() }, "*-1\r\n", "_\r\n"},
+		{"array", func(w *RespWriter) { w.Array(2).BulkString("a").Integer(1) }, "*2\r\n$1\r\na\r\n:1\r\n", "*2\r\n$1\r\na\r\n:1\r\n"},
+		{"map", func(w *RespWriter) { w.Map(1).BulkString("k").BulkString("v") }, "*2\r\n$1\r\nk\r\n$1\r\nv\r\n", "%1\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{"double", func(w *RespWriter) { w.Double(1.5) }, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"double inf", func(w *RespWriter) { w.Double(math.Inf(1)) }, "$3\r\ninf\r\n", ",inf\r\n"},
+		{"double -inf", func(w *RespWriter) { w.Double(math.Inf(-1)) }, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"boolean true", func(w *RespWriter) { w.Boolean(true) }, ":1\r\n", "#t\r\n"},
+		{"boolean false", func(w *RespWriter) { w.Boolean(false) }, ":0\r\n", "#f\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, version := range []int{2, 3} {
+				w := NewRespWriter(nil)
+				w.version = version
+				tt.write(w)
+
+				want := tt.resp2
+				if version == 3 {
+					want = tt.resp3
+				}
+				if got := string(w.Bytes()); got != want {
+					t.Fatalf("RESP%d = %q, want %q", version, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+)
+
+//VerifyHook 校验失败时调用，err为ChecksumFail或SequenceFail，返回值决定如何处理这个消息
+type VerifyHook = func(message iface.IMessage, err error) common.VerifyAction
+
+//SequencePacker 带校验码和序列号的封包方式，每个连接使用Clone出来的packer，序列号在连接内单调递增
+//封包格式：data长度(4字节)msgID(4字节)seq(4字节)crc32(4字节)data，crc32（IEEE）的范围为msgID、seq和data
+//序列号从1开始，收到的序列号不大于上一个时为重复或乱序，大于上一个+1时为丢失（不算校验失败，可以通过message.Seq()判断）
+//序列号由Stamp在写入前设置，连接发送时会在写入锁中调用，单独使用时需要按写入顺序调用Stamp
+//序列号达到最大值后从0继续，比较时按回绕处理（RFC 1982），相差不超过2^31即可
+type SequencePacker struct {
+	maxBodyLength uint32
+	action        common.VerifyAction // 校验失败时的处理方式，默认：关闭连接
+	hook          VerifyHook          // 校验失败时调用，设置后不再使用action
+	sendSeq       uint32              // 最后发送的序列号，只在Stamp中访问
+	recvSeq       uint32              // 最后收到的序列号，只在事件循环中访问
+}
+
+type SequenceOption = func(p *SequencePacker)
+
+//WithVerifyAction 校验失败时的处理方式，默认：common.VerifyClose
+func WithVerifyAction(action common.VerifyAction) SequenceOption {
+	return func(p *SequencePacker) {
+		p.action = action
+	}
+}
+
+//WithVerifyHook 校验失败时调用，根据返回值处理，可以用于记录日志、统计
+func WithVerifyHook(hook VerifyHook) SequenceOption {
+	return func(p *SequencePacker) {
+		p.hook = hook
+	}
+}
+
+func NewSequencePacker(opts ...SequenceOption) *SequencePacker {
+	p := &SequencePacker{
+		action: common.VerifyClose,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+//Clone 复制配置，序列号从头开始
+func (p *SequencePacker) Clone() iface.IPacker {
+	return &SequencePacker{
+		maxBodyLength: p.maxBodyLength,
+		action:        p.action,
+		hook:          p.hook,
+	}
+}
+
+//SetMaxBodyLength .
+func (p *SequencePacker) SetMaxBodyLength(maxBodyLength uint32) {
+	p.maxBodyLength = maxBodyLength
+}
+
+//GetHeaderLength 获取头部长度
+func (p *SequencePacker) GetHeaderLength() uint32 {
+	return 16
+}
+
+//Pack 封包，序列号和校验码在Stamp中设置
+func (p *SequencePacker) Pack(msgID uint32, data []byte) ([]byte, error) {
+
+	buff := make([]byte, 16+len(data))
+	binary.LittleEndian.PutUint32(buff[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buff[4:], msgID)
+	copy(buff[16:], data)
+
+	return buff, nil
+}
+
+//Stamp 设置下一个序列号并计算校验码，需要按写入顺序调用
+func (p *SequencePacker) Stamp(dataPack []byte) {
+	if len(dataPack) < 16 {
+		return
+	}
+
+	p.sendSeq++
+	binary.LittleEndian.PutUint32(dataPack[8:], p.sendSeq)
+
+	checksum := crc32.Update(crc32.ChecksumIEEE(dataPack[4:12]), crc32.IEEETable, dataPack[16:])
+	binary.LittleEndian.PutUint32(dataPack[12:], checksum)
+}
+
+//UnPack 解包数据（传到这里的只有包头），校验在包体读取完整后进行
+func (p *SequencePacker) UnPack(bs []byte) (iface.IMessage, error) {
+
+	if len(bs) < 16 {
+		return nil, HeadBytesLengthFail
+	}
+
+	dataLen := binary.LittleEndian.Uint32(bs[0:])
+
+	// 判断长度是否超过限制
+	if p.maxBodyLength > 0 && dataLen > p.maxBodyLength {
+		Logger.Errorln(BodyLenExceedLimit)
+		return nil, BodyLenExceedLimit
+	}
+
+	return &Message{
+		MsgID:    binary.LittleEndian.Uint32(bs[4:]),
+		DataLen:  dataLen,
+		SeqID:    binary.LittleEndian.Uint32(bs[8:]),
+		checksum: binary.LittleEndian.Uint32(bs[12:]),
+	}, nil
+}
+
+//UnPackBody 校验crc32和序列号
+func (p *SequencePacker) UnPackBody(message iface.IMessage) error {
+
+	msg, ok := message.(*Message)
+	if !ok {
+		return nil
+	}
+
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[0:], msg.MsgID)
+	binary.LittleEndian.PutUint32(header[4:], msg.SeqID)
+	checksum := crc32.Update(crc32.ChecksumIEEE(header[:]), crc32.IEEETable, msg.Data)
+
+	var err error
+	if checksum != msg.checksum {
+		err = ChecksumFail
+	} else if int32(msg.SeqID-p.recvSeq) <= 0 {
+		// 回绕后的序列号也比上一个大，如：0xffffffff之后是0
+		err = SequenceFail
+	}
+
+	if err == nil {
+		p.recvSeq = msg.SeqID
+		return nil
+	}
+
+	action := p.action
+	if p.hook != nil {
+		action = p.hook(message, err)
+	}
+
+	switch action {
+	case common.VerifyPass:
+		return nil
+	case common.VerifyDrop:
+		return MessageDropped
+	default:
+		Logger.Errorf("msgID[%d] seq[%d] verify error %v", msg.MsgID, msg.SeqID, err)
+		return err
+	}
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/ikilobyte/netman/common"
+	"github.com/ikilobyte/netman/iface"
+)
+
+//sequenceMessage 使用序列号seq封包后解包，返回未校验的消息
+func sequenceMessage(t *testing.T, seq uint32, data string) *Message {
+	t.Helper()
+	sender := &SequencePacker{sendSeq: seq - 1}
+	dataPack, _ := sender.Pack(1, []byte(data))
+	sender.Stamp(dataPack)
+
+	message, err := sender.UnPack(dataPack[:16])
+	if err != nil {
+		t.Fatalf("unpack：%v", err)
+	}
+	message.SetData(dataPack[16:])
+	return message.(*Message)
+}
+
+func TestSequencePackerStamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		sendSeq uint32
+		want    []uint32
+	}{
+		{"start", 0, []uint32{1, 2, 3}},
+		{"wrap around", 0xfffffffe, []uint32{0xffffffff, 0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewSequencePacker()
+			p.sendSeq = tt.sendSeq
+			for _, want := range tt.want {
+				dataPack, _ := p.Pack(1, []byte("data"))
+				p.Stamp(dataPack)
+				message, _ := p.UnPack(dataPack[:16])
+				if message.Seq() != want {
+					t.Fatalf("seq = %#x, want %#x", message.Seq(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestSequencePackerVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		recvSeq uint32
+		seqs    []uint32
+		errs    []error
+		last    uint32 // 校验后的recvSeq，校验失败的消息不更新
+	}{
+		{"in order", 0, []uint32{1, 2, 3}, []error{nil, nil, nil}, 3},
+		{"lost", 0, []uint32{1, 5}, []error{nil, nil}, 5},
+		{"duplicate", 0, []uint32{1, 2, 2}, []error{nil, nil, SequenceFail}, 2},
+		{"out of order", 0, []uint32{1, 3, 2}, []error{nil, nil, SequenceFail}, 3},
+		{"wrap around", 0xfffffffe, []uint32{0xffffffff, 0, 1}, []error{nil, nil, nil}, 1},
+		{"lost across wrap", 0xfffffff0, []uint32{2}, []error{nil}, 2},
+		{"old across wrap", 1, []uint32{0xffffffff}, []error{SequenceFail}, 1},
+		{"less than half range", 0, []uint32{0x7fffffff, 0xfffffffe}, []error{nil, nil}, 0xfffffffe},
+		{"half range", 0, []uint32{0x80000000}, []error{SequenceFail}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewSequencePacker()
+			p.recvSeq = tt.recvSeq
+			for i, seq := range tt.seqs {
+				if err := p.UnPackBody(sequenceMessage(t, seq, "data")); err != tt.errs[i] {
+					t.Fatalf("seq %#x err = %v, want %v", seq, err, tt.errs[i])
+				}
+			}
+			if p.recvSeq != tt.last {
+				t.Fatalf("recvSeq = %#x, want %#x", p.recvSeq, tt.last)
+			}
+		})
+	}
+}
+
+func TestSequencePackerAction(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  SequenceOption
+		err  error
+	}{
+		{"close", WithVerifyAction(common.VerifyClose), ChecksumFail},
+		{"drop", WithVerifyAction(common.VerifyDrop), MessageDropped},
+		{"pass", WithVerifyAction(common.VerifyPass), nil},
+		{"hook", WithVerifyHook(func(message iface.IMessage, err error) common.VerifyAction {
+			if err != ChecksumFail || message.Seq() != 1 {
+				return common.VerifyClose
+			}
+			return common.VerifyDrop
+		}), MessageDropped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := sequenceMessage(t, 1, "data")
+			message.Data = []byte("date")
+			if err := NewSequencePacker(tt.opt).UnPackBody(message); err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bytes"
+
+	"github.com/ikilobyte/netman/common"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "), []byte("HEAD "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+//SniffTLS TLS握手记录：类型0x16，版本0x0300~0x0304
+func SniffTLS(head []byte) common.SniffResult {
+	if len(head) > 0 && head[0] != 0x16 || len(head) > 1 && head[1] != 0x03 {
+		return common.SniffNoMatch
+	}
+	if len(head) < 3 {
+		return common.SniffMore
+	}
+	if head[2] > 0x04 {
+		return common.SniffNoMatch
+	}
+	return common.SniffMatch
+}
+
+//SniffHTTP HTTP/1.x请求行，以请求方法开头，如：GET /
+func SniffHTTP(head []byte) common.SniffResult {
+	result := common.SniffNoMatch
+	for _, method := range httpMethods {
+		switch SniffPrefix(method)(head) {
+		case common.SniffMatch:
+			return common.SniffMatch
+		case common.SniffMore:
+			result = common.SniffMore
+		}
+	}
+	return result
+}
+
+//SniffPrefix 以prefix开头，如：MQTT的CONNECT包以0x10开头、自定义协议的魔数
+func SniffPrefix(prefix []byte) func(head []byte) common.SniffResult {
+	return func(head []byte) common.SniffResult {
+		if bytes.HasPrefix(head, prefix) {
+			return common.SniffMatch
+		}
+		if bytes.HasPrefix(prefix, head) {
+			return common.SniffMore
+		}
+		return common.SniffNoMatch
+	}
+}
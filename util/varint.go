@@ -0,0 +1,118 @@
+package util
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/ikilobyte/netman/iface"
+)
+
+//VarintPacker varint长度前缀的封包方式，实现了IStreamDecoder
+//封包格式：data长度(uvarint)msgID(uvarint)data，配置了固定msgID时没有msgID部分，与protobuf的writeDelimitedTo格式相同
+type VarintPacker struct {
+	maxBodyLength uint32
+	fixedMsgID    bool   // 包头中是否没有msgID
+	msgID         uint32 // 没有msgID时，解码出来的msgID
+}
+
+type VarintOption = func(p *VarintPacker)
+
+//WithVarintFixedMsgID 包头中没有msgID，解码出来的msgID都是这个值，封包时忽略msgID
+func WithVarintFixedMsgID(msgID uint32) VarintOption {
+	return func(p *VarintPacker) {
+		p.fixedMsgID = true
+		p.msgID = msgID
+	}
+}
+
+func NewVarintPacker(opts ...VarintOption) *VarintPacker {
+	p := &VarintPacker{}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+//SetMaxBodyLength .
+func (p *VarintPacker) SetMaxBodyLength(maxBodyLength uint32) {
+	p.maxBodyLength = maxBodyLength
+}
+
+//GetHeaderLength 包头长度不固定，使用Decode解码，不会调用这个方法
+func (p *VarintPacker) GetHeaderLength() uint32 {
+	return 0
+}
+
+//UnPack 包头长度不固定，使用Decode解码，不会调用这个方法
+func (p *VarintPacker) UnPack([]byte) (iface.IMessage, error) {
+	return nil, HeadBytesLengthFail
+}
+
+//Pack 封包
+func (p *VarintPacker) Pack(msgID uint32, data []byte) ([]byte, error) {
+	buff := make([]byte, 0, binary.MaxVarintLen64+binary.MaxVarintLen32+len(data))
+	buff = appendUvarint(buff, uint64(len(data)))
+	if !p.fixedMsgID {
+		buff = appendUvarint(buff, uint64(msgID))
+	}
+	return append(buff, data...), nil
+}
+
+//Decode 解码出所有完整的消息
+func (p *VarintPacker) Decode(buf []byte) (int, []iface.IMessage, error) {
+
+	consumed := 0
+	messages := make([]iface.IMessage, 0)
+
+	for consumed < len(buf) {
+		remain := buf[consumed:]
+
+		// 包体长度
+		length, offset := binary.Uvarint(remain)
+		if offset == 0 {
+			break
+		}
+		if offset < 0 {
+			return consumed, messages, HeadBytesLengthFail
+		}
+
+		// 判断长度是否超过限制
+		if length > math.MaxUint32 || (p.maxBodyLength > 0 && length > uint64(p.maxBodyLength)) {
+			return consumed, messages, BodyLenExceedLimit
+		}
+
+		// msgID
+		msgID := p.msgID
+		if !p.fixedMsgID {
+			id, n := binary.Uvarint(remain[offset:])
+			if n == 0 {
+				break
+			}
+			if n < 0 || id > math.MaxUint32 {
+				return consumed, messages, HeadBytesLengthFail
+			}
+			msgID = uint32(id)
+			offset += n
+		}
+
+		// 数据不完整
+		if uint64(len(remain)-offset) < length {
+			break
+		}
+
+		end := offset + int(length)
+		message := &Message{MsgID: msgID}
+		message.SetData(remain[offset:end:end])
+		messages = append(messages, message)
+		consumed += end
+	}
+
+	return consumed, messages, nil
+}
+
+//appendUvarint 写入uvarint
+func appendUvarint(buff []byte, value uint64) []byte {
+	var bs [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(bs[:], value)
+	return append(buff, bs[:n]...)
+}